@@ -0,0 +1,285 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "log"
+    "path"
+    "errors"
+    "sync/atomic"
+    "encoding/json"
+)
+
+const (
+    FABRIC_CMD_TASK_ERROR                   = "task_error"
+    
+    ACL_ALLOW                               = "allow"
+    ACL_DENY                                = "deny"
+)
+
+// ACLRule matches offramp tasks. Empty fields and FABRIC_TOPIC_ANY match
+// anything, other values are patterns as for path.Match ("ctrl-*")
+//
+type ACLRule struct {
+    Effect          string      `json:"effect"              yaml:"effect"             toml:"effect"`           // ACL_ALLOW or ACL_DENY
+    ActorID         string      `json:"actor_id"            yaml:"actor_id"           toml:"actor_id"`
+    ActorPlatformID string      `json:"actor_platform_id"   yaml:"actor_platform_id"  toml:"actor_platform_id"`
+    TaskID          string      `json:"task_id"             yaml:"task_id"            toml:"task_id"`
+    ServiceID       string      `json:"service_id"          yaml:"service_id"         toml:"service_id"`
+    FeedID          string      `json:"feed_id"             yaml:"feed_id"            toml:"feed_id"`
+}
+
+func aclMatch(pattern string, value string) bool {
+    if pattern == "" || pattern == FABRIC_TOPIC_ANY {
+        return true
+    }
+    
+    ok, _ := path.Match(pattern, value)
+    
+    return ok
+}
+
+// Match ...
+//
+func (r *ACLRule) Match(t *FabricTopic) bool {
+    return aclMatch(r.ActorID, t.ActorID) &&
+           aclMatch(r.ActorPlatformID, t.ActorPlatformID) &&
+           aclMatch(r.TaskID, t.TaskID) &&
+           aclMatch(r.ServiceID, t.ServiceID) &&
+           aclMatch(r.FeedID, t.FeedID)
+}
+
+// ACL decides which actors may send which tasks to a node. The first matching
+// rule wins, Default (ACL_DENY if empty) is used when no rule matches. Actor
+// ids are only trustworthy with signing enabled
+//
+type ACL struct {
+    Rules           []ACLRule   `json:"rules"               yaml:"rules"              toml:"rules"`
+    Default         string      `json:"default"             yaml:"default"            toml:"default"`
+    Reply           bool        `json:"reply"               yaml:"reply"              toml:"reply"`            // send a task error to the actor
+    
+    OnDeny          func(t *FabricTopic)    `json:"-" yaml:"-" toml:"-"`
+}
+
+// Validate ...
+//
+func (a *ACL) Validate() error {
+    if a.Default != "" && a.Default != ACL_ALLOW && a.Default != ACL_DENY {
+        return errors.New("Validate: acl default must be 'allow' or 'deny'")
+    }
+    
+    for _, r := range a.Rules {
+        if r.Effect != ACL_ALLOW && r.Effect != ACL_DENY {
+            return errors.New("Validate: acl rule effect must be 'allow' or 'deny'")
+        }
+        
+        for _, p := range []string{r.ActorID, r.ActorPlatformID, r.TaskID, r.ServiceID, r.FeedID} {
+            if _, err := path.Match(p, ""); err != nil {
+                return errors.New("Validate: bad acl pattern '" + p + "'")
+            }
+        }
+    }
+    
+    return nil
+}
+
+// Allowed reports whether the task in t may be run
+//
+func (a *ACL) Allowed(t *FabricTopic) bool {
+    for i := range a.Rules {
+        if a.Rules[i].Match(t) {
+            return a.Rules[i].Effect == ACL_ALLOW
+        }
+    }
+    
+    return a.Default == ACL_ALLOW
+}
+
+// SetACL sets the ACL for the tasks sent to this node, nil allows all
+//
+func (m *MqttFabric) SetACL(a *ACL) *MqttFabric {
+    m.ACL = a
+    return m
+}
+
+// authorize checks a task sent to this node against the ACL. It returns false
+// if the task must be dropped
+//
+func (m *MqttFabric) authorize(t *FabricTopic, msg *Message) bool {
+    if m.ACL.Allowed(t) {
+        return true
+    }
+    
+    log.Printf("authorize(): denied %s/%s to run %s on %s/%s\n", t.ActorID, t.ActorPlatformID, t.TaskID, t.ServiceID, t.FeedID)
+    
+    atomic.AddUint64(&m.metrics.denied, 1)
+    
+    if m.ACL.OnDeny != nil {
+        m.ACL.OnDeny(t)
+    }
+    
+    if m.ACL.Reply {
+        m.replyTaskError(t, msg, "denied")
+    }
+    
+    return false
+}
+
+// TaskError is the reply of a node to a task it did not run
+//
+type TaskError struct {
+    NodeName        string      `json:"nodename"`
+    PlatformID      string      `json:"platform_id"`
+    TaskID          string      `json:"task_id"`
+    ServiceID       string      `json:"service_id"`
+    FeedID          string      `json:"feed_id"`
+    Error           string      `json:"error"`
+    Correlation     string      `json:"correlation,omitempty"`     // correlation data of the task, MQTT 5 only
+}
+
+// OnTaskErrorHandler ...
+type OnTaskErrorHandler func(mqtt *MqttFabric, e *TaskError)
+
+// TaskErrorSubscription returns the topic the errors for the tasks sent by
+// actorID/actorPlatformID are published on. The nodename of the node
+// replying is in the place of the "sysctl" of the status topic
+//
+func (f *Fabric) TaskErrorSubscription(actorID string, actorPlatformID string) (string) {
+    return f.RootTopic + "/" + actorID + "/$commands/$clients/" + FABRIC_TOPIC_ANY + "/" + actorPlatformID + "/" + FABRIC_CMD_TASK_ERROR
+}
+
+// TaskErrorMessage returns the topic and message for e, sent to the actor of t
+//
+func (f *Fabric) TaskErrorMessage(t *FabricTopic, e *TaskError) (string, string) {
+    type D struct {
+        Type        string `json:"_type"`
+        *TaskError
+    }
+    
+    msg, err := json.Marshal(map[string]interface{}{"d": D{Type: FABRIC_CMD_TASK_ERROR, TaskError: e}})
+    
+    if err != nil {
+        log.Println("TaskErrorMessage(): err = ", err)
+        return "", ""
+    }
+    
+    return f.RootTopic + "/" + t.ActorID + "/$commands/$clients/" + f.NodeName + "/" + t.ActorPlatformID + "/" + FABRIC_CMD_TASK_ERROR, string(msg)
+}
+
+// TaskErrorParse parses a message created by TaskErrorMessage()
+//
+func TaskErrorParse(msg string) (*TaskError, error) {
+    type D struct {
+        Type        string `json:"_type"`
+        TaskError
+    }
+    
+    var jsonMsg struct {
+        Data *D `json:"d"`
+    }
+    
+    if err := json.Unmarshal([]byte(msg), &jsonMsg); err != nil {
+        return nil, errors.New("TaskErrorParse: cannot parse JSON object")
+    }
+    if jsonMsg.Data == nil || jsonMsg.Data.Type != FABRIC_CMD_TASK_ERROR {
+        return nil, errors.New("TaskErrorParse: not a task error message")
+    }
+    
+    return &jsonMsg.Data.TaskError, nil
+}
+
+// replyTaskError tells the actor of t that the task was not run
+//
+func (m *MqttFabric) replyTaskError(t *FabricTopic, msg *Message, reason string) {
+    f := m.Root(t.RootTopic)
+    
+    if f == nil {
+        return
+    }
+    
+    e := &TaskError{
+        NodeName:   t.NodeName,
+        PlatformID: t.PlatformID,
+        TaskID:     t.TaskID,
+        ServiceID:  t.ServiceID,
+        FeedID:     t.FeedID,
+        Error:      reason,
+    }
+    
+    var props *Properties
+    
+    if msg.Properties != nil && len(msg.Properties.CorrelationData) > 0 {
+        e.Correlation = string(msg.Properties.CorrelationData)
+        props         = &Properties{CorrelationData: msg.Properties.CorrelationData}
+    }
+    
+    topic, payload := f.TaskErrorMessage(t, e)
+    
+    if topic == "" {
+        return
+    }
+    
+    policy := m.Policy(FABRIC_SYS, FABRIC_CMD_TASK_ERROR)
+    
+    if err := m.PublishProperties(topic, policy.QoS, policy.Retain, []byte(payload), props); err != nil {
+        log.Println("replyTaskError(): err = ", err)
+    }
+}
+
+// SetOnTaskErrorHandler subscribes to the errors for the tasks this node
+// sends, on every root
+//
+func (m *MqttFabric) SetOnTaskErrorHandler(handler OnTaskErrorHandler) *MqttFabric {
+    m.OnTaskError = handler
+    
+    if m.Transport.IsConnected() {
+        m.subscribeTaskErrors()
+    }
+    
+    return m
+}
+
+func (m *MqttFabric) subscribeTaskErrors() {
+    m.SubscribeAll(1, func(f *Fabric) string {
+        return f.TaskErrorSubscription(f.ActorID, f.ActorPlatformID)
+    })
+}
+
+func (m *MqttFabric) onTaskError(t *FabricTopic, msg *Message) {
+    if m.OnTaskError == nil || t.NodeName != m.F.ActorID {
+        return
+    }
+    
+    e, err := TaskErrorParse(string(msg.Payload))
+    
+    if err != nil {
+        log.Println("onTaskError(): err = ", err)
+        return
+    }
+    
+    m.OnTaskError(m, e)
+}
@@ -0,0 +1,80 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+)
+
+func TestOnMessageVerifiesBeforeACL(t *testing.T) {
+    p := newSecuredPair(t)
+    
+    // unsigned task for a feed the ACL denies
+    spy   := p.broker.NewTransport()
+    spy.Connect()
+    
+    topic := p.ctrl.F.CtrlOfframpTopic("dev1", TASK_ID_DIGITAL_WRITE, "esp", SERVICE_ID_DIGITAL_OUT, "door")
+    raw, _ := BlueMixEncode(SERVICE_ID_DIGITAL_OUT, "door", true)
+    
+    spy.Publish(topic, 0, false, raw)
+    
+    p.ctrl.CtrlDigitalWrite("dev1", "esp", "relay1", true)
+    
+    if s := p.next(t); !strings.HasPrefix(s, "relay1 ") {
+        t.Errorf("handler got %s", s)
+    }
+    
+    if mt := p.device.Metrics(); mt.Rejected != 1 || mt.Denied != 0 {
+        t.Errorf("rejected = %d, denied = %d, want 1, 0", mt.Rejected, mt.Denied)
+    }
+}
+
+func TestOnMessageDecryptsBeforeACL(t *testing.T) {
+    p := newSecuredPair(t)
+    
+    // correctly signed, but encrypted with the wrong key
+    rogue := p.controller(func() *Encryption {
+        e := NewEncryption()
+        e.SetPairKey("fabric", "dev1", "ctl", "pair-1", bytes.Repeat([]byte{2}, 32))
+        return e
+    }())
+    
+    rogue.CtrlDigitalWrite("dev1", "esp", "door", true)
+    p.ctrl.CtrlDigitalWrite("dev1", "esp", "door", true)
+    p.ctrl.CtrlDigitalWrite("dev1", "esp", "relay1", false)
+    
+    if s := p.next(t); !strings.HasPrefix(s, "relay1 ") {
+        t.Errorf("handler got %s", s)
+    }
+    
+    // only the task that could be decrypted reached the ACL
+    if mt := p.device.Metrics(); mt.Rejected != 1 || mt.Denied != 1 {
+        t.Errorf("rejected = %d, denied = %d, want 1, 1", mt.Rejected, mt.Denied)
+    }
+}
@@ -28,6 +28,8 @@ package mqttfabric
 
 import (
     "log"
+    "math"
+    "time"
     "errors"
     "encoding/json"
 )
@@ -35,6 +37,8 @@ import (
 type BlueMixObject struct {
     Type            string
     FeedID          string
+    TraceParent     string              // W3C trace context, may be empty
+    Time            time.Time           // from the "ts" of a signed envelope, zero if there is none
     
     T               interface{}         // the value
 }
@@ -47,7 +51,6 @@ func BlueMixParse(msg string) (*BlueMixObject, error) {
     var objmap map[string]*json.RawMessage
     
     if err := json.Unmarshal([]byte(msg), &objmap); err != nil {
-        log.Fatal(err)
         return nil, errors.New("BlueMixParse: cannot parse JSON top-level object")
     }
     
@@ -62,7 +65,6 @@ func BlueMixParse(msg string) (*BlueMixObject, error) {
             var parsed map[string]interface{}
             
             if err := json.Unmarshal(*objmap["d"], &parsed); err != nil {
-                log.Fatal(err)
                 return nil, errors.New("BlueMixParse: cannot parse JSON 'd' object")
             }
             
@@ -77,6 +79,10 @@ func BlueMixParse(msg string) (*BlueMixObject, error) {
                     //log.Println("BlueMixParse(): found 'feed_id'")
                     b.SetFeedID(value.(string))
                     gotFeedID = true
+                } else if key == "traceparent" && isString(value) {
+                    b.TraceParent = value.(string)
+                } else if ts, ok := value.(float64); key == "ts" && ok {
+                    b.Time = time.Unix(0, int64(ts) * int64(time.Millisecond))
                 } else if key == "value" {
                     //log.Println("BlueMixParse(): found 'value'")
                     b.SetValue(value)
@@ -93,6 +99,54 @@ func BlueMixParse(msg string) (*BlueMixObject, error) {
     return nil, errors.New("BlueMixParse: missing one or more fields in JSON object")
 }
 
+// NumericValue returns a BlueMixObject value as number, booleans are 0 and 1
+//
+func NumericValue(v interface{}) (float64, bool) {
+    switch x := v.(type) {
+        case float64:
+            return x, true
+        case int:
+            return float64(x), true
+        case bool:
+            if x {
+                return 1, true
+            }
+            return 0, true
+    }
+    
+    return 0, false
+}
+
+// BlueMixEncode builds the "d" envelope for a value
+//
+func BlueMixEncode(valueType string, feedID string, value interface{}) ([]byte, error) {
+    return BlueMixEncodeTrace(valueType, feedID, value, "")
+}
+
+// BlueMixEncodeTrace builds the "d" envelope for a value with a W3C traceparent,
+// which is left out when empty
+//
+func BlueMixEncodeTrace(valueType string, feedID string, value interface{}, traceparent string) ([]byte, error) {
+    type Data struct {
+        Type        string      `json:"_type"`
+        FeedID      string      `json:"feed_id"`
+        Value       interface{} `json:"value"`
+        TraceParent string      `json:"traceparent,omitempty"`
+    }
+    
+    type D struct {
+        Data Data `json:"d"`
+    }
+    
+    return json.Marshal(D{
+        Data: Data{
+            Type:           valueType,
+            FeedID:         feedID,
+            Value:          value,
+            TraceParent:    traceparent,
+        },
+    })
+}
 
 func NewBlueMixObject() (*BlueMixObject) {
     return &BlueMixObject{T: nil}
@@ -116,7 +170,12 @@ func (o *BlueMixObject) SetValue(v interface{}) (*BlueMixObject) {
             break
         case float64:
             //log.Println("SetValue(): float64")
-            o.T = int(v.(float64))
+            // JSON numbers are float64, only whole numbers become int
+            if f := v.(float64); f == math.Trunc(f) && math.Abs(f) < 1 << 53 {
+                o.T = int(f)
+            } else {
+                o.T = f
+            }
             break
         case bool:
             //log.Println("SetValue(): bool")
@@ -163,6 +222,8 @@ func (o *BlueMixObject) GetValueInt() (int, error) {
     switch t := o.T.(type) {
         case int:
             return o.T.(int), nil
+        case float64:
+            return int(o.T.(float64)), nil
         default:
             log.Println("GetValueInt(): not 'int'")
             _ = t
@@ -0,0 +1,139 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+// Package chronos is the time service of the fabric: a node publishing the
+// time and a scheduler sending tasks at set times
+//
+package chronos
+
+import (
+    "sync"
+    "time"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// Chronos publishes the unix time in seconds on the SERVICE_ID_TIME/FEED_ID_SECONDS
+// feed, for devices without a clock of their own
+//
+type Chronos struct {
+    Fabric          *mqttfabric.MqttFabric
+    Interval        time.Duration
+    
+    mu              sync.Mutex
+    stop            chan struct{}
+}
+
+// New returns a Chronos publishing through m, which should be a DEVICE with
+// the platform id PLATFORM_ID_CHRONOS
+//
+func New(m *mqttfabric.MqttFabric) *Chronos {
+    return &Chronos{Fabric: m, Interval: time.Second}
+}
+
+// NewNode creates the MqttFabric for a Chronos node as well
+//
+func NewNode(transport mqttfabric.Transport, rootTopic string, nodename string) *Chronos {
+    return New(mqttfabric.MqttFabricInitializeTransport(transport, rootTopic, nodename, mqttfabric.PLATFORM_ID_CHRONOS, mqttfabric.DEVICE))
+}
+
+// Descriptor returns the descriptor of the time feed
+//
+func (c *Chronos) Descriptor() *mqttfabric.Descriptor {
+    d := mqttfabric.NewDescriptor(c.Fabric.F.NodeName, c.Fabric.F.PlatformID)
+    
+    d.AddFeed(mqttfabric.SERVICE_ID_TIME, &mqttfabric.FeedDescriptor{
+        FeedID:     mqttfabric.FEED_ID_SECONDS,
+        ValueType:  "int",
+        Unit:       "s",
+    })
+    
+    return d
+}
+
+// Start sets the descriptor and publishes the time every Interval, on the
+// boundaries of Interval. It can be called before or after MqttFabric.Start()
+//
+func (c *Chronos) Start() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    if c.stop != nil {
+        return
+    }
+    
+    c.Fabric.SetDescriptor(c.Descriptor())
+    
+    c.stop = make(chan struct{})
+    
+    go c.run(c.stop)
+}
+
+// Stop ...
+//
+func (c *Chronos) Stop() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    if c.stop != nil {
+        close(c.stop)
+        c.stop = nil
+    }
+}
+
+func (c *Chronos) run(stop chan struct{}) {
+    for {
+        now := time.Now()
+        
+        select {
+            case <-stop:
+                return
+            case <-time.After(now.Truncate(c.Interval).Add(c.Interval).Sub(now)):
+        }
+        
+        // not connected is not an error here, the next tick tries again
+        if c.Fabric.Transport.IsConnected() {
+            c.Fabric.DevicePub(mqttfabric.SERVICE_ID_TIME, mqttfabric.FEED_ID_SECONDS, time.Now().Unix())
+        }
+    }
+}
+
+// Seconds returns the time from a message on the time feed
+//
+func Seconds(msg string) (time.Time, error) {
+    o, err := mqttfabric.BlueMixParse(msg)
+    
+    if err != nil {
+        return time.Time{}, err
+    }
+    
+    v, err := o.GetValueInt()
+    
+    if err != nil {
+        return time.Time{}, err
+    }
+    
+    return time.Unix(int64(v), 0), nil
+}
@@ -0,0 +1,252 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package chronos
+
+import (
+    "time"
+    "errors"
+    "strconv"
+    "strings"
+)
+
+// Cron is a parsed cron expression: minute, hour, day of month, month and day
+// of week, with "*", lists, ranges, steps and the names of months and days.
+// "@hourly", "@daily", "@weekly", "@monthly" and "@yearly" are understood too
+//
+type Cron struct {
+    Expr            string
+    
+    minute          uint64
+    hour            uint64
+    dom             uint64
+    month           uint64
+    dow             uint64
+    anyDom          bool
+    anyDow          bool
+}
+
+var cronMacros = map[string]string{
+    "@yearly":      "0 0 1 1 *",
+    "@annually":    "0 0 1 1 *",
+    "@monthly":     "0 0 1 * *",
+    "@weekly":      "0 0 * * 0",
+    "@daily":       "0 0 * * *",
+    "@midnight":    "0 0 * * *",
+    "@hourly":      "0 * * * *",
+}
+
+var cronMonths = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronDays   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseCron ...
+//
+func ParseCron(expr string) (*Cron, error) {
+    spec := strings.TrimSpace(expr)
+    
+    if m, ok := cronMacros[strings.ToLower(spec)]; ok {
+        spec = m
+    }
+    
+    fields := strings.Fields(spec)
+    
+    if len(fields) != 5 {
+        return nil, errors.New("ParseCron: '" + expr + "' does not have 5 fields")
+    }
+    
+    c := &Cron{Expr: expr}
+    
+    var err error
+    
+    if c.minute, err = cronField(fields[0], 0, 59, nil); err != nil {
+        return nil, errors.New("ParseCron: minute: " + err.Error())
+    }
+    if c.hour, err = cronField(fields[1], 0, 23, nil); err != nil {
+        return nil, errors.New("ParseCron: hour: " + err.Error())
+    }
+    if c.dom, err = cronField(fields[2], 1, 31, nil); err != nil {
+        return nil, errors.New("ParseCron: day of month: " + err.Error())
+    }
+    if c.month, err = cronField(fields[3], 1, 12, cronMonths); err != nil {
+        return nil, errors.New("ParseCron: month: " + err.Error())
+    }
+    if c.dow, err = cronField(fields[4], 0, 7, cronDays); err != nil {
+        return nil, errors.New("ParseCron: day of week: " + err.Error())
+    }
+    
+    // 7 is sunday too
+    if c.dow & (1 << 7) != 0 {
+        c.dow |= 1
+    }
+    
+    c.anyDom = fields[2] == "*" || fields[2] == "?"
+    c.anyDow = fields[4] == "*" || fields[4] == "?"
+    
+    return c, nil
+}
+
+func cronValue(s string, names []string) (int, error) {
+    for i, n := range names {
+        if n != "" && strings.ToLower(s) == n {
+            return i, nil
+        }
+    }
+    
+    return strconv.Atoi(s)
+}
+
+// cronField returns the values of a field as bits
+//
+func cronField(field string, min int, max int, names []string) (uint64, error) {
+    var bits uint64
+    
+    for _, part := range strings.Split(field, ",") {
+        step := 1
+        
+        if i := strings.Index(part, "/"); i >= 0 {
+            var err error
+            
+            if step, err = strconv.Atoi(part[i + 1:]); err != nil || step <= 0 {
+                return 0, errors.New("bad step in '" + part + "'")
+            }
+            
+            part = part[:i]
+        }
+        
+        lo, hi := min, max
+        
+        if part != "*" && part != "?" {
+            r := strings.SplitN(part, "-", 2)
+            
+            var err error
+            
+            if lo, err = cronValue(r[0], names); err != nil {
+                return 0, errors.New("bad value '" + r[0] + "'")
+            }
+            
+            hi = lo
+            
+            if len(r) == 2 {
+                if hi, err = cronValue(r[1], names); err != nil {
+                    return 0, errors.New("bad value '" + r[1] + "'")
+                }
+            } else if step > 1 {
+                // "5/15" is 5, 20, 35, 50
+                hi = max
+            }
+        }
+        
+        if lo < min || hi > max || lo > hi {
+            return 0, errors.New("'" + part + "' is out of range")
+        }
+        
+        for v := lo; v <= hi; v += step {
+            bits |= 1 << uint(v)
+        }
+    }
+    
+    return bits, nil
+}
+
+func (c *Cron) dayMatches(t time.Time) bool {
+    dom := c.dom & (1 << uint(t.Day())) != 0
+    dow := c.dow & (1 << uint(t.Weekday())) != 0
+    
+    // like cron: when both are restricted either one may match
+    if !c.anyDom && !c.anyDow {
+        return dom || dow
+    }
+    
+    return dom && dow
+}
+
+// repeated returns how far the clock was put back when t is in the time that
+// is repeated after it
+//
+func repeated(t time.Time) (time.Duration, bool) {
+    start, _ := t.ZoneBounds()
+    
+    if start.IsZero() {
+        return 0, false
+    }
+    
+    _, before := start.Add(-time.Second).Zone()
+    _, after  := t.Zone()
+    
+    shift := time.Duration(before - after) * time.Second
+    
+    return shift, shift > 0 && t.Sub(start) < shift
+}
+
+// first returns the first time with the wall clock of t, time.Date() may give
+// either one of a repeated time
+//
+func first(t time.Time) time.Time {
+    if shift, ok := repeated(t); ok {
+        return t.Add(-shift)
+    }
+    
+    return t
+}
+
+// Next returns the first time after t matching c, in the location of t, or
+// the zero time if there is none within five years. Times skipped when the
+// clock is put forward for daylight saving time never match. When it is put
+// back the repeated times match once, or twice if the hour is "*"
+//
+func (c *Cron) Next(t time.Time) time.Time {
+    loc   := t.Location()
+    t      = t.Truncate(time.Minute).Add(time.Minute)
+    limit := t.AddDate(5, 0, 0)
+    
+    for t.Before(limit) {
+        if c.month & (1 << uint(t.Month())) == 0 {
+            t = first(time.Date(t.Year(), t.Month() + 1, 1, 0, 0, 0, 0, loc))
+            continue
+        }
+        if !c.dayMatches(t) {
+            t = first(time.Date(t.Year(), t.Month(), t.Day() + 1, 0, 0, 0, 0, loc))
+            continue
+        }
+        if c.hour & (1 << uint(t.Hour())) == 0 {
+            t = first(time.Date(t.Year(), t.Month(), t.Day(), t.Hour() + 1, 0, 0, 0, loc))
+            continue
+        }
+        if c.minute & (1 << uint(t.Minute())) == 0 {
+            t = t.Add(time.Minute)
+            continue
+        }
+        if _, ok := repeated(t); ok && c.hour != 1 << 24 - 1 {
+            // "30 2 * * *" ran at the first 2:30
+            t = t.Add(time.Minute)
+            continue
+        }
+        
+        return t
+    }
+    
+    return time.Time{}
+}
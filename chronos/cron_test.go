@@ -0,0 +1,146 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package chronos
+
+import (
+    "time"
+    "testing"
+)
+
+const cronLayout = "2006-01-02 15:04 -0700"
+
+func TestCronNext(t *testing.T) {
+    cases := []struct {
+        expr            string
+        from, want      string
+    }{
+        {"* * * * *",           "2026-01-07 10:07 +0000", "2026-01-07 10:08 +0000"},
+        {"*/15 * * * *",        "2026-01-07 10:07 +0000", "2026-01-07 10:15 +0000"},
+        {"5/15 * * * *",        "2026-01-07 10:21 +0000", "2026-01-07 10:35 +0000"},
+        {"0,30 8-9 * * *",      "2026-01-07 08:30 +0000", "2026-01-07 09:00 +0000"},
+        {"0 9-17/4 * * *",      "2026-01-07 10:00 +0000", "2026-01-07 13:00 +0000"},
+        {"0 0 * * mon",         "2026-01-07 10:00 +0000", "2026-01-12 00:00 +0000"},
+        {"0 0 * * 7",           "2026-01-07 10:00 +0000", "2026-01-11 00:00 +0000"},      // sunday
+        {"0 7 * * Mon-Fri",     "2026-01-09 07:00 +0000", "2026-01-12 07:00 +0000"},
+        {"0 0 1 jan *",         "2026-01-07 10:00 +0000", "2027-01-01 00:00 +0000"},
+        {"0 0 29 feb *",        "2026-01-07 10:00 +0000", "2028-02-29 00:00 +0000"},
+        {"0 0 30 2 *",          "2026-01-07 10:00 +0000", ""},
+        {"@hourly",             "2026-01-07 10:00 +0000", "2026-01-07 11:00 +0000"},
+        {"@weekly",             "2026-01-07 10:00 +0000", "2026-01-11 00:00 +0000"},
+        
+        // the day of month or the day of week when both are restricted
+        {"0 0 13 * fri",        "2026-01-01 10:00 +0000", "2026-01-02 00:00 +0000"},
+        {"0 0 13 * fri",        "2026-01-09 10:00 +0000", "2026-01-13 00:00 +0000"},
+        {"0 0 13 * *",          "2026-01-01 10:00 +0000", "2026-01-13 00:00 +0000"},
+        {"0 0 * * fri",         "2026-01-09 10:00 +0000", "2026-01-16 00:00 +0000"},
+        {"0 0 13 * ?",          "2026-01-01 10:00 +0000", "2026-01-13 00:00 +0000"},
+    }
+    
+    for _, c := range cases {
+        cron, err := ParseCron(c.expr)
+        
+        if err != nil {
+            t.Errorf("ParseCron(%q): %v", c.expr, err)
+            continue
+        }
+        
+        from, _ := time.Parse(cronLayout, c.from)
+        next    := cron.Next(from)
+        got     := ""
+        
+        if !next.IsZero() {
+            got = next.Format(cronLayout)
+        }
+        
+        if got != c.want {
+            t.Errorf("%q after %s = %q, want %q", c.expr, c.from, got, c.want)
+        }
+    }
+}
+
+func TestCronNextDaylightSaving(t *testing.T) {
+    cases := []struct {
+        zone            string
+        expr            string
+        from, want      string
+    }{
+        // skipped when the clock is put forward
+        {"Europe/Copenhagen", "30 2 * * *", "2026-03-29 00:00 +0100", "2026-03-30 02:30 +0200"},
+        {"Europe/Copenhagen", "30 * * * *", "2026-03-29 01:30 +0100", "2026-03-29 03:30 +0200"},
+        
+        // once when it is put back, time.Date() gives the second 2:00 here
+        {"Europe/Copenhagen", "30 2 * * *", "2026-10-25 00:00 +0200", "2026-10-25 02:30 +0200"},
+        {"Europe/Copenhagen", "30 2 * * *", "2026-10-25 02:30 +0200", "2026-10-26 02:30 +0100"},
+        {"Europe/Copenhagen", "0 3 * * *",  "2026-10-25 00:00 +0200", "2026-10-25 03:00 +0100"},
+        {"America/New_York",  "30 1 * * *", "2026-11-01 00:00 -0400", "2026-11-01 01:30 -0400"},
+        {"America/New_York",  "30 1 * * *", "2026-11-01 01:30 -0400", "2026-11-02 01:30 -0500"},
+        
+        // or every hour if the hour is "*"
+        {"Europe/Copenhagen", "30 * * * *", "2026-10-25 02:30 +0200", "2026-10-25 02:30 +0100"},
+        {"Europe/Copenhagen", "30 * * * *", "2026-10-25 02:30 +0100", "2026-10-25 03:30 +0100"},
+    }
+    
+    for _, c := range cases {
+        loc, err := time.LoadLocation(c.zone)
+        
+        if err != nil {
+            t.Skip(err)
+        }
+        
+        cron, err := ParseCron(c.expr)
+        
+        if err != nil {
+            t.Fatal(err)
+        }
+        
+        from, _ := time.Parse(cronLayout, c.from)
+        
+        if got := cron.Next(from.In(loc)).Format(cronLayout); got != c.want {
+            t.Errorf("%s: %q after %s = %s, want %s", c.zone, c.expr, c.from, got, c.want)
+        }
+    }
+}
+
+func TestParseCronErrors(t *testing.T) {
+    for _, expr := range []string{
+        "* * * *",
+        "* * * * * *",
+        "60 * * * *",
+        "* 24 * * *",
+        "* * 0 * *",
+        "* * * 13 *",
+        "* * * * 8",
+        "*/0 * * * *",
+        "5-1 * * * *",
+        "* * * foo *",
+        "x * * * *",
+    } {
+        if _, err := ParseCron(expr); err == nil {
+            t.Errorf("ParseCron(%q) did not fail", expr)
+        }
+    }
+}
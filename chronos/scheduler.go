@@ -0,0 +1,448 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package chronos
+
+import (
+    "log"
+    "sort"
+    "sync"
+    "time"
+    "errors"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+    "gopkg.in/yaml.v2"
+    "github.com/mikejac/mqtt.fabric.golang/rules"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+var errExpired = errors.New("Add: one-shot job in the past")
+
+// Job sends its tasks on a schedule. Exactly one of Cron, Sun and At is set:
+// a cron expression, SUNRISE or SUNSET plus Offset, or a one-shot time in
+// RFC 3339. One-shot jobs are removed after they fired
+//
+type Job struct {
+    Name            string          `json:"name"         yaml:"name"`
+    Cron            string          `json:"cron"         yaml:"cron"`
+    Sun             string          `json:"sun"          yaml:"sun"`
+    Offset          rules.Duration  `json:"offset"       yaml:"offset"`
+    At              string          `json:"at"           yaml:"at"`
+    Tasks           []*rules.Task   `json:"tasks"        yaml:"tasks"`
+    
+    cron            *Cron
+    at              time.Time
+    next            time.Time
+}
+
+func (j *Job) validate(rootTopic string) error {
+    set := 0
+    
+    if j.Cron != "" {
+        c, err := ParseCron(j.Cron)
+        
+        if err != nil {
+            return err
+        }
+        
+        j.cron = c
+        set++
+    }
+    
+    if j.Sun != "" {
+        if j.Sun != SUNRISE && j.Sun != SUNSET {
+            return errors.New("sun must be '" + SUNRISE + "' or '" + SUNSET + "'")
+        }
+        
+        set++
+    }
+    
+    if j.At != "" {
+        at, err := time.Parse(time.RFC3339, j.At)
+        
+        if err != nil {
+            return err
+        }
+        
+        j.at = at
+        set++
+    }
+    
+    if set != 1 {
+        return errors.New("one of cron, sun and at must be set")
+    }
+    if len(j.Tasks) == 0 {
+        return errors.New("no tasks")
+    }
+    
+    for _, t := range j.Tasks {
+        if err := t.Validate(rootTopic); err != nil {
+            return err
+        }
+    }
+    
+    return nil
+}
+
+// Schedule is the content of a schedule file. Latitude and Longitude are
+// needed for the sun jobs, Timezone (default local) for cron and sun jobs
+//
+type Schedule struct {
+    RootTopic       string          `json:"root_topic"   yaml:"root_topic"`
+    Latitude        float64         `json:"latitude"     yaml:"latitude"`
+    Longitude       float64         `json:"longitude"    yaml:"longitude"`
+    Timezone        string          `json:"timezone"     yaml:"timezone"`
+    Jobs            []*Job          `json:"jobs"         yaml:"jobs"`
+}
+
+// LoadSchedule reads a .json or .yaml/.yml file
+//
+func LoadSchedule(path string) (*Schedule, error) {
+    data, err := ioutil.ReadFile(path)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    s := &Schedule{}
+    
+    switch strings.ToLower(filepath.Ext(path)) {
+        case ".json":
+            err = json.Unmarshal(data, s)
+        case ".yaml", ".yml":
+            err = yaml.Unmarshal(data, s)
+        default:
+            return nil, errors.New("LoadSchedule: unknown file type '" + filepath.Ext(path) + "'")
+    }
+    
+    if err != nil {
+        return nil, errors.New("LoadSchedule: " + path + ": " + err.Error())
+    }
+    
+    return s, nil
+}
+
+// JobState ...
+//
+type JobState struct {
+    Name            string
+    Next            time.Time
+}
+
+// Scheduler runs Jobs on a controller. Latitude and Longitude (degrees, north
+// and east positive) are needed for the sun jobs
+//
+type Scheduler struct {
+    Fabric          *mqttfabric.MqttFabric
+    Location        *time.Location          // for cron and sun jobs, default local
+    Latitude        float64
+    Longitude       float64
+    DryRun          bool                    // report the tasks without sending them
+    OnFire          func(j *Job, t *rules.Task, err error)
+    
+    mu              sync.Mutex
+    jobs            []*Job
+    wakeup          chan struct{}
+    stop            chan struct{}
+}
+
+// NewScheduler ...
+//
+func NewScheduler(m *mqttfabric.MqttFabric) *Scheduler {
+    return &Scheduler{
+        Fabric:     m,
+        Location:   time.Local,
+        wakeup:     make(chan struct{}, 1),
+    }
+}
+
+// NewSchedulerFromSchedule creates a scheduler with the jobs of s. One-shot
+// jobs in the past are logged and skipped
+//
+func NewSchedulerFromSchedule(m *mqttfabric.MqttFabric, s *Schedule) (*Scheduler, error) {
+    sc := NewScheduler(m)
+    
+    sc.Latitude  = s.Latitude
+    sc.Longitude = s.Longitude
+    
+    if s.Timezone != "" {
+        loc, err := time.LoadLocation(s.Timezone)
+        
+        if err != nil {
+            return nil, err
+        }
+        
+        sc.Location = loc
+    }
+    
+    for _, j := range s.Jobs {
+        err := sc.addJob(j, s.RootTopic)
+        
+        // a schedule file outlives its one-shot jobs
+        if err == errExpired {
+            log.Println("chronos: NewSchedulerFromSchedule(): ", j.Name, ": skipped, at ", j.At, " is in the past")
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    
+    return sc, nil
+}
+
+// next returns the time j fires after t, the zero time if never again
+//
+func (s *Scheduler) next(j *Job, t time.Time) time.Time {
+    t = t.In(s.Location)
+    
+    switch {
+        case j.cron != nil:
+            return j.cron.Next(t)
+        case j.Sun != "":
+            return SunEvent(j.Sun, time.Duration(j.Offset), t, s.Latitude, s.Longitude)
+        case j.at.After(t):
+            return j.at
+    }
+    
+    return time.Time{}
+}
+
+// Add adds j, replacing a job with the same name
+//
+func (s *Scheduler) Add(j *Job) error {
+    return s.addJob(j, "")
+}
+
+func (s *Scheduler) addJob(j *Job, rootTopic string) error {
+    if j.Name == "" {
+        return errors.New("Add: job without name")
+    }
+    if rootTopic == "" && s.Fabric != nil {
+        rootTopic = s.Fabric.F.RootTopic
+    }
+    if err := j.validate(rootTopic); err != nil {
+        return errors.New("Add: " + j.Name + ": " + err.Error())
+    }
+    
+    j.next = s.next(j, time.Now())
+    
+    if j.next.IsZero() {
+        if j.At != "" {
+            return errExpired
+        }
+        return errors.New("Add: " + j.Name + ": never fires")
+    }
+    
+    s.mu.Lock()
+    s.remove(j.Name)
+    s.jobs = append(s.jobs, j)
+    s.mu.Unlock()
+    
+    s.wake()
+    
+    return nil
+}
+
+// Cron adds a job sending tasks on the cron expression expr
+//
+func (s *Scheduler) Cron(name string, expr string, tasks ...*rules.Task) error {
+    return s.Add(&Job{Name: name, Cron: expr, Tasks: tasks})
+}
+
+// Sun adds a job sending tasks at every SUNRISE or SUNSET (event) plus offset
+//
+func (s *Scheduler) Sun(name string, event string, offset time.Duration, tasks ...*rules.Task) error {
+    return s.Add(&Job{Name: name, Sun: event, Offset: rules.Duration(offset), Tasks: tasks})
+}
+
+// At adds a one-shot job sending tasks at t
+//
+func (s *Scheduler) At(name string, t time.Time, tasks ...*rules.Task) error {
+    return s.Add(&Job{Name: name, At: t.Format(time.RFC3339Nano), Tasks: tasks})
+}
+
+// After adds a one-shot job sending tasks after d
+//
+func (s *Scheduler) After(name string, d time.Duration, tasks ...*rules.Task) error {
+    return s.At(name, time.Now().Add(d), tasks...)
+}
+
+// Remove removes the job called name
+//
+func (s *Scheduler) Remove(name string) {
+    s.mu.Lock()
+    s.remove(name)
+    s.mu.Unlock()
+    
+    s.wake()
+}
+
+// remove is called with s.mu held
+func (s *Scheduler) remove(name string) {
+    for i, j := range s.jobs {
+        if j.Name == name {
+            s.jobs = append(s.jobs[:i], s.jobs[i + 1:]...)
+            return
+        }
+    }
+}
+
+// Jobs returns the jobs by the time they fire next
+//
+func (s *Scheduler) Jobs() []JobState {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    var states []JobState
+    
+    for _, j := range s.jobs {
+        states = append(states, JobState{Name: j.Name, Next: j.next})
+    }
+    
+    sort.Slice(states, func(a, b int) bool {
+        return states[a].Next.Before(states[b].Next)
+    })
+    
+    return states
+}
+
+func (s *Scheduler) wake() {
+    select {
+        case s.wakeup <- struct{}{}:
+        default:
+    }
+}
+
+// Start runs the jobs until Stop() is called
+//
+func (s *Scheduler) Start() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if s.stop != nil {
+        return
+    }
+    
+    s.stop = make(chan struct{})
+    
+    go s.run(s.stop)
+}
+
+// Stop ...
+//
+func (s *Scheduler) Stop() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if s.stop != nil {
+        close(s.stop)
+        s.stop = nil
+    }
+}
+
+func (s *Scheduler) run(stop chan struct{}) {
+    timer := time.NewTimer(time.Hour)
+    defer timer.Stop()
+    
+    for {
+        s.fireDue(time.Now())
+        
+        // sleep until the next job, but at most a minute so a changed clock
+        // is noticed
+        wait := time.Minute
+        
+        for _, j := range s.Jobs() {
+            if d := time.Until(j.Next); d < wait {
+                wait = d
+            }
+            break
+        }
+        
+        if !timer.Stop() {
+            select {
+                case <-timer.C:
+                default:
+            }
+        }
+        
+        timer.Reset(wait)
+        
+        select {
+            case <-stop:
+                return
+            case <-s.wakeup:
+            case <-timer.C:
+        }
+    }
+}
+
+// fireDue sends the tasks of the jobs due at now
+//
+func (s *Scheduler) fireDue(now time.Time) {
+    var due []*Job
+    
+    s.mu.Lock()
+    
+    jobs := s.jobs[:0]
+    
+    for _, j := range s.jobs {
+        if j.next.After(now) {
+            jobs = append(jobs, j)
+            continue
+        }
+        
+        due = append(due, j)
+        
+        // one-shot jobs are done, the others are scheduled again
+        if j.next = s.next(j, now); !j.next.IsZero() {
+            jobs = append(jobs, j)
+        }
+    }
+    
+    s.jobs = jobs
+    
+    s.mu.Unlock()
+    
+    for _, j := range due {
+        for _, t := range j.Tasks {
+            var err error
+            
+            if !s.DryRun {
+                err = t.Send(s.Fabric)
+            }
+            if err != nil {
+                log.Println("chronos: fireDue(): ", j.Name, ": err = ", err)
+            }
+            
+            if s.OnFire != nil {
+                s.OnFire(j, t, err)
+            }
+        }
+    }
+}
@@ -0,0 +1,72 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package chronos
+
+import (
+    "io/ioutil"
+    "log"
+    "os"
+    "testing"
+    "time"
+    "github.com/mikejac/mqtt.fabric.golang/rules"
+)
+
+func TestScheduleSkipsExpiredJobs(t *testing.T) {
+    log.SetOutput(ioutil.Discard)
+    t.Cleanup(func() { log.SetOutput(os.Stderr) })
+    
+    task := func() []*rules.Task {
+        return []*rules.Task{{NodeName: "hall", PlatformID: "esp1", ServiceID: "digital_out", FeedID: "tree", Value: true}}
+    }
+    
+    s := &Schedule{RootTopic: "fabric", Jobs: []*Job{
+        {Name: "past",   At: "2020-12-24T18:00:00Z", Tasks: task()},
+        {Name: "future", At: time.Now().Add(time.Hour).UTC().Format(time.RFC3339), Tasks: task()},
+        {Name: "hourly", Cron: "0 * * * *", Tasks: task()},
+    }}
+    
+    sc, err := NewSchedulerFromSchedule(nil, s)
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    var names []string
+    
+    for _, j := range sc.Jobs() {
+        names = append(names, j.Name)
+    }
+    
+    if len(names) != 2 || names[0] == "past" || names[1] == "past" {
+        t.Errorf("jobs = %v, want future and hourly", names)
+    }
+    
+    // adding one directly is still an error
+    if err := sc.At("late", time.Now().Add(-time.Minute), task()...); err == nil {
+        t.Error("At() in the past did not fail")
+    }
+}
@@ -0,0 +1,137 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package chronos
+
+import (
+    "math"
+    "time"
+)
+
+const (
+    SUNRISE         = "sunrise"
+    SUNSET          = "sunset"
+)
+
+func sin(deg float64) float64 {
+    return math.Sin(deg * math.Pi / 180)
+}
+
+func cos(deg float64) float64 {
+    return math.Cos(deg * math.Pi / 180)
+}
+
+// fromJulian converts a Julian date to time
+//
+func fromJulian(j float64) time.Time {
+    return time.Unix(int64(math.Floor((j - 2440587.5) * 86400 + 0.5)), 0)
+}
+
+// dayNumber returns the days since 2000-01-01 of the calendar date of t, in
+// the location of t
+//
+func dayNumber(t time.Time) float64 {
+    return math.Floor(float64(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix()) / 86400) - 10957
+}
+
+// SunTimes returns sunrise and sunset on the day of date, in the location of
+// date, for latitude and longitude in degrees (north and east positive). ok
+// is false on days the sun doesn't rise or set. The times are accurate to
+// about a minute
+//
+func SunTimes(date time.Time, latitude float64, longitude float64) (sunrise time.Time, sunset time.Time, ok bool) {
+    loc := date.Location()
+    n   := dayNumber(date)
+    
+    transit, hour, ok := sunDay(n, latitude, longitude)
+    
+    // the solar noon of day n is on another date where the time zone is far
+    // from the mean solar time, like UTC+14 at 150W
+    if d := n - dayNumber(fromJulian(transit).In(loc)); d != 0 {
+        transit, hour, ok = sunDay(n + d, latitude, longitude)
+    }
+    
+    if !ok {
+        return time.Time{}, time.Time{}, false
+    }
+    
+    return fromJulian(transit - hour / 360).In(loc), fromJulian(transit + hour / 360).In(loc), true
+}
+
+// sunDay returns the Julian date of the solar noon of day n (days since
+// 2000-01-01) at longitude and the hour angle of sunrise and sunset in
+// degrees. ok is false if the sun doesn't rise or set
+//
+func sunDay(n float64, latitude float64, longitude float64) (transit float64, hour float64, ok bool) {
+    // the mean solar noon
+    j := n - longitude / 360
+    
+    m := math.Mod(357.5291 + 0.98560028 * j, 360)
+    c := 1.9148 * sin(m) + 0.0200 * sin(2 * m) + 0.0003 * sin(3 * m)
+    l := math.Mod(m + c + 180 + 102.9372, 360)
+    
+    transit = 2451545.0 + j + 0.0053 * sin(m) - 0.0069 * sin(2 * l)
+    
+    sinDecl := sin(l) * sin(23.4397)
+    cosDecl := math.Cos(math.Asin(sinDecl))
+    
+    // -0.833 degrees for the refraction and the size of the sun
+    cosHour := (sin(-0.833) - sin(latitude) * sinDecl) / (cos(latitude) * cosDecl)
+    
+    if cosHour < -1 || cosHour > 1 {
+        return transit, 0, false
+    }
+    
+    return transit, math.Acos(cosHour) * 180 / math.Pi, true
+}
+
+// SunEvent returns the first sunrise or sunset (event) plus offset after t,
+// skipping the days without one, or the zero time if there is none within a
+// year
+//
+func SunEvent(event string, offset time.Duration, t time.Time, latitude float64, longitude float64) time.Time {
+    for i := -1; i <= 366; i++ {
+        day := time.Date(t.Year(), t.Month(), t.Day() + i, 12, 0, 0, 0, t.Location())
+        
+        rise, set, ok := SunTimes(day, latitude, longitude)
+        
+        if !ok {
+            continue
+        }
+        
+        at := set
+        
+        if event == SUNRISE {
+            at = rise
+        }
+        
+        if at = at.Add(offset); at.After(t) {
+            return at
+        }
+    }
+    
+    return time.Time{}
+}
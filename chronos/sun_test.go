@@ -0,0 +1,59 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package chronos
+
+import (
+    "time"
+    "testing"
+)
+
+func TestSunTimesCalendarDay(t *testing.T) {
+    cases := []struct {
+        zone            string
+        lat, lon        float64
+        rise, set       string
+    }{
+        {"Europe/Copenhagen",  55.68,  12.57,   "2026-01-01 08:38", "2026-01-01 15:47"},
+        {"Pacific/Auckland",   -36.85, 174.76,  "2026-01-01 06:04", "2026-01-01 20:43"},      // UTC+13
+        {"Pacific/Kiritimati", 1.87,   -157.4,  "2026-01-01 06:32", "2026-01-01 18:33"},      // UTC+14 at 157W
+        {"Pacific/Honolulu",   21.3,   -157.86, "2026-01-01 07:09", "2026-01-01 18:00"},
+    }
+    
+    for _, c := range cases {
+        loc, err := time.LoadLocation(c.zone)
+        
+        if err != nil {
+            t.Skip(err)
+        }
+        
+        rise, set, ok := SunTimes(time.Date(2026, 1, 1, 0, 0, 0, 0, loc), c.lat, c.lon)
+        
+        if !ok || rise.Format("2006-01-02 15:04") != c.rise || set.Format("2006-01-02 15:04") != c.set {
+            t.Errorf("%s: got %s %s %v, want %s %s", c.zone, rise.Format("2006-01-02 15:04"), set.Format("2006-01-02 15:04"), ok, c.rise, c.set)
+        }
+    }
+}
@@ -0,0 +1,166 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "flag"
+    "time"
+    "text/tabwriter"
+    "github.com/mikejac/mqtt.fabric.golang/rules"
+    "github.com/mikejac/mqtt.fabric.golang/chronos"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+func runChronos(args []string) int {
+    fs := flag.NewFlagSet("chronos", flag.ExitOnError)
+    g  := addGlobalFlags(fs)
+    
+    interval := fs.Duration("interval", time.Second, "how often the time is published")
+    
+    fs.Parse(args)
+    
+    c, err := g.load()
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    if *interval <= 0 {
+        return fail("-interval must be positive")
+    }
+    
+    c.Class = "device"
+    
+    if g.platformID == "" {
+        c.PlatformID = mqttfabric.PLATFORM_ID_CHRONOS
+    }
+    
+    m, err := mqttfabric.NewFromConfig(c)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    ch := chronos.New(m)
+    ch.Interval = *interval
+    ch.Start()
+    
+    m.Start()
+    
+    <-interrupted()
+    
+    ch.Stop()
+    m.Stop()
+    
+    return 0
+}
+
+func runSchedule(args []string) int {
+    fs := flag.NewFlagSet("schedule", flag.ExitOnError)
+    g  := addGlobalFlags(fs)
+    
+    file   := fs.String("schedule", "", "schedule file (.json or .yaml)")
+    dryRun := fs.Bool("dry-run",    false, "print the tasks without sending them")
+    list   := fs.Bool("list",       false, "print when the jobs fire next and exit")
+    
+    fs.Parse(args)
+    
+    if *file == "" {
+        return fail("-schedule is required")
+    }
+    
+    schedule, err := chronos.LoadSchedule(*file)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    if *list {
+        s, err := chronos.NewSchedulerFromSchedule(nil, schedule)
+        
+        if err != nil {
+            return fail("%v", err)
+        }
+        
+        w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+        
+        fmt.Fprintf(w, "JOB\tNEXT\n")
+        
+        for _, j := range s.Jobs() {
+            fmt.Fprintf(w, "%s\t%s\n", j.Name, j.Next.In(s.Location).Format(time.RFC3339))
+        }
+        
+        w.Flush()
+        
+        return 0
+    }
+    
+    c, err := g.load()
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    c.Class = "controller"
+    
+    m, err := mqttfabric.NewFromConfig(c)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    s, err := chronos.NewSchedulerFromSchedule(m, schedule)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    s.DryRun = *dryRun
+    s.OnFire = func(j *chronos.Job, t *rules.Task, err error) {
+        status := ""
+        
+        if *dryRun {
+            status = " (dry-run)"
+        }
+        if err != nil {
+            status = " error: " + err.Error()
+        }
+        
+        fmt.Printf("%s %s %s%s\n", time.Now().Format(time.RFC3339), j.Name, t, status)
+    }
+    
+    m.Start()
+    s.Start()
+    
+    <-interrupted()
+    
+    s.Stop()
+    m.Stop()
+    
+    return 0
+}
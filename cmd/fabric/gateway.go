@@ -0,0 +1,95 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+    "flag"
+    "net/http"
+    "github.com/mikejac/mqtt.fabric.golang/gateway"
+    "github.com/mikejac/mqtt.fabric.golang/metrics"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+func runGateway(args []string) int {
+    fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+    g  := addGlobalFlags(fs)
+    
+    listen  := fs.String("listen",  ":8080", "HTTP listen address")
+    export  := fs.Bool("metrics",   true,    "serve Prometheus metrics on /metrics")
+    
+    fs.Parse(args)
+    
+    c, err := g.load()
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    c.Class = "controller"
+    
+    m, err := mqttfabric.NewFromConfig(c)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    gw := gateway.NewGateway(m)
+    
+    if err := gw.Start(); err != nil {
+        return fail("%v", err)
+    }
+    
+    mux := http.NewServeMux()
+    mux.Handle("/", gw)
+    
+    if *export {
+        e := metrics.NewExporter(m)
+        e.Cache = gw.Cache
+        
+        mux.Handle("/metrics", e)
+    }
+    
+    m.Start()
+    defer m.Stop()
+    
+    server := &http.Server{Addr: *listen, Handler: mux}
+    errc   := make(chan error, 1)
+    
+    go func() {
+        errc <- server.ListenAndServe()
+    }()
+    
+    select {
+        case err := <-errc:
+            return fail("%v", err)
+        case <-interrupted():
+    }
+    
+    server.Close()
+    
+    return 0
+}
@@ -0,0 +1,231 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "flag"
+    "time"
+    "encoding/json"
+    "text/tabwriter"
+    "github.com/mikejac/mqtt.fabric.golang/history"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+func runHistory(args []string) int {
+    if len(args) < 1 {
+        return fail("usage: fabric history record|query|compact [flags]")
+    }
+    
+    switch args[0] {
+        case "record":
+            return runHistoryRecord(args[1:])
+        case "query":
+            return runHistoryQuery(args[1:])
+        case "compact":
+            return runHistoryCompact(args[1:])
+    }
+    
+    return fail("unknown history command '%s', use record, query or compact", args[0])
+}
+
+func addStoreFlags(fs *flag.FlagSet) (*string, *history.Options) {
+    opts := &history.Options{}
+    
+    dir := fs.String("dir", "history", "directory of the store")
+    
+    fs.DurationVar(&opts.MaxAge,     "max-age",      0, "remove values older than this, 0 keeps them")
+    fs.Int64Var(&opts.MaxSize,       "max-size",     0, "remove the oldest values above this many bytes, 0 is no limit")
+    fs.Int64Var(&opts.SegmentSize,   "segment-size", 0, "segment size in bytes (default 4 MiB)")
+    fs.DurationVar(&opts.SegmentAge, "segment-age",  0, "segment age (default 1h)")
+    
+    return dir, opts
+}
+
+func runHistoryRecord(args []string) int {
+    fs := flag.NewFlagSet("history record", flag.ExitOnError)
+    g  := addGlobalFlags(fs)
+    
+    dir, opts := addStoreFlags(fs)
+    
+    fs.Parse(args)
+    
+    c, err := g.load()
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    store, err := history.Open(*dir, *opts)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    defer store.Close()
+    
+    c.Class = "controller"
+    
+    m, err := mqttfabric.NewFromConfig(c)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    if err := store.Attach(m); err != nil {
+        return fail("%v", err)
+    }
+    
+    m.Start()
+    
+    <-interrupted()
+    
+    m.Stop()
+    
+    return 0
+}
+
+// parseTime accepts RFC 3339 or a duration meaning that long ago
+//
+func parseTime(s string) (time.Time, error) {
+    if s == "" {
+        return time.Time{}, nil
+    }
+    if d, err := time.ParseDuration(s); err == nil {
+        if d < 0 {
+            d = -d
+        }
+        
+        return time.Now().Add(-d), nil
+    }
+    
+    return time.Parse(time.RFC3339, s)
+}
+
+func runHistoryQuery(args []string) int {
+    fs := flag.NewFlagSet("history query", flag.ExitOnError)
+    
+    dir     := fs.String("dir",      "history", "directory of the store")
+    root    := fs.String("root",     "", "root topic")
+    node    := fs.String("node",     "", "nodename")
+    pf      := fs.String("platform", "", "platform id")
+    service := fs.String("service",  "", "service id")
+    feed    := fs.String("feed",     "", "feed id")
+    from    := fs.String("from",     "1h", "start, RFC 3339 or a duration ago")
+    to      := fs.String("to",       "", "end, RFC 3339 or a duration ago (default now)")
+    bucket  := fs.Duration("bucket", 0, "downsample to min/max/avg per bucket")
+    asJSON  := fs.Bool("json",       false, "print JSON")
+    
+    fs.Parse(args)
+    
+    start, err := parseTime(*from)
+    
+    if err != nil {
+        return fail("-from: %v", err)
+    }
+    
+    end, err := parseTime(*to)
+    
+    if err != nil {
+        return fail("-to: %v", err)
+    }
+    
+    store, err := history.OpenReadOnly(*dir)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    filter := mqttfabric.FeedFilter{RootTopic: *root, NodeName: *node, PlatformID: *pf, ServiceID: *service, FeedID: *feed}
+    enc    := json.NewEncoder(os.Stdout)
+    w      := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    
+    defer w.Flush()
+    
+    if *bucket > 0 {
+        buckets, err := store.Downsample(filter, start, end, *bucket)
+        
+        if err != nil {
+            return fail("%v", err)
+        }
+        
+        if *asJSON {
+            enc.Encode(buckets)
+            return 0
+        }
+        
+        fmt.Fprintln(w, "START\tNODE\tPLATFORM\tSERVICE\tFEED\tCOUNT\tMIN\tMAX\tAVG")
+        
+        for _, b := range buckets {
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%g\t%g\t%.4g\n", b.Start.Format(time.RFC3339), b.NodeName, b.PlatformID, b.ServiceID, b.FeedID, b.Count, b.Min, b.Max, b.Avg)
+        }
+        
+        return 0
+    }
+    
+    points, err := store.Query(filter, start, end)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    if *asJSON {
+        enc.Encode(points)
+        return 0
+    }
+    
+    fmt.Fprintln(w, "TIME\tNODE\tPLATFORM\tSERVICE\tFEED\tVALUE")
+    
+    for _, p := range points {
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%v\n", p.Time.Format(time.RFC3339), p.NodeName, p.PlatformID, p.ServiceID, p.FeedID, p.Value)
+    }
+    
+    return 0
+}
+
+func runHistoryCompact(args []string) int {
+    fs := flag.NewFlagSet("history compact", flag.ExitOnError)
+    
+    dir, opts := addStoreFlags(fs)
+    
+    fs.Parse(args)
+    
+    // compacting is writing, so not while 'history record' runs
+    store, err := history.Open(*dir, *opts)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    defer store.Close()
+    
+    if err := store.Compact(); err != nil {
+        return fail("%v", err)
+    }
+    
+    return 0
+}
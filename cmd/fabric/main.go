@@ -0,0 +1,312 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+// Command fabric is a tool for working with the MQTT fabric from the shell
+//
+package main
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "flag"
+    "time"
+    "strings"
+    "sync/atomic"
+    "io/ioutil"
+    "os/signal"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+type command struct {
+    name            string
+    usage           string
+    run             func(args []string) int
+}
+
+var commands = []*command{
+    {"monitor",  "show a live table of the traffic under the root topic",         runMonitor},
+    {"pub",      "publish an onramp value as a node",                             runPub},
+    {"write",    "send an offramp task to a node",                                runWrite},
+    {"nodes",    "list the nodes from their status messages",                     runNodes},
+    {"record",   "record the traffic under the root topic to a file",             runRecord},
+    {"replay",   "publish recorded traffic again",                                runReplay},
+    {"simulate", "run simulated devices from a spec file",                        runSimulate},
+    {"gateway",  "serve the fabric over HTTP",                                    runGateway},
+    {"history",  "record, query and compact the feed history",                    runHistory},
+    {"rules",    "run rules, or test them on recorded traffic",                   runRules},
+    {"chronos",  "publish the time as a chronos node",                            runChronos},
+    {"schedule", "send tasks on cron, sunrise/sunset and one-shot schedules",     runSchedule},
+}
+
+func main() {
+    if len(os.Args) < 2 {
+        usage()
+        os.Exit(2)
+    }
+    
+    for _, cmd := range commands {
+        if cmd.name == os.Args[1] {
+            os.Exit(cmd.run(os.Args[2:]))
+        }
+    }
+    
+    usage()
+    os.Exit(2)
+}
+
+func usage() {
+    fmt.Fprintf(os.Stderr, "usage: fabric <command> [flags]\n\ncommands:\n")
+    
+    for _, cmd := range commands {
+        fmt.Fprintf(os.Stderr, "    %-12s %s\n", cmd.name, cmd.usage)
+    }
+    
+    fmt.Fprintf(os.Stderr, "\nrun 'fabric <command> -h' for the flags of a command\n")
+}
+
+// globalFlags are the connection flags shared by all commands
+//
+type globalFlags struct {
+    config          string
+    broker          string
+    port            int
+    root            string
+    nodename        string
+    platformID      string
+    verbose         bool
+}
+
+func addGlobalFlags(fs *flag.FlagSet) *globalFlags {
+    g := &globalFlags{}
+    
+    fs.StringVar(&g.config,     "config",   "", "configuration file (.json, .yaml or .toml)")
+    fs.StringVar(&g.broker,     "broker",   "", "broker host")
+    fs.IntVar(&g.port,          "port",     0,  "broker port")
+    fs.StringVar(&g.root,       "root",     "", "root topic")
+    fs.StringVar(&g.nodename,   "nodename", "", "nodename of this tool")
+    fs.StringVar(&g.platformID, "platform", "", "platform id of this tool")
+    fs.BoolVar(&g.verbose,      "v",        false, "log what the library is doing")
+    
+    return g
+}
+
+// load builds the configuration from the defaults, the config file, the
+// environment and last the flags
+//
+func (g *globalFlags) load() (*mqttfabric.Config, error) {
+    if !g.verbose {
+        log.SetOutput(ioutil.Discard)
+    }
+    
+    hostname, _ := os.Hostname()
+    
+    c := mqttfabric.NewConfig()
+    
+    c.Class      = "controller"
+    c.NodeName   = "fabric-cli-" + hostname
+    c.PlatformID = "fabric-cli"
+    
+    if g.config != "" {
+        if err := c.LoadFile(g.config); err != nil {
+            return nil, err
+        }
+    }
+    
+    if err := c.LoadEnv(); err != nil {
+        return nil, err
+    }
+    
+    if g.broker != "" {
+        c.Broker = g.broker
+    }
+    if g.port != 0 {
+        c.Port = g.port
+    }
+    if g.root != "" {
+        c.RootTopic = g.root
+    }
+    if g.nodename != "" {
+        c.NodeName = g.nodename
+    }
+    if g.platformID != "" {
+        c.PlatformID = g.platformID
+    }
+    
+    if err := c.Validate(); err != nil {
+        return nil, err
+    }
+    
+    return c, nil
+}
+
+func roots(c *mqttfabric.Config) []string {
+    return append([]string{c.RootTopic}, c.Roots...)
+}
+
+// loadEncryption loads the encryption keys of the configuration, nil if it has
+// none
+//
+func loadEncryption(c *mqttfabric.Config) (*mqttfabric.Encryption, error) {
+    if c.Encryption == nil {
+        return nil, nil
+    }
+    
+    e, err := mqttfabric.LoadEncryption(c.Encryption.Keys)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    e.Required = c.Encryption.Required
+    
+    return e, nil
+}
+
+// decrypting returns onMessage with the values of onramp and offramp messages
+// decrypted first, or onMessage itself without encryption keys. Messages that
+// cannot be decrypted are passed on as they are
+//
+func decrypting(c *mqttfabric.Config, onMessage mqttfabric.TransportMessageHandler) (mqttfabric.TransportMessageHandler, error) {
+    e, err := loadEncryption(c)
+    
+    if err != nil || e == nil {
+        return onMessage, err
+    }
+    
+    return func(msg *mqttfabric.Message) {
+        t, err := mqttfabric.ParseTopicRoots(roots(c), msg.Topic)
+        
+        if err == nil && (t.Kind == mqttfabric.TOPIC_ONRAMP || t.Kind == mqttfabric.TOPIC_OFFRAMP) {
+            payload, err := e.Decrypt(t, msg.Topic, msg.Payload)
+            
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "%s: %v\n", msg.Topic, err)
+            } else {
+                d        := *msg
+                d.Payload = payload
+                msg       = &d
+            }
+        }
+        
+        onMessage(msg)
+    }, nil
+}
+
+// connectRaw connects without announcing a fabric node and subscribes to topics
+// before returning and again every time the connection is re-established. The
+// payloads are passed on as received, see decrypting()
+//
+func connectRaw(c *mqttfabric.Config, topics []string, onMessage mqttfabric.TransportMessageHandler) (*mqttfabric.PahoTransport, error) {
+    t := mqttfabric.NewPahoTransportFromConfig(c)
+    
+    var connected int32
+    
+    subscribe := func() {
+        for _, topic := range topics {
+            if err := t.Subscribe(topic, 0); err != nil {
+                fmt.Fprintf(os.Stderr, "subscribe %s: %v\n", topic, err)
+            }
+        }
+    }
+    
+    t.SetHandlers(func() {
+        // the first connect is handled below
+        if atomic.LoadInt32(&connected) == 1 {
+            subscribe()
+        }
+    }, func(err error) {
+        fmt.Fprintf(os.Stderr, "connection lost: %v\n", err)
+    }, onMessage)
+    
+    if err := t.Connect(); err != nil {
+        return nil, err
+    }
+    
+    subscribe()
+    atomic.StoreInt32(&connected, 1)
+    
+    return t, nil
+}
+
+// publishWait publishes and waits for the publish to complete
+//
+func publishWait(t *mqttfabric.PahoTransport, topic string, qos byte, retain bool, payload []byte) error {
+    token := t.Client.Publish(topic, qos, retain, payload)
+    
+    if !token.WaitTimeout(10 * time.Second) {
+        return fmt.Errorf("timeout publishing to %s", topic)
+    }
+    
+    return token.Error()
+}
+
+// mapFlag is a repeatable old=new flag
+//
+type mapFlag map[string]string
+
+func (f mapFlag) String() string {
+    var list []string
+    
+    for k, v := range f {
+        list = append(list, k + "=" + v)
+    }
+    
+    return strings.Join(list, ",")
+}
+
+func (f mapFlag) Set(s string) error {
+    kv := strings.SplitN(s, "=", 2)
+    
+    if len(kv) != 2 || kv[0] == "" {
+        return fmt.Errorf("'%s' is not old=new", s)
+    }
+    
+    f[kv[0]] = kv[1]
+    
+    return nil
+}
+
+// interrupted returns a channel that is closed on SIGINT
+//
+func interrupted() <-chan struct{} {
+    done := make(chan struct{})
+    sig  := make(chan os.Signal, 1)
+    
+    signal.Notify(sig, os.Interrupt)
+    
+    go func() {
+        <-sig
+        close(done)
+    }()
+    
+    return done
+}
+
+func fail(format string, args ...interface{}) int {
+    fmt.Fprintf(os.Stderr, "fabric: " + strings.TrimSuffix(format, "\n") + "\n", args...)
+    return 1
+}
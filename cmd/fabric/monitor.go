@@ -0,0 +1,223 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "flag"
+    "path"
+    "sort"
+    "sync"
+    "time"
+    "encoding/json"
+    "text/tabwriter"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// monitorRow is the last message seen on a topic
+//
+type monitorRow struct {
+    Time            time.Time   `json:"time"`
+    Topic           string      `json:"topic"`
+    Root            string      `json:"root"`
+    Node            string      `json:"node"`
+    Direction       string      `json:"direction"`
+    PlatformID      string      `json:"platform_id"`
+    ServiceID       string      `json:"service_id"`
+    FeedID          string      `json:"feed_id"`
+    ActorID         string      `json:"actor_id,omitempty"`
+    TaskID          string      `json:"task_id,omitempty"`
+    Value           interface{} `json:"value"`
+    Retained        bool        `json:"retained"`
+}
+
+func runMonitor(args []string) int {
+    fs := flag.NewFlagSet("monitor", flag.ExitOnError)
+    g  := addGlobalFlags(fs)
+    
+    node    := fs.String("node",    "*", "only show nodes matching this pattern")
+    service := fs.String("service", "*", "only show services matching this pattern")
+    feed    := fs.String("feed",    "*", "only show feeds matching this pattern")
+    dir     := fs.String("dir",     "*", "only show this direction (onramp or offramp)")
+    asJSON  := fs.Bool("json",      false, "print every message as a line of JSON instead of the table")
+    refresh := fs.Duration("refresh", time.Second, "table refresh interval")
+    
+    fs.Parse(args)
+    
+    c, err := g.load()
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    match := func(pattern string, s string) bool {
+        ok, err := path.Match(pattern, s)
+        return err == nil && ok
+    }
+    
+    var mu   sync.Mutex
+    rows    := make(map[string]*monitorRow)
+    enc     := json.NewEncoder(os.Stdout)
+    
+    var topics []string
+    
+    for _, root := range roots(c) {
+        topics = append(topics, root + "/#")
+    }
+    
+    onMessage := func(msg *mqttfabric.Message) {
+        row := newMonitorRow(roots(c), msg)
+        
+        if row == nil {
+            return
+        }
+        if !match(*node, row.Node) || !match(*service, row.ServiceID) || !match(*feed, row.FeedID) || !match(*dir, row.Direction) {
+            return
+        }
+        
+        mu.Lock()
+        defer mu.Unlock()
+        
+        if *asJSON {
+            enc.Encode(row)
+        } else {
+            rows[row.Topic] = row
+        }
+    }
+    
+    handler, err := decrypting(c, onMessage)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    t, err := connectRaw(c, topics, handler)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    defer t.Disconnect(250)
+    
+    done   := interrupted()
+    ticker := time.NewTicker(*refresh)
+    defer ticker.Stop()
+    
+    for {
+        select {
+            case <-done:
+                return 0
+                
+            case <-ticker.C:
+                if !*asJSON {
+                    mu.Lock()
+                    printMonitorTable(rows)
+                    mu.Unlock()
+                }
+        }
+    }
+}
+
+// newMonitorRow returns nil for topics that are not onramp or offramp feeds
+//
+func newMonitorRow(roots []string, msg *mqttfabric.Message) *monitorRow {
+    t, err := mqttfabric.ParseTopicRoots(roots, msg.Topic)
+    
+    if err != nil || t.Kind == mqttfabric.TOPIC_COMMAND {
+        return nil
+    }
+    
+    row := &monitorRow{
+        Time:       time.Now(),
+        Topic:      msg.Topic,
+        Root:       t.RootTopic,
+        Node:       t.NodeName,
+        Direction:  "onramp",
+        PlatformID: t.PlatformID,
+        ServiceID:  t.ServiceID,
+        FeedID:     t.FeedID,
+        ActorID:    t.ActorID,
+        TaskID:     t.TaskID,
+        Retained:   msg.Retained,
+    }
+    
+    if t.Kind == mqttfabric.TOPIC_OFFRAMP {
+        row.Direction = "offramp"
+    }
+    
+    if b, err := mqttfabric.BlueMixParse(string(msg.Payload)); err == nil {
+        row.Value = b.T
+    } else {
+        row.Value = string(msg.Payload)
+    }
+    
+    return row
+}
+
+func printMonitorTable(rows map[string]*monitorRow) {
+    list := make([]*monitorRow, 0, len(rows))
+    
+    for _, row := range rows {
+        list = append(list, row)
+    }
+    
+    sort.Slice(list, func(i, j int) bool {
+        a, b := list[i], list[j]
+        
+        if a.Node != b.Node {
+            return a.Node < b.Node
+        }
+        if a.Direction != b.Direction {
+            return a.Direction < b.Direction
+        }
+        if a.ServiceID != b.ServiceID {
+            return a.ServiceID < b.ServiceID
+        }
+        
+        return a.FeedID < b.FeedID
+    })
+    
+    // clear the screen
+    fmt.Print("\033[H\033[2J")
+    
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    
+    fmt.Fprintln(w, "NODE\tDIR\tPLATFORM\tSERVICE\tFEED\tTASK\tVALUE\tAGE")
+    
+    for _, row := range list {
+        age := time.Since(row.Time).Truncate(time.Second).String()
+        
+        if row.Retained {
+            age += " (retained)"
+        }
+        
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%v\t%s\n", row.Node, row.Direction, row.PlatformID, row.ServiceID, row.FeedID, row.TaskID, row.Value, age)
+    }
+    
+    w.Flush()
+}
@@ -0,0 +1,214 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "flag"
+    "sort"
+    "sync"
+    "time"
+    "strings"
+    "encoding/json"
+    "text/tabwriter"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// nodeRow is the last status seen for a node
+//
+type nodeRow struct {
+    Root            string      `json:"root"`
+    Node            string      `json:"node"`
+    PlatformID      string      `json:"platform_id"`
+    Class           string      `json:"class"`
+    Status          string      `json:"status"`
+    Uptime          int64       `json:"uptime"`             // now, if the node is online
+    Since           *time.Time  `json:"since,omitempty"`    // the time of the status, if it has one
+}
+
+func runNodes(args []string) int {
+    fs := flag.NewFlagSet("nodes", flag.ExitOnError)
+    g  := addGlobalFlags(fs)
+    
+    wait     := fs.Duration("wait",  2 * time.Second, "how long to collect status messages")
+    require  := fs.String("require", "", "comma separated nodenames that must be online")
+    asJSON   := fs.Bool("json",      false, "print the nodes as JSON")
+    
+    fs.Parse(args)
+    
+    c, err := g.load()
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    var mu  sync.Mutex
+    nodes  := make(map[string]*nodeRow)
+    
+    var topics []string
+    
+    for _, root := range roots(c) {
+        f := mqttfabric.FabricInitialize(root, c.NodeName, c.PlatformID, mqttfabric.CONTROLLER)
+        topics = append(topics, f.StatusSubscription(mqttfabric.FABRIC_TOPIC_ANY, mqttfabric.FABRIC_TOPIC_ANY))
+    }
+    
+    t, err := connectRaw(c, topics, func(msg *mqttfabric.Message) {
+        topic, err := mqttfabric.ParseTopicRoots(roots(c), msg.Topic)
+        
+        if err != nil {
+            return
+        }
+        
+        s, err := mqttfabric.StatusParse(string(msg.Payload))
+        
+        if err != nil {
+            return
+        }
+        
+        mu.Lock()
+        defer mu.Unlock()
+        
+        n := &nodeRow{
+            Root:       topic.RootTopic,
+            Node:       s.NodeName,
+            PlatformID: s.PlatformID,
+            Class:      s.ClassType.String(),
+            Status:     s.Status.String(),
+            Uptime:     s.Uptime,
+        }
+        
+        // the retained status has the uptime of when it was published
+        if !s.Time.IsZero() {
+            n.Since = &s.Time
+            
+            if s.Status == mqttfabric.FABRIC_ONLINE {
+                n.Uptime += int64(time.Since(s.Time) / time.Second)
+            }
+        }
+        
+        nodes[msg.Topic] = n
+    })
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    time.Sleep(*wait)
+    t.Disconnect(250)
+    
+    mu.Lock()
+    defer mu.Unlock()
+    
+    list := make([]*nodeRow, 0, len(nodes))
+    
+    for _, n := range nodes {
+        list = append(list, n)
+    }
+    
+    sort.Slice(list, func(i, j int) bool {
+        if list[i].Root != list[j].Root {
+            return list[i].Root < list[j].Root
+        }
+        if list[i].Node != list[j].Node {
+            return list[i].Node < list[j].Node
+        }
+        
+        return list[i].PlatformID < list[j].PlatformID
+    })
+    
+    if *asJSON {
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "  ")
+        enc.Encode(list)
+    } else {
+        printNodes(list)
+    }
+    
+    // a node is online if any of its platforms is online
+    exit := 0
+    
+    for _, name := range strings.Split(*require, ",") {
+        if name = strings.TrimSpace(name); name == "" {
+            continue
+        }
+        
+        online := false
+        
+        for _, n := range list {
+            if n.Node == name && n.Status == mqttfabric.FABRIC_ONLINE.String() {
+                online = true
+            }
+        }
+        
+        if !online {
+            fmt.Fprintf(os.Stderr, "fabric: required node '%s' is not online\n", name)
+            exit = 1
+        }
+    }
+    
+    return exit
+}
+
+func printNodes(list []*nodeRow) {
+    // only use colors on a terminal
+    color := false
+    
+    if fi, err := os.Stdout.Stat(); err == nil && fi.Mode() & os.ModeCharDevice != 0 {
+        color = true
+    }
+    
+    // status is the last column since the color codes would break the alignment
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    
+    fmt.Fprintln(w, "ROOT\tNODE\tPLATFORM\tCLASS\tUPTIME\tSTATUS")
+    
+    for _, n := range list {
+        status := n.Status
+        uptime := "-"
+        
+        if n.Status == mqttfabric.FABRIC_DISCONNECTED.String() {
+            // the LWT is active
+            if color {
+                status = "\033[31m" + status + "\033[0m"
+            } else {
+                status = status + " (!)"
+            }
+        } else {
+            uptime = (time.Duration(n.Uptime) * time.Second).String()
+            
+            // from a node that doesn't send the time of its status
+            if n.Since == nil && n.Status == mqttfabric.FABRIC_ONLINE.String() {
+                uptime = ">" + uptime
+            }
+        }
+        
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", n.Root, n.Node, n.PlatformID, n.Class, uptime, status)
+    }
+    
+    w.Flush()
+}
@@ -0,0 +1,302 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+    "fmt"
+    "flag"
+    "time"
+    "errors"
+    "strconv"
+    "strings"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// inferValue converts s to the type given by valueType. With "auto" integers,
+// floats and the words true and false are recognized and everything else is a
+// string
+//
+func inferValue(s string, valueType string) (interface{}, error) {
+    switch valueType {
+        case "string":
+            return s, nil
+            
+        case "bool":
+            switch strings.ToLower(s) {
+                case "true", "on", "1":
+                    return true, nil
+                case "false", "off", "0":
+                    return false, nil
+            }
+            return nil, errors.New("'" + s + "' is not a bool")
+            
+        case "int":
+            return strconv.Atoi(s)
+            
+        case "float":
+            return strconv.ParseFloat(s, 64)
+            
+        case "auto":
+            if i, err := strconv.Atoi(s); err == nil {
+                return i, nil
+            }
+            if f, err := strconv.ParseFloat(s, 64); err == nil {
+                return f, nil
+            }
+            // not strconv.ParseBool(), it takes "t", "F" and the like
+            switch s {
+                case "true":
+                    return true, nil
+                case "false":
+                    return false, nil
+            }
+            return s, nil
+    }
+    
+    return nil, errors.New("unknown value type '" + valueType + "'")
+}
+
+// taskService returns the service a task is normally sent to
+//
+func taskService(taskID string) string {
+    switch taskID {
+        case mqttfabric.TASK_ID_DIGITAL_WRITE, mqttfabric.TASK_ID_DIGITAL_WRITE_EX, mqttfabric.TASK_ID_DIGITAL_WRITE_MOMENTARY, mqttfabric.TASK_ID_DIGITAL_WRITE_MOMENTARY_EX:
+            return mqttfabric.SERVICE_ID_DIGITAL_OUT
+        case mqttfabric.TASK_ID_ANALOG_WRITE, mqttfabric.TASK_ID_ANALOG_WRITE_EX:
+            return mqttfabric.SERVICE_ID_ANALOG_OUT
+    }
+    
+    return mqttfabric.SERVICE_ID_TEXT
+}
+
+// taskValueType returns the value type a task expects
+//
+func taskValueType(taskID string) string {
+    switch taskService(taskID) {
+        case mqttfabric.SERVICE_ID_DIGITAL_OUT:
+            return "bool"
+        case mqttfabric.SERVICE_ID_ANALOG_OUT:
+            return "int"
+    }
+    
+    return "string"
+}
+
+// encode builds the "d" envelope like MqttFabric does: the value encrypted if
+// the configuration has encryption keys, then signed with the key of the
+// nodename if it has a keyring
+//
+func encode(c *mqttfabric.Config, topic string, serviceID string, feedID string, v interface{}) ([]byte, error) {
+    e, err := loadEncryption(c)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    if e != nil {
+        t, err := mqttfabric.ParseTopicRoots(roots(c), topic)
+        
+        if err != nil {
+            return nil, err
+        }
+        
+        if v, err = e.Encrypt(t, topic, v); err != nil {
+            return nil, err
+        }
+    }
+    
+    if c.Signing == nil {
+        return mqttfabric.BlueMixEncode(serviceID, feedID, v)
+    }
+    
+    keyring, err := mqttfabric.LoadKeyring(c.Signing.Keyring)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    key := keyring.Key(c.NodeName)
+    
+    if key == nil {
+        return nil, fmt.Errorf("no key for %s in %s", c.NodeName, c.Signing.Keyring)
+    }
+    
+    return mqttfabric.SignEnvelope(topic, c.NodeName, key, serviceID, feedID, v, "")
+}
+
+func runPub(args []string) int {
+    fs := flag.NewFlagSet("pub", flag.ExitOnError)
+    g  := addGlobalFlags(fs)
+    
+    service   := fs.String("service", "", "service id")
+    feed      := fs.String("feed",    "", "feed id")
+    value     := fs.String("value",   "", "the value")
+    valueType := fs.String("type",    "auto", "value type: auto, bool, int, float or string")
+    qos       := fs.Int("qos",        0, "QoS")
+    retain    := fs.Bool("retain",    false, "retain the value")
+    
+    fs.Parse(args)
+    
+    c, err := g.load()
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    if *service == "" || *feed == "" {
+        return fail("-service and -feed are required")
+    }
+    
+    v, err := inferValue(*value, *valueType)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    f       := mqttfabric.FabricInitialize(c.RootTopic, c.NodeName, c.PlatformID, mqttfabric.DEVICE)
+    topic   := f.DeviceOnrampTopic(*service, *feed)
+    msg, err := encode(c, topic, *service, *feed, v)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    t, err := connectRaw(c, nil, func(msg *mqttfabric.Message) {})
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    defer t.Disconnect(250)
+    
+    if err := publishWait(t, topic, byte(*qos), *retain, msg); err != nil {
+        return fail("%v", err)
+    }
+    
+    fmt.Printf("%s %s\n", topic, msg)
+    
+    return 0
+}
+
+func runWrite(args []string) int {
+    fs := flag.NewFlagSet("write", flag.ExitOnError)
+    g  := addGlobalFlags(fs)
+    
+    to         := fs.String("to",              "", "nodename of the target node")
+    platform   := fs.String("target-platform", "", "platform id of the target node")
+    task       := fs.String("task",            mqttfabric.TASK_ID_DIGITAL_WRITE, "task id: digital_write, digital_write_momentary, analog_write, raw, ...")
+    service    := fs.String("service",         "", "service id (default depends on the task)")
+    feed       := fs.String("feed",            "", "feed id")
+    value      := fs.String("value",           "", "the value")
+    valueType  := fs.String("type",            "", "value type: auto, bool, int, float or string (default depends on the task)")
+    qos        := fs.Int("qos",                1, "QoS")
+    wait       := fs.Duration("wait",          0, "wait this long for the node to publish the new value")
+    ackService := fs.String("ack-service",     "", "service to wait for the new value on (default is -service)")
+    
+    fs.Parse(args)
+    
+    c, err := g.load()
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    if *to == "" || *platform == "" || *feed == "" {
+        return fail("-to, -target-platform and -feed are required")
+    }
+    
+    if *service == "" {
+        *service = taskService(*task)
+    }
+    if *valueType == "" {
+        *valueType = taskValueType(*task)
+    }
+    if *ackService == "" {
+        *ackService = *service
+    }
+    
+    v, err := inferValue(*value, *valueType)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    f       := mqttfabric.FabricInitialize(c.RootTopic, c.NodeName, c.PlatformID, mqttfabric.CONTROLLER)
+    topic   := f.CtrlOfframpTopic(*to, *task, *platform, *service, *feed)
+    ack     := f.CtrlOnrampSubscription(*to, *platform, *ackService, *feed)
+    msg, err := encode(c, topic, *service, *feed, v)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    acks      := make(chan *mqttfabric.Message, 1)
+    var topics []string
+    
+    if *wait > 0 {
+        topics = append(topics, ack)
+    }
+    
+    handler, err := decrypting(c, func(msg *mqttfabric.Message) {
+        // a retained value is the state from before the task
+        if msg.Topic == ack && !msg.Retained {
+            select {
+                case acks <- msg:
+                default:
+            }
+        }
+    })
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    t, err := connectRaw(c, topics, handler)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    defer t.Disconnect(250)
+    
+    if err := publishWait(t, topic, byte(*qos), false, msg); err != nil {
+        return fail("%v", err)
+    }
+    
+    fmt.Printf("%s %s\n", topic, msg)
+    
+    if *wait <= 0 {
+        return 0
+    }
+    
+    select {
+        case m := <-acks:
+            fmt.Printf("%s %s\n", m.Topic, m.Payload)
+            return 0
+            
+        case <-time.After(*wait):
+            return fail("no new value on %s within %v", ack, *wait)
+    }
+}
@@ -0,0 +1,165 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "flag"
+    "time"
+    "bufio"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+func runRecord(args []string) int {
+    fs := flag.NewFlagSet("record", flag.ExitOnError)
+    g  := addGlobalFlags(fs)
+    
+    out      := fs.String("out",        "-", "file to write to, - is stdout")
+    duration := fs.Duration("duration", 0, "stop after this long, 0 records until interrupted")
+    
+    fs.Parse(args)
+    
+    c, err := g.load()
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    var w io.Writer = os.Stdout
+    
+    if *out != "-" {
+        f, err := os.Create(*out)
+        
+        if err != nil {
+            return fail("%v", err)
+        }
+        
+        defer f.Close()
+        
+        w = f
+    }
+    
+    bw := bufio.NewWriter(w)
+    defer bw.Flush()
+    
+    recorder := mqttfabric.NewRecorder(bw)
+    
+    var topics []string
+    
+    for _, root := range roots(c) {
+        topics = append(topics, root + "/#")
+    }
+    
+    t, err := connectRaw(c, topics, recorder.Handler())
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    var timeout <-chan time.Time
+    
+    if *duration > 0 {
+        timeout = time.After(*duration)
+    }
+    
+    select {
+        case <-interrupted():
+        case <-timeout:
+    }
+    
+    t.Disconnect(250)
+    
+    return 0
+}
+
+func runReplay(args []string) int {
+    fs := flag.NewFlagSet("replay", flag.ExitOnError)
+    g  := addGlobalFlags(fs)
+    
+    in      := fs.String("in",     "-", "file to read from, - is stdin")
+    speed   := fs.Float64("speed", 1, "timing factor: 1 is the original timing, 2 twice as fast, 0 as fast as possible")
+    rootMap := mapFlag{}
+    nodeMap := mapFlag{}
+    
+    fs.Var(rootMap, "rewrite-root", "rewrite a root topic, old=new (repeatable)")
+    fs.Var(nodeMap, "rewrite-node", "rewrite a nodename, old=new (repeatable)")
+    
+    fs.Parse(args)
+    
+    c, err := g.load()
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    var r io.Reader = os.Stdin
+    
+    if *in != "-" {
+        f, err := os.Open(*in)
+        
+        if err != nil {
+            return fail("%v", err)
+        }
+        
+        defer f.Close()
+        
+        r = f
+    }
+    
+    t, err := connectRaw(c, nil, func(msg *mqttfabric.Message) {})
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    defer t.Disconnect(250)
+    
+    p := mqttfabric.NewReplayer(func(topic string, qos byte, retain bool, payload []byte) error {
+        if g.verbose {
+            fmt.Fprintf(os.Stderr, "%s %s\n", topic, payload)
+        }
+        
+        return publishWait(t, topic, qos, retain, payload)
+    })
+    
+    p.Speed      = *speed
+    p.Roots      = roots(c)
+    p.RootTopics = rootMap
+    p.NodeNames  = nodeMap
+    
+    for old := range rootMap {
+        p.Roots = append(p.Roots, old)
+    }
+    
+    if err := p.Replay(mqttfabric.NewRecordReader(r), interrupted()); err != nil {
+        return fail("%v", err)
+    }
+    
+    return 0
+}
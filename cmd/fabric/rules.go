@@ -0,0 +1,172 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "flag"
+    "strings"
+    "github.com/mikejac/mqtt.fabric.golang/rules"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+func runRules(args []string) int {
+    if len(args) < 1 {
+        return fail("usage: fabric rules run|test [flags]")
+    }
+    
+    switch args[0] {
+        case "run":
+            return runRulesRun(args[1:])
+        case "test":
+            return runRulesTest(args[1:])
+    }
+    
+    return fail("unknown rules command '%s', use run or test", args[0])
+}
+
+func runRulesRun(args []string) int {
+    fs := flag.NewFlagSet("rules run", flag.ExitOnError)
+    g  := addGlobalFlags(fs)
+    
+    file   := fs.String("rules",   "", "rule file (.json or .yaml)")
+    dryRun := fs.Bool("dry-run",   false, "print the tasks without sending them")
+    
+    fs.Parse(args)
+    
+    c, err := g.load()
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    if *file == "" {
+        return fail("-rules is required")
+    }
+    
+    set, err := rules.LoadRules(*file)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    c.Class = "controller"
+    
+    m, err := mqttfabric.NewFromConfig(c)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    e, err := rules.NewEngine(m, set)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    e.DryRun = *dryRun
+    e.OnFire = func(f *rules.Firing) {
+        fmt.Println(f)
+    }
+    
+    if err := e.Start(); err != nil {
+        return fail("%v", err)
+    }
+    
+    m.Start()
+    
+    <-interrupted()
+    
+    e.Stop()
+    m.Stop()
+    
+    return 0
+}
+
+// runRulesTest prints what the rules would have done on recorded traffic, the
+// output can be compared to an expected one
+//
+func runRulesTest(args []string) int {
+    fs := flag.NewFlagSet("rules test", flag.ExitOnError)
+    
+    file  := fs.String("rules", "", "rule file (.json or .yaml)")
+    in    := fs.String("in",    "", "recording made with 'fabric record'")
+    root  := fs.String("roots", "", "comma separated root topics of the recording (default root_topic of the rule file)")
+    keys  := fs.String("keys",  "", "encryption key file to decrypt the recording with (see LoadEncryption)")
+    
+    fs.Parse(args)
+    
+    if *file == "" || *in == "" {
+        return fail("-rules and -in are required")
+    }
+    
+    set, err := rules.LoadRules(*file)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    f, err := os.Open(*in)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    defer f.Close()
+    
+    var roots []string
+    
+    if *root != "" {
+        roots = strings.Split(*root, ",")
+    } else if set.RootTopic != "" {
+        roots = []string{set.RootTopic}
+    }
+    
+    rr := mqttfabric.NewRecordReader(f)
+    
+    if *keys != "" {
+        e, err := mqttfabric.LoadEncryption(*keys)
+        
+        if err != nil {
+            return fail("%v", err)
+        }
+        
+        rr.SetDecryption(e, roots)
+    }
+    
+    fired, err := rules.Evaluate(set, rr, roots)
+    
+    for _, f := range fired {
+        fmt.Println(f)
+    }
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    return 0
+}
@@ -0,0 +1,76 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package main
+
+import (
+    "flag"
+    "github.com/mikejac/mqtt.fabric.golang/simulator"
+)
+
+func runSimulate(args []string) int {
+    fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+    g  := addGlobalFlags(fs)
+    
+    specFile := fs.String("spec", "", "simulation spec (.json or .yaml)")
+    
+    fs.Parse(args)
+    
+    c, err := g.load()
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    if *specFile == "" {
+        return fail("-spec is required")
+    }
+    
+    spec, err := simulator.LoadSpec(*specFile)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    
+    // the root topic from the command line wins over the one in the spec
+    if g.root != "" {
+        spec.RootTopic = g.root
+    }
+    
+    s, err := simulator.NewFromConfig(spec, c)
+    
+    if err != nil {
+        return fail("%v", err)
+    }
+    if err := s.Start(); err != nil {
+        return fail("%v", err)
+    }
+    
+    <-interrupted()
+    
+    s.Stop()
+    
+    return 0
+}
@@ -0,0 +1,386 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "os"
+    "time"
+    "errors"
+    "strconv"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+    "gopkg.in/yaml.v2"
+    "github.com/BurntSushi/toml"
+)
+
+// PolicyConfig ...
+//
+type PolicyConfig struct {
+    ServiceID       string      `json:"service_id"  yaml:"service_id"  toml:"service_id"`
+    FeedID          string      `json:"feed_id"     yaml:"feed_id"     toml:"feed_id"`
+    QoS             byte        `json:"qos"         yaml:"qos"         toml:"qos"`
+    Retain          bool        `json:"retain"      yaml:"retain"      toml:"retain"`
+}
+
+// SigningConfig ...
+//
+type SigningConfig struct {
+    Keyring         string      `json:"keyring"     yaml:"keyring"      toml:"keyring"`      // see LoadKeyring
+    Unsigned        string      `json:"unsigned"    yaml:"unsigned"     toml:"unsigned"`     // "drop" (default) or "flag"
+    MaxRetainedAge  int         `json:"max_retained_age" yaml:"max_retained_age" toml:"max_retained_age"` // seconds, 0 is 24h
+}
+
+// EncryptionConfig ...
+//
+type EncryptionConfig struct {
+    Keys            string      `json:"keys"        yaml:"keys"         toml:"keys"`         // see LoadEncryption
+    Required        bool        `json:"required"    yaml:"required"     toml:"required"`
+}
+
+// Config holds everything needed to create an MqttFabric
+//
+type Config struct {
+    Broker          string          `json:"broker"      yaml:"broker"       toml:"broker"`
+    Port            int             `json:"port"        yaml:"port"         toml:"port"`
+    KeepAlive       int             `json:"keepalive"   yaml:"keepalive"    toml:"keepalive"`
+    ClientID        string          `json:"client_id"   yaml:"client_id"    toml:"client_id"`
+    Username        string          `json:"username"    yaml:"username"     toml:"username"`
+    Password        string          `json:"password"    yaml:"password"     toml:"password"`
+    
+    RootTopic       string          `json:"root_topic"  yaml:"root_topic"   toml:"root_topic"`
+    Roots           []string        `json:"roots"       yaml:"roots"        toml:"roots"`        // additional root topics
+    NodeName        string          `json:"nodename"    yaml:"nodename"     toml:"nodename"`
+    PlatformID      string          `json:"platform_id" yaml:"platform_id"  toml:"platform_id"`
+    Class           string          `json:"class"       yaml:"class"        toml:"class"`        // "device" or "controller"
+    
+    Policies        []PolicyConfig  `json:"policies"    yaml:"policies"     toml:"policies"`
+    Signing         *SigningConfig  `json:"signing"     yaml:"signing"      toml:"signing"`      // nil disables signing
+    Encryption      *EncryptionConfig `json:"encryption" yaml:"encryption"  toml:"encryption"`   // nil disables encryption
+    ACL             *ACL            `json:"acl"         yaml:"acl"          toml:"acl"`          // tasks sent to this node, nil allows all
+}
+
+// NewConfig returns a Config with the defaults set
+//
+func NewConfig() *Config {
+    return &Config{
+        Port:       1883,
+        KeepAlive:  60,
+        Class:      "device",
+    }
+}
+
+// LoadConfig reads the defaults, then the file at path (if not empty) and last
+// the FABRIC_* environment variables. The result is validated
+//
+func LoadConfig(path string) (*Config, error) {
+    c := NewConfig()
+    
+    if path != "" {
+        if err := c.LoadFile(path); err != nil {
+            return nil, err
+        }
+    }
+    
+    if err := c.LoadEnv(); err != nil {
+        return nil, err
+    }
+    
+    if err := c.Validate(); err != nil {
+        return nil, err
+    }
+    
+    return c, nil
+}
+
+// LoadFile reads a .json, .yaml/.yml or .toml file into c
+//
+func (c *Config) LoadFile(path string) error {
+    data, err := ioutil.ReadFile(path)
+    
+    if err != nil {
+        return err
+    }
+    
+    switch strings.ToLower(filepath.Ext(path)) {
+        case ".json":
+            err = json.Unmarshal(data, c)
+        case ".yaml", ".yml":
+            err = yaml.Unmarshal(data, c)
+        case ".toml":
+            err = toml.Unmarshal(data, c)
+        default:
+            return errors.New("LoadFile: unknown file type '" + filepath.Ext(path) + "'")
+    }
+    
+    if err != nil {
+        return errors.New("LoadFile: " + path + ": " + err.Error())
+    }
+    
+    return nil
+}
+
+// LoadEnv overrides c with the FABRIC_* environment variables that are set
+//
+func (c *Config) LoadEnv() error {
+    envString := func(name string, value *string) {
+        if v, ok := os.LookupEnv(name); ok {
+            *value = v
+        }
+    }
+    envInt := func(name string, value *int) error {
+        if v, ok := os.LookupEnv(name); ok {
+            i, err := strconv.Atoi(v)
+            
+            if err != nil {
+                return errors.New("LoadEnv: " + name + " is not a number")
+            }
+            
+            *value = i
+        }
+        
+        return nil
+    }
+    
+    envString("FABRIC_BROKER",      &c.Broker)
+    envString("FABRIC_CLIENT_ID",   &c.ClientID)
+    envString("FABRIC_USERNAME",    &c.Username)
+    envString("FABRIC_PASSWORD",    &c.Password)
+    envString("FABRIC_ROOT_TOPIC",  &c.RootTopic)
+    envString("FABRIC_NODENAME",    &c.NodeName)
+    envString("FABRIC_PLATFORM_ID", &c.PlatformID)
+    envString("FABRIC_CLASS",       &c.Class)
+    
+    if v, ok := os.LookupEnv("FABRIC_ROOTS"); ok {
+        c.Roots = nil
+        
+        for _, root := range strings.Split(v, ",") {
+            if root = strings.TrimSpace(root); root != "" {
+                c.Roots = append(c.Roots, root)
+            }
+        }
+    }
+    
+    if err := envInt("FABRIC_PORT", &c.Port); err != nil {
+        return err
+    }
+    if err := envInt("FABRIC_KEEPALIVE", &c.KeepAlive); err != nil {
+        return err
+    }
+    
+    return nil
+}
+
+// Validate ...
+//
+func (c *Config) Validate() error {
+    if c.Broker == "" {
+        return errors.New("Validate: broker is not set")
+    }
+    if c.Port <= 0 || c.Port > 65535 {
+        return errors.New("Validate: invalid port " + strconv.Itoa(c.Port))
+    }
+    if c.KeepAlive < 0 {
+        return errors.New("Validate: invalid keepalive " + strconv.Itoa(c.KeepAlive))
+    }
+    if c.RootTopic == "" {
+        return errors.New("Validate: root_topic is not set")
+    }
+    if c.NodeName == "" {
+        return errors.New("Validate: nodename is not set")
+    }
+    if c.PlatformID == "" {
+        return errors.New("Validate: platform_id is not set")
+    }
+    if c.ClassType() == 0 {
+        return errors.New("Validate: class must be 'device' or 'controller'")
+    }
+    
+    for _, topic := range append([]string{c.RootTopic, c.NodeName, c.PlatformID}, c.Roots...) {
+        if strings.ContainsAny(topic, "+#") {
+            return errors.New("Validate: '" + topic + "' contains a wildcard")
+        }
+    }
+    
+    for _, p := range c.Policies {
+        if p.ServiceID == "" || p.FeedID == "" {
+            return errors.New("Validate: policy without service_id or feed_id")
+        }
+        if p.QoS > 2 {
+            return errors.New("Validate: invalid qos for policy " + policyKey(p.ServiceID, p.FeedID))
+        }
+    }
+    
+    if c.Signing != nil {
+        if c.Signing.Keyring == "" {
+            return errors.New("Validate: signing without keyring")
+        }
+        if c.Signing.Unsigned != "" && c.Signing.Unsigned != "drop" && c.Signing.Unsigned != "flag" {
+            return errors.New("Validate: signing.unsigned must be 'drop' or 'flag'")
+        }
+        if c.Signing.MaxRetainedAge < 0 {
+            return errors.New("Validate: negative signing.max_retained_age")
+        }
+    }
+    
+    if c.Encryption != nil && c.Encryption.Keys == "" {
+        return errors.New("Validate: encryption without keys")
+    }
+    
+    if c.ACL != nil {
+        if err := c.ACL.Validate(); err != nil {
+            return err
+        }
+    }
+    
+    return nil
+}
+
+// ClassType returns the class type of c or 0 if Class is invalid
+//
+func (c *Config) ClassType() ClassType {
+    switch strings.ToLower(c.Class) {
+        case "device":
+            return DEVICE
+        case "controller":
+            return CONTROLLER
+    }
+    
+    return 0
+}
+
+// NewFromConfig creates an MqttFabric using the Paho transport
+//
+func NewFromConfig(c *Config) (*MqttFabric, error) {
+    if err := c.Validate(); err != nil {
+        return nil, err
+    }
+    
+    t      := NewPahoTransportFromConfig(c)
+    m, err := NewFromConfigTransport(c, t)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    m.Options = t.Options
+    
+    return m, nil
+}
+
+// NewPahoTransportFromConfig creates a Paho transport from the connection
+// settings in c
+//
+func NewPahoTransportFromConfig(c *Config) *PahoTransport {
+    clientid := c.ClientID
+    
+    if clientid == "" {
+        clientid = DefaultClientID()
+    }
+    
+    opts := pahoOptions(c.Broker, c.Port, c.KeepAlive, clientid)
+    
+    if c.Username != "" {
+        opts.SetUsername(c.Username)
+        opts.SetPassword(c.Password)
+    }
+    
+    return NewPahoTransport(opts)
+}
+
+// NewFromConfigTransport creates an MqttFabric using transport. The connection
+// settings in c are not used
+//
+func NewFromConfigTransport(c *Config, transport Transport) (*MqttFabric, error) {
+    if err := c.Validate(); err != nil {
+        return nil, err
+    }
+    
+    m := MqttFabricInitializeTransport(transport, c.RootTopic, c.NodeName, c.PlatformID, c.ClassType())
+    
+    for _, root := range c.Roots {
+        m.AddRoot(root)
+    }
+    
+    for _, p := range c.Policies {
+        m.SetPolicy(p.ServiceID, p.FeedID, p.QoS, p.Retain)
+    }
+    
+    if c.Signing != nil {
+        s, err := c.Signing.NewSigning()
+        
+        if err != nil {
+            return nil, err
+        }
+        
+        m.SetSigning(s)
+    }
+    
+    if c.Encryption != nil {
+        e, err := LoadEncryption(c.Encryption.Keys)
+        
+        if err != nil {
+            return nil, err
+        }
+        
+        e.Required = c.Encryption.Required
+        m.SetEncryption(e)
+    }
+    
+    if c.ACL != nil {
+        m.SetACL(c.ACL)
+    }
+    
+    return m, nil
+}
+
+// NewSigning loads the keyring
+//
+func (c *SigningConfig) NewSigning() (*Signing, error) {
+    keyring, err := LoadKeyring(c.Keyring)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    s := NewSigning(keyring, c.policy())
+    
+    if c.MaxRetainedAge > 0 {
+        s.MaxRetainedAge = time.Duration(c.MaxRetainedAge) * time.Second
+    }
+    
+    return s, nil
+}
+
+func (c *SigningConfig) policy() SignaturePolicy {
+    if c.Unsigned == "flag" {
+        return SIGNATURE_FLAG
+    }
+    
+    return SIGNATURE_DROP
+}
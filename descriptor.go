@@ -0,0 +1,275 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "log"
+    "sync"
+    "errors"
+    "encoding/json"
+)
+
+const (
+    FABRIC_CMD_DESCRIPTOR                   = "descriptor"
+)
+
+// FeedDescriptor describes one feed of a service
+//
+type FeedDescriptor struct {
+    FeedID          string      `json:"feed_id"`
+    ValueType       string      `json:"value_type"`         // bool, int, float or string
+    Unit            string      `json:"unit,omitempty"`
+    Min             *float64    `json:"min,omitempty"`
+    Max             *float64    `json:"max,omitempty"`
+    Tasks           []string    `json:"tasks,omitempty"`    // task id's the feed accepts
+}
+
+// ServiceDescriptor ...
+//
+type ServiceDescriptor struct {
+    ServiceID       string              `json:"service_id"`
+    Feeds           []*FeedDescriptor   `json:"feeds"`
+}
+
+// Descriptor lists the services and feeds a node offers. Devices publish it
+// retained next to their status topic
+//
+type Descriptor struct {
+    NodeName        string                  `json:"nodename"`
+    PlatformID      string                  `json:"platform_id"`
+    Services        []*ServiceDescriptor    `json:"services"`
+}
+
+// OnDescriptorHandler is called when a descriptor is published or removed, in
+// which case d is nil
+type OnDescriptorHandler func( mqtt            *MqttFabric,
+                               topic           *FabricTopic,
+                               d               *Descriptor)
+
+// NewDescriptor ...
+//
+func NewDescriptor(nodename string, platformID string) *Descriptor {
+    return &Descriptor{NodeName: nodename, PlatformID: platformID}
+}
+
+// AddFeed adds feed to the service serviceID
+//
+func (d *Descriptor) AddFeed(serviceID string, feed *FeedDescriptor) *Descriptor {
+    for _, s := range d.Services {
+        if s.ServiceID == serviceID {
+            s.Feeds = append(s.Feeds, feed)
+            return d
+        }
+    }
+    
+    d.Services = append(d.Services, &ServiceDescriptor{ServiceID: serviceID, Feeds: []*FeedDescriptor{feed}})
+    
+    return d
+}
+
+// Feed returns the descriptor of serviceID/feedID or nil
+//
+func (d *Descriptor) Feed(serviceID string, feedID string) *FeedDescriptor {
+    for _, s := range d.Services {
+        if s.ServiceID != serviceID {
+            continue
+        }
+        
+        for _, f := range s.Feeds {
+            if f.FeedID == feedID {
+                return f
+            }
+        }
+    }
+    
+    return nil
+}
+
+// DescriptorSubscription returns the descriptor topic of nodename/platformID,
+// both may be FABRIC_TOPIC_ANY
+//
+func (f *Fabric) DescriptorSubscription(nodename string, platformID string) (string) {
+    return f.RootTopic + "/" + nodename + "/$commands/$clients/" + FABRIC_SYS + "/" + platformID + "/" + FABRIC_CMD_DESCRIPTOR
+}
+
+// DescriptorMessage returns the topic and message for d
+//
+func (f *Fabric) DescriptorMessage(d *Descriptor) (string, string) {
+    type D struct {
+        Type        string `json:"_type"`
+        *Descriptor
+    }
+    
+    msg, err := json.Marshal(map[string]interface{}{"d": D{Type: FABRIC_CMD_DESCRIPTOR, Descriptor: d}})
+    
+    if err != nil {
+        log.Println("DescriptorMessage(): err = ", err)
+        return "", ""
+    }
+    
+    return f.DescriptorSubscription(d.NodeName, d.PlatformID), string(msg)
+}
+
+// DescriptorParse parses a message created by DescriptorMessage()
+//
+func DescriptorParse(msg string) (*Descriptor, error) {
+    type D struct {
+        Type        string `json:"_type"`
+        Descriptor
+    }
+    
+    var jsonMsg struct {
+        Data *D `json:"d"`
+    }
+    
+    if err := json.Unmarshal([]byte(msg), &jsonMsg); err != nil {
+        return nil, errors.New("DescriptorParse: cannot parse JSON object")
+    }
+    if jsonMsg.Data == nil || jsonMsg.Data.Type != FABRIC_CMD_DESCRIPTOR {
+        return nil, errors.New("DescriptorParse: not a descriptor message")
+    }
+    
+    return &jsonMsg.Data.Descriptor, nil
+}
+
+// descriptorRegistry holds the descriptors seen by a controller
+//
+type descriptorRegistry struct {
+    mu              sync.Mutex
+    watch           bool
+    descriptors     map[string]*Descriptor      // key is the topic
+}
+
+// SetDescriptor sets the descriptor a device publishes when it connects. If
+// already connected it is published right away
+//
+func (m *MqttFabric) SetDescriptor(d *Descriptor) *MqttFabric {
+    m.descriptor = d
+    
+    if m.Transport.IsConnected() {
+        m.publishDescriptor()
+    }
+    
+    return m
+}
+
+func (m *MqttFabric) publishDescriptor() {
+    if m.descriptor == nil {
+        return
+    }
+    
+    policy := m.Policy(FABRIC_SYS, FABRIC_CMD_DESCRIPTOR)
+    
+    for _, f := range m.Roots {
+        topic, msg := f.DescriptorMessage(m.descriptor)
+        
+        if topic != "" {
+            m.Publish(topic, policy.QoS, policy.Retain, []byte(msg))
+        }
+    }
+}
+
+// WatchDescriptors subscribes to the descriptors of all nodes under every root
+// and keeps track of them. handler may be nil
+//
+func (m *MqttFabric) WatchDescriptors(handler OnDescriptorHandler) *MqttFabric {
+    m.OnDescriptor = handler
+    
+    m.registry.mu.Lock()
+    m.registry.watch = true
+    m.registry.mu.Unlock()
+    
+    if m.Transport.IsConnected() {
+        m.subscribeDescriptors()
+    }
+    
+    return m
+}
+
+func (m *MqttFabric) subscribeDescriptors() {
+    m.SubscribeAll(1, func(f *Fabric) string {
+        return f.DescriptorSubscription(FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY)
+    })
+}
+
+func (m *MqttFabric) onDescriptor(t *FabricTopic, msg *Message) {
+    var d *Descriptor
+    
+    if len(msg.Payload) > 0 {
+        var err error
+        
+        if d, err = DescriptorParse(string(msg.Payload)); err != nil {
+            log.Println("onDescriptor(): err = ", err)
+            return
+        }
+    }
+    
+    m.registry.mu.Lock()
+    
+    if d == nil {
+        delete(m.registry.descriptors, msg.Topic)
+    } else {
+        m.registry.descriptors[msg.Topic] = d
+    }
+    
+    m.registry.mu.Unlock()
+    
+    if m.OnDescriptor != nil {
+        m.OnDescriptor(m, t, d)
+    }
+}
+
+// Descriptor returns the descriptor of nodename/platformID, or nil if it has
+// not been seen. WatchDescriptors() must have been called
+//
+func (m *MqttFabric) Descriptor(nodename string, platformID string) *Descriptor {
+    m.registry.mu.Lock()
+    defer m.registry.mu.Unlock()
+    
+    for _, d := range m.registry.descriptors {
+        if d.NodeName == nodename && d.PlatformID == platformID {
+            return d
+        }
+    }
+    
+    return nil
+}
+
+// Descriptors returns all descriptors seen
+//
+func (m *MqttFabric) Descriptors() []*Descriptor {
+    m.registry.mu.Lock()
+    defer m.registry.mu.Unlock()
+    
+    list := make([]*Descriptor, 0, len(m.registry.descriptors))
+    
+    for _, d := range m.registry.descriptors {
+        list = append(list, d)
+    }
+    
+    return list
+}
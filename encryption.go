@@ -0,0 +1,410 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "log"
+    "sync"
+    "errors"
+    "io/ioutil"
+    "crypto/aes"
+    "crypto/rand"
+    "crypto/cipher"
+    "encoding/json"
+    "encoding/base64"
+)
+
+const (
+    ENCRYPTION_AES256_GCM   = "A256GCM"
+)
+
+// encryptedValue replaces the value of an encrypted "d" envelope
+//
+type encryptedValue struct {
+    Algorithm       string      `json:"enc"`
+    KeyID           string      `json:"kid"`
+    Nonce           string      `json:"iv"`
+    Data            string      `json:"ct"`
+}
+
+// encryptionKey is a key and the scope it is used in: a root topic, the
+// onramp values of a node or the tasks between two nodes
+//
+type encryptionKey struct {
+    id              string
+    scope           string
+    aead            cipher.AEAD
+}
+
+func rootScope(rootTopic string) string {
+    return "root:" + rootTopic
+}
+
+func nodeScope(rootTopic string, nodename string) string {
+    return "node:" + rootTopic + "/" + nodename
+}
+
+func pairScope(rootTopic string, a string, b string) string {
+    if b < a {
+        a, b = b, a
+    }
+    
+    return "pair:" + rootTopic + "/" + a + "/" + b
+}
+
+// Encryption encrypts the value in the "d" envelope of onramp values and
+// offramp tasks with AES-256-GCM. Tasks use the key of the actor and target
+// pair, values the key of their node, and both fall back to the key of the
+// root topic.
+//
+// The first key added for a scope is used for encrypting, later ones only for
+// decrypting until Use() is called. A key is rotated by adding the new key
+// everywhere, calling Use() on the nodes publishing and then RemoveKey()
+//
+type Encryption struct {
+    Required        bool        // drop messages that are not encrypted
+    
+    mu              sync.RWMutex
+    keys            map[string]*encryptionKey   // by id
+    current         map[string]*encryptionKey   // by scope
+}
+
+// NewEncryption ...
+//
+func NewEncryption() *Encryption {
+    return &Encryption{
+        keys:       make(map[string]*encryptionKey),
+        current:    make(map[string]*encryptionKey),
+    }
+}
+
+func (e *Encryption) add(scope string, keyID string, key []byte) error {
+    if len(key) != 32 {
+        return errors.New("Encryption: key must be 32 bytes")
+    }
+    if keyID == "" {
+        return errors.New("Encryption: empty key id")
+    }
+    
+    block, err := aes.NewCipher(key)
+    
+    if err != nil {
+        return err
+    }
+    
+    aead, err := cipher.NewGCM(block)
+    
+    if err != nil {
+        return err
+    }
+    
+    k := &encryptionKey{id: keyID, scope: scope, aead: aead}
+    
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    
+    if old, ok := e.keys[keyID]; ok && old.scope != scope {
+        return errors.New("Encryption: key id '" + keyID + "' is used by another scope")
+    }
+    
+    e.keys[keyID] = k
+    
+    if _, ok := e.current[scope]; !ok {
+        e.current[scope] = k
+    }
+    
+    return nil
+}
+
+// Use makes keyID the key used for encrypting in its scope
+//
+func (e *Encryption) Use(keyID string) error {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    
+    k, ok := e.keys[keyID]
+    
+    if !ok {
+        return errors.New("Use: unknown key '" + keyID + "'")
+    }
+    
+    e.current[k.scope] = k
+    
+    return nil
+}
+
+// SetRootKey adds a key for everything under rootTopic
+//
+func (e *Encryption) SetRootKey(rootTopic string, keyID string, key []byte) error {
+    return e.add(rootScope(rootTopic), keyID, key)
+}
+
+// SetNodeKey adds a key for the onramp values of nodename
+//
+func (e *Encryption) SetNodeKey(rootTopic string, nodename string, keyID string, key []byte) error {
+    return e.add(nodeScope(rootTopic, nodename), keyID, key)
+}
+
+// SetPairKey adds a key for the tasks between nodeA and nodeB
+//
+func (e *Encryption) SetPairKey(rootTopic string, nodeA string, nodeB string, keyID string, key []byte) error {
+    return e.add(pairScope(rootTopic, nodeA, nodeB), keyID, key)
+}
+
+// RemoveKey removes a key after rotation. Messages encrypted with it can no
+// longer be decrypted. Removing the key used for encrypting leaves the scope
+// without one until Use() is called
+//
+func (e *Encryption) RemoveKey(keyID string) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    
+    k, ok := e.keys[keyID]
+    
+    if !ok {
+        return
+    }
+    
+    delete(e.keys, keyID)
+    
+    if e.current[k.scope] == k {
+        delete(e.current, k.scope)
+    }
+}
+
+// scopes returns the scopes of a topic, the most specific first
+//
+func scopes(t *FabricTopic) []string {
+    switch t.Kind {
+        case TOPIC_ONRAMP:
+            return []string{nodeScope(t.RootTopic, t.NodeName), rootScope(t.RootTopic)}
+        case TOPIC_OFFRAMP:
+            return []string{pairScope(t.RootTopic, t.ActorID, t.NodeName), rootScope(t.RootTopic)}
+    }
+    
+    return nil
+}
+
+func (e *Encryption) keyFor(t *FabricTopic) *encryptionKey {
+    e.mu.RLock()
+    defer e.mu.RUnlock()
+    
+    for _, scope := range scopes(t) {
+        if k, ok := e.current[scope]; ok {
+            return k
+        }
+    }
+    
+    return nil
+}
+
+// Encrypt returns the encrypted value, or value itself when there is no key
+// for the topic
+//
+func (e *Encryption) Encrypt(t *FabricTopic, topic string, value interface{}) (interface{}, error) {
+    k := e.keyFor(t)
+    
+    if k == nil {
+        if e.Required {
+            return nil, errors.New("encrypt: no key for " + topic)
+        }
+        return value, nil
+    }
+    
+    plain, err := json.Marshal(value)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    nonce := make([]byte, k.aead.NonceSize())
+    
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, err
+    }
+    
+    return &encryptedValue{
+        Algorithm:  ENCRYPTION_AES256_GCM,
+        KeyID:      k.id,
+        Nonce:      base64.StdEncoding.EncodeToString(nonce),
+        Data:       base64.StdEncoding.EncodeToString(k.aead.Seal(nil, nonce, plain, []byte(topic + "\n" + k.id))),
+    }, nil
+}
+
+// Decrypt returns payload with the value decrypted. The key must belong to
+// one of the scopes of the topic
+//
+func (e *Encryption) Decrypt(t *FabricTopic, topic string, payload []byte) ([]byte, error) {
+    var envelope map[string]map[string]json.RawMessage
+    
+    if err := json.Unmarshal(payload, &envelope); err != nil || envelope["d"] == nil {
+        if e.Required {
+            return nil, errors.New("decrypt: cannot parse envelope")
+        }
+        return payload, nil
+    }
+    
+    d := envelope["d"]
+    
+    var v encryptedValue
+    
+    if err := json.Unmarshal(d["value"], &v); err != nil || v.Algorithm == "" {
+        if e.Required {
+            return nil, errors.New("decrypt: value is not encrypted")
+        }
+        return payload, nil
+    }
+    
+    if v.Algorithm != ENCRYPTION_AES256_GCM {
+        return nil, errors.New("decrypt: unknown algorithm '" + v.Algorithm + "'")
+    }
+    
+    e.mu.RLock()
+    k := e.keys[v.KeyID]
+    e.mu.RUnlock()
+    
+    if k == nil {
+        return nil, errors.New("decrypt: unknown key '" + v.KeyID + "'")
+    }
+    
+    allowed := false
+    
+    for _, scope := range scopes(t) {
+        if k.scope == scope {
+            allowed = true
+        }
+    }
+    
+    if !allowed {
+        return nil, errors.New("decrypt: key '" + v.KeyID + "' does not belong to the topic")
+    }
+    
+    nonce, err := base64.StdEncoding.DecodeString(v.Nonce)
+    
+    if err != nil || len(nonce) != k.aead.NonceSize() {
+        return nil, errors.New("decrypt: bad nonce")
+    }
+    
+    data, err := base64.StdEncoding.DecodeString(v.Data)
+    
+    if err != nil {
+        return nil, errors.New("decrypt: bad ciphertext")
+    }
+    
+    plain, err := k.aead.Open(nil, nonce, data, []byte(topic + "\n" + k.id))
+    
+    if err != nil {
+        return nil, errors.New("decrypt: authentication failed")
+    }
+    
+    d["value"] = json.RawMessage(plain)
+    
+    return json.Marshal(envelope)
+}
+
+// SetEncryption enables encryption, nil disables it
+//
+func (m *MqttFabric) SetEncryption(e *Encryption) *MqttFabric {
+    m.Encryption = e
+    return m
+}
+
+// decrypt returns msg with the value decrypted, or nil if it must be dropped
+//
+func (m *MqttFabric) decrypt(t *FabricTopic, msg *Message) *Message {
+    payload, err := m.Encryption.Decrypt(t, msg.Topic, msg.Payload)
+    
+    if err != nil {
+        log.Println("decrypt(): ", msg.Topic, ": err = ", err)
+        m.metrics.reject()
+        return nil
+    }
+    
+    c        := *msg
+    c.Payload = payload
+    
+    return &c
+}
+
+// EncryptionKeyConfig is a key in an encryption key file. Exactly one of Node
+// and Nodes may be set, neither means the key of the root topic
+//
+type EncryptionKeyConfig struct {
+    KeyID           string      `json:"kid"`
+    RootTopic       string      `json:"root"`
+    Node            string      `json:"node,omitempty"`
+    Nodes           []string    `json:"nodes,omitempty"`       // a pair
+    Key             string      `json:"key"`                   // base64, 32 bytes
+    Use             bool        `json:"use,omitempty"`         // encrypt with it instead of the first key of the scope
+}
+
+// LoadEncryption reads a JSON list of EncryptionKeyConfig
+//
+func LoadEncryption(path string) (*Encryption, error) {
+    data, err := ioutil.ReadFile(path)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    var keys []EncryptionKeyConfig
+    
+    if err := json.Unmarshal(data, &keys); err != nil {
+        return nil, errors.New("LoadEncryption: " + path + ": " + err.Error())
+    }
+    
+    e := NewEncryption()
+    
+    for _, kc := range keys {
+        key, err := base64.StdEncoding.DecodeString(kc.Key)
+        
+        if err != nil {
+            return nil, errors.New("LoadEncryption: " + kc.KeyID + ": " + err.Error())
+        }
+        
+        switch {
+            case kc.Node != "" && len(kc.Nodes) == 0:
+                err = e.SetNodeKey(kc.RootTopic, kc.Node, kc.KeyID, key)
+            case kc.Node == "" && len(kc.Nodes) == 2:
+                err = e.SetPairKey(kc.RootTopic, kc.Nodes[0], kc.Nodes[1], kc.KeyID, key)
+            case kc.Node == "" && len(kc.Nodes) == 0:
+                err = e.SetRootKey(kc.RootTopic, kc.KeyID, key)
+            default:
+                err = errors.New("node or a pair of nodes expected")
+        }
+        
+        if err == nil && kc.Use {
+            err = e.Use(kc.KeyID)
+        }
+        
+        if err != nil {
+            return nil, errors.New("LoadEncryption: " + kc.KeyID + ": " + err.Error())
+        }
+    }
+    
+    return e, nil
+}
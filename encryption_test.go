@@ -0,0 +1,117 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestRecordReaderDecrypts(t *testing.T) {
+    e := NewEncryption()
+    e.SetNodeKey("fabric", "dev1", "dev1-1", bytes.Repeat([]byte{1}, 32))
+    
+    topic := FabricInitialize("fabric", "dev1", "esp", DEVICE).DeviceOnrampTopic(SERVICE_ID_ANALOG_IN, "temp")
+    ft, _ := ParseTopic("fabric", topic)
+    
+    value, err := e.Encrypt(ft, topic, 21.5)
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    payload, _ := BlueMixEncode(SERVICE_ID_ANALOG_IN, "temp", value)
+    
+    var buf bytes.Buffer
+    
+    NewRecorder(&buf).Write(&Message{Topic: topic, Payload: payload})
+    recorded := buf.String()
+    
+    // the recording keeps the ciphertext
+    if !strings.Contains(recorded, `\"ct\"`) {
+        t.Fatalf("recorded %s", recorded)
+    }
+    
+    r, err := NewRecordReader(strings.NewReader(recorded)).SetDecryption(e, []string{"fabric"}).Next()
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(r.Payload, `"value":21.5`) {
+        t.Errorf("decrypted %s", r.Payload)
+    }
+    
+    // without the key the record is returned as it is
+    r, _ = NewRecordReader(strings.NewReader(recorded)).SetDecryption(NewEncryption(), []string{"fabric"}).Next()
+    
+    if !strings.Contains(r.Payload, `"ct"`) {
+        t.Errorf("got %s", r.Payload)
+    }
+}
+
+func TestOnMessageDecryptsVerifiedTasks(t *testing.T) {
+    p := newSecuredPair(t)
+    
+    if err := p.ctrl.CtrlDigitalWrite("dev1", "esp", "relay1", true); err != nil {
+        t.Fatal(err)
+    }
+    
+    // the signature covers the ciphertext, so it is verified before decryption
+    if s := p.next(t); !strings.HasPrefix(s, "relay1 ") || !strings.Contains(s, `"value":true`) || strings.Contains(s, `"ct"`) {
+        t.Errorf("handler got %s", s)
+    }
+    
+    if mt := p.device.Metrics(); mt.Rejected != 0 || mt.Denied != 0 {
+        t.Errorf("rejected = %d, denied = %d", mt.Rejected, mt.Denied)
+    }
+}
+
+func TestSubscribeHandlerDecryptsOwnValues(t *testing.T) {
+    p := newSecuredPair(t)
+    p.device.Encryption.SetNodeKey("fabric", "dev1", "dev1-1", bytes.Repeat([]byte{3}, 32))
+    
+    own := make(chan string, 1)
+    
+    p.device.SubscribeHandler(p.device.F.DeviceOnrampTopic(SERVICE_ID_DIGITAL_OUT, "relay1"), 1, func(m *MqttFabric, msg *Message) {
+        own <- string(msg.Payload)
+    })
+    
+    if err := p.device.DevicePub(SERVICE_ID_DIGITAL_OUT, "relay1", true); err != nil {
+        t.Fatal(err)
+    }
+    
+    select {
+        case s := <-own:
+            if !strings.Contains(s, `"value":true`) || strings.Contains(s, `"ct"`) {
+                t.Errorf("subscription got %s", s)
+            }
+        case <-time.After(time.Second):
+            t.Fatal("subscription got nothing")
+    }
+}
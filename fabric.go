@@ -28,6 +28,8 @@ package mqttfabric
 
 import (
     "log"
+    "time"
+    "errors"
     "encoding/json"
 )
 
@@ -124,12 +126,13 @@ func FabricInitialize(rootTopic string, nodename string, platformID string, clas
 // StatusMessage ...
 //
 func (f *Fabric) StatusMessage(fabricStatus Status, seconds int64) (string, string) {
-    var topic = f.RootTopic + "/" + f.NodeName + "/$commands/$clients/" + FABRIC_SYS + "/" + f.PlatformID + "/" + FABRIC_CMD_STATUS
+    var topic = f.StatusSubscription(f.NodeName, f.PlatformID)
     
     type Data struct {
         Type        string `json:"_type"`
         Status      string `json:"status"`
         Uptime     *int64  `json:"uptime"`
+        Time       *int64  `json:"time,omitempty"`
         Nodename    string `json:"nodename"`
         PlatformID  string `json:"platform_id"`
         Class       string `json:"class"`
@@ -158,14 +161,19 @@ func (f *Fabric) StatusMessage(fabricStatus Status, seconds int64) (string, stri
             return "", ""
     }
     
+    // the time the uptime was taken, the LWT is created long before it is sent
+    now := time.Now().Unix()
+    
     switch fabricStatus {
         case FABRIC_ONLINE:
             jsonMsg.Data.Status = "online"
             jsonMsg.Data.Uptime = &seconds
+            jsonMsg.Data.Time   = &now
             
         case FABRIC_OFFLINE:
             jsonMsg.Data.Status = "offline"
             jsonMsg.Data.Uptime = &seconds
+            jsonMsg.Data.Time   = &now
             
         case FABRIC_DISCONNECTED:
             jsonMsg.Data.Status = "disconnected"
@@ -185,6 +193,110 @@ func (f *Fabric) StatusMessage(fabricStatus Status, seconds int64) (string, stri
     return topic, string(msg)
 }
 
+// StatusSubscription returns the status topic of nodename/platformID, both
+// may be FABRIC_TOPIC_ANY
+//
+func (f *Fabric) StatusSubscription(nodename string, platformID string) (string) {
+    return f.RootTopic + "/" + nodename + "/$commands/$clients/" + FABRIC_SYS + "/" + platformID + "/" + FABRIC_CMD_STATUS
+}
+
+// StatusObject is a parsed status message
+//
+type StatusObject struct {
+    Status          Status
+    Uptime          int64           // seconds, not set when disconnected
+    Time            time.Time       // when Uptime was taken, zero if unknown
+    NodeName        string
+    PlatformID      string
+    ClassType       ClassType
+}
+
+// StatusParse parses a message created by StatusMessage()
+//
+func StatusParse(msg string) (*StatusObject, error) {
+    type Data struct {
+        Type        string `json:"_type"`
+        Status      string `json:"status"`
+        Uptime     *int64  `json:"uptime"`
+        Time       *int64  `json:"time"`
+        Nodename    string `json:"nodename"`
+        PlatformID  string `json:"platform_id"`
+        Class       string `json:"class"`
+    }
+    
+    type D struct {
+        Data *Data `json:"d"`
+    }
+    
+    var jsonMsg D
+    
+    if err := json.Unmarshal([]byte(msg), &jsonMsg); err != nil {
+        return nil, errors.New("StatusParse: cannot parse JSON object")
+    }
+    if jsonMsg.Data == nil || jsonMsg.Data.Type != "status" {
+        return nil, errors.New("StatusParse: not a status message")
+    }
+    
+    s := &StatusObject{NodeName: jsonMsg.Data.Nodename, PlatformID: jsonMsg.Data.PlatformID}
+    
+    switch jsonMsg.Data.Status {
+        case "online":
+            s.Status = FABRIC_ONLINE
+        case "offline":
+            s.Status = FABRIC_OFFLINE
+        case "disconnected":
+            s.Status = FABRIC_DISCONNECTED
+        default:
+            return nil, errors.New("StatusParse: unknown status '" + jsonMsg.Data.Status + "'")
+    }
+    
+    switch jsonMsg.Data.Class {
+        case "device":
+            s.ClassType = DEVICE
+        case "controller":
+            s.ClassType = CONTROLLER
+        default:
+            return nil, errors.New("StatusParse: unknown class '" + jsonMsg.Data.Class + "'")
+    }
+    
+    if jsonMsg.Data.Uptime != nil {
+        s.Uptime = *jsonMsg.Data.Uptime
+    }
+    if jsonMsg.Data.Time != nil {
+        s.Time = time.Unix(*jsonMsg.Data.Time, 0)
+    }
+    
+    return s, nil
+}
+
+// String ...
+//
+func (s Status) String() (string) {
+    switch s {
+        case FABRIC_ONLINE:
+            return "online"
+        case FABRIC_OFFLINE:
+            return "offline"
+        case FABRIC_DISCONNECTED:
+            return "disconnected"
+    }
+    
+    return "unknown"
+}
+
+// String ...
+//
+func (c ClassType) String() (string) {
+    switch c {
+        case DEVICE:
+            return "device"
+        case CONTROLLER:
+            return "controller"
+    }
+    
+    return "unknown"
+}
+
 // DeviceOnrampTopic ...
 //
 func (f *Fabric) DeviceOnrampTopic(serviceID string, feedID string) (string) {
@@ -0,0 +1,315 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "sync"
+    "time"
+)
+
+// FeedKey identifies an onramp feed
+//
+type FeedKey struct {
+    RootTopic       string      `json:"root"`
+    NodeName        string      `json:"nodename"`
+    PlatformID      string      `json:"platform_id"`
+    ServiceID       string      `json:"service_id"`
+    FeedID          string      `json:"feed_id"`
+}
+
+// FeedValue is the last value of a feed
+//
+type FeedValue struct {
+    FeedKey
+    
+    Type            string      `json:"type"`
+    Value           interface{} `json:"value"`
+    Time            time.Time   `json:"time"`       // when it was published, zero if unknown
+    Topic           string      `json:"topic"`
+    Retained        bool        `json:"retained"`   // the value came from a retained message
+    Stale           bool        `json:"stale"`      // not updated for MaxAge
+}
+
+// FeedFilter selects feeds, empty fields and FABRIC_TOPIC_ANY match anything
+//
+type FeedFilter FeedKey
+
+func matchFilter(filter string, value string) bool {
+    return filter == "" || filter == FABRIC_TOPIC_ANY || filter == value
+}
+
+// Match ...
+//
+func (f FeedFilter) Match(k FeedKey) bool {
+    return matchFilter(f.RootTopic, k.RootTopic) && matchFilter(f.NodeName, k.NodeName) && matchFilter(f.PlatformID, k.PlatformID) &&
+           matchFilter(f.ServiceID, k.ServiceID) && matchFilter(f.FeedID, k.FeedID)
+}
+
+type feedWatcher struct {
+    filter          FeedFilter
+    ch              chan FeedValue
+}
+
+// FeedCache keeps the last value of every onramp feed. Attach it to a
+// MqttFabric, the retained values are delivered when it subscribes
+//
+type FeedCache struct {
+    MaxAge          time.Duration   // values not updated for MaxAge are stale, 0 disables it
+    
+    mu              sync.Mutex
+    fabric          *MqttFabric
+    values          map[FeedKey]*FeedValue
+    watchers        map[*feedWatcher]bool
+    stop            chan struct{}
+}
+
+// NewFeedCache ...
+//
+func NewFeedCache() *FeedCache {
+    return &FeedCache{
+        values:     make(map[FeedKey]*FeedValue),
+        watchers:   make(map[*feedWatcher]bool),
+    }
+}
+
+// Attach subscribes to the onramp traffic of all roots of m. Call it before
+// m.Start() or after the roots have been added. Attaching again does nothing
+//
+func (c *FeedCache) Attach(m *MqttFabric) error {
+    c.mu.Lock()
+    
+    if c.fabric != nil {
+        c.mu.Unlock()
+        return nil
+    }
+    
+    c.fabric = m
+    
+    if c.MaxAge > 0 {
+        c.stop = make(chan struct{})
+        go c.checkStale(c.stop)
+    }
+    
+    c.mu.Unlock()
+    
+    for _, f := range m.Roots {
+        if err := m.SubscribeHandler(f.CtrlOnrampSubscription(FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY), 0, c.onOnramp); err != nil {
+            return err
+        }
+    }
+    
+    return nil
+}
+
+// Close stops the staleness check and closes all watch channels
+//
+func (c *FeedCache) Close() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    if c.stop != nil {
+        close(c.stop)
+        c.stop = nil
+    }
+    
+    for w := range c.watchers {
+        close(w.ch)
+    }
+    
+    c.watchers = make(map[*feedWatcher]bool)
+}
+
+func (c *FeedCache) onOnramp(m *MqttFabric, msg *Message) {
+    t, err := m.ParseTopic(msg.Topic)
+    
+    if err != nil || t.Kind != TOPIC_ONRAMP {
+        return
+    }
+    
+    o, err := BlueMixParse(string(msg.Payload))
+    
+    if err != nil {
+        return
+    }
+    
+    c.Update(&FeedValue{
+        FeedKey:    FeedKey{RootTopic: t.RootTopic, NodeName: t.NodeName, PlatformID: t.PlatformID, ServiceID: t.ServiceID, FeedID: t.FeedID},
+        Type:       o.Type,
+        Value:      o.T,
+        Time:       valueTime(o, msg),
+        Topic:      msg.Topic,
+        Retained:   msg.Retained,
+    })
+}
+
+// valueTime returns when a value was published: the timestamp of the envelope
+// if it has one, otherwise now unless the value is retained. A retained value
+// may be days old, so its time is zero, which means the age is unknown
+//
+func valueTime(o *BlueMixObject, msg *Message) time.Time {
+    if !o.Time.IsZero() {
+        return o.Time
+    }
+    if msg.Retained {
+        return time.Time{}
+    }
+    
+    return time.Now()
+}
+
+// Update stores v and passes it on to the watchers. It is called for the
+// traffic after Attach() but can be used to seed the cache too
+//
+func (c *FeedCache) Update(v *FeedValue) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    stored := *v
+    stored.Stale = c.stale(&stored)
+    
+    c.values[v.FeedKey] = &stored
+    
+    c.notify(stored)
+}
+
+// notify sends v to the watchers matching it, c.mu must be held. Slow watchers
+// lose values rather than block the fabric
+//
+func (c *FeedCache) notify(v FeedValue) {
+    for w := range c.watchers {
+        if w.filter.Match(v.FeedKey) {
+            select {
+                case w.ch <- v:
+                default:
+            }
+        }
+    }
+}
+
+// Get returns the last value of a feed
+//
+func (c *FeedCache) Get(k FeedKey) (FeedValue, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    v, ok := c.values[k]
+    
+    if !ok {
+        return FeedValue{}, false
+    }
+    
+    return c.copy(v), true
+}
+
+// copy returns v with Stale set, c.mu must be held
+//
+func (c *FeedCache) copy(v *FeedValue) FeedValue {
+    r := *v
+    r.Stale = c.stale(v)
+    
+    return r
+}
+
+// stale tells if v has not been updated for MaxAge, values of unknown age
+// are stale as well
+//
+func (c *FeedCache) stale(v *FeedValue) bool {
+    return c.MaxAge > 0 && (v.Time.IsZero() || time.Since(v.Time) > c.MaxAge)
+}
+
+// Snapshot returns the last values of the feeds matching filter
+//
+func (c *FeedCache) Snapshot(filter FeedFilter) []FeedValue {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    var list []FeedValue
+    
+    for k, v := range c.values {
+        if filter.Match(k) {
+            list = append(list, c.copy(v))
+        }
+    }
+    
+    return list
+}
+
+// Watch returns a channel receiving the new values of the feeds matching
+// filter, and values turning stale with Stale set. Values are dropped when
+// more than buffer are waiting. cancel stops the watch and closes the channel
+//
+func (c *FeedCache) Watch(filter FeedFilter, buffer int) (ch <-chan FeedValue, cancel func()) {
+    w := &feedWatcher{filter: filter, ch: make(chan FeedValue, buffer)}
+    
+    c.mu.Lock()
+    c.watchers[w] = true
+    c.mu.Unlock()
+    
+    var once sync.Once
+    
+    return w.ch, func() {
+        once.Do(func() {
+            c.mu.Lock()
+            defer c.mu.Unlock()
+            
+            if c.watchers[w] {
+                delete(c.watchers, w)
+                close(w.ch)
+            }
+        })
+    }
+}
+
+func (c *FeedCache) checkStale(stop chan struct{}) {
+    interval := c.MaxAge / 4
+    
+    if interval < time.Second {
+        interval = time.Second
+    }
+    
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    
+    for {
+        select {
+            case <-stop:
+                return
+            case <-ticker.C:
+        }
+        
+        c.mu.Lock()
+        
+        for _, v := range c.values {
+            if !v.Stale && c.stale(v) {
+                v.Stale = true
+                c.notify(*v)
+            }
+        }
+        
+        c.mu.Unlock()
+    }
+}
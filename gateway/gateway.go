@@ -0,0 +1,428 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+// Package gateway serves the fabric over HTTP
+//
+//   GET  /nodes                                          status of all nodes
+//   GET  /nodes/{node}/feeds                             last values of a node
+//   GET  /nodes/{node}/feeds/{service}/{feed}            last value of a feed
+//   POST /nodes/{node}/feeds/{service}/{feed}/tasks/{task} send an offramp task
+//   GET  /events                                         onramp updates as Server-Sent Events
+//   GET  /ws                                             WebSocket, see WSMessage
+//
+// The ?root= and ?platform= query parameters select the root topic and the
+// platform id when a nodename is used in several of them. The body of a task
+// is {"value": ...}, optionally with "platform_id". /events takes ?root=,
+// ?node=, ?platform=, ?service= and ?feed= filters
+//
+package gateway
+
+import (
+    "log"
+    "sort"
+    "sync"
+    "time"
+    "errors"
+    "strings"
+    "net/http"
+    "encoding/json"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// Node is the last status of a node/platform
+//
+type Node struct {
+    Root            string      `json:"root"`
+    NodeName        string      `json:"nodename"`
+    PlatformID      string      `json:"platform_id"`
+    Class           string      `json:"class"`
+    Status          string      `json:"status"`
+    Uptime          int64       `json:"uptime"`
+    Time            time.Time   `json:"time"`
+}
+
+// Task is the body of a task request
+//
+type Task struct {
+    PlatformID      string      `json:"platform_id"`
+    Value           interface{} `json:"value"`
+}
+
+// Gateway is an http.Handler on top of a MqttFabric
+//
+type Gateway struct {
+    Fabric          *mqttfabric.MqttFabric
+    Cache           *mqttfabric.FeedCache   // the last values, may be shared with others
+    StreamBuffer    int             // updates buffered per event stream or WebSocket, default 64
+    CheckOrigin     func(r *http.Request) bool  // WebSocket origin check, nil allows the same host only
+    
+    mu              sync.Mutex
+    nodes           map[string]*Node    // status topic to node
+}
+
+// NewGateway creates a gateway on m, which should be a CONTROLLER. Call Start()
+// before m.Start()
+//
+func NewGateway(m *mqttfabric.MqttFabric) *Gateway {
+    return &Gateway{
+        Fabric:         m,
+        Cache:          mqttfabric.NewFeedCache(),
+        StreamBuffer:   64,
+        nodes:          make(map[string]*Node),
+    }
+}
+
+// Start subscribes to the status messages and attaches the cache
+//
+func (g *Gateway) Start() error {
+    any := mqttfabric.FABRIC_TOPIC_ANY
+    
+    for _, f := range g.Fabric.Roots {
+        if err := g.Fabric.SubscribeHandler(f.StatusSubscription(any, any), 1, g.onStatus); err != nil {
+            return err
+        }
+    }
+    
+    return g.Cache.Attach(g.Fabric)
+}
+
+func (g *Gateway) onStatus(m *mqttfabric.MqttFabric, msg *mqttfabric.Message) {
+    t, err := m.ParseTopic(msg.Topic)
+    
+    if err != nil {
+        return
+    }
+    
+    s, err := mqttfabric.StatusParse(string(msg.Payload))
+    
+    if err != nil {
+        return
+    }
+    
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    
+    g.nodes[msg.Topic] = &Node{
+        Root:       t.RootTopic,
+        NodeName:   s.NodeName,
+        PlatformID: s.PlatformID,
+        Class:      s.ClassType.String(),
+        Status:     s.Status.String(),
+        Uptime:     s.Uptime,
+        Time:       time.Now(),
+    }
+}
+
+// ServeHTTP ...
+//
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+    
+    switch {
+        case len(path) == 1 && path[0] == "nodes":
+            if allow(w, r, http.MethodGet) {
+                g.getNodes(w, r)
+            }
+            
+        case len(path) == 1 && path[0] == "events":
+            if allow(w, r, http.MethodGet) {
+                g.getEvents(w, r)
+            }
+            
+        case len(path) == 1 && path[0] == "ws":
+            if allow(w, r, http.MethodGet) {
+                g.serveWebSocket(w, r)
+            }
+            
+        case len(path) == 3 && path[0] == "nodes" && path[2] == "feeds":
+            if allow(w, r, http.MethodGet) {
+                g.getFeeds(w, r, path[1])
+            }
+            
+        case len(path) == 5 && path[0] == "nodes" && path[2] == "feeds":
+            if allow(w, r, http.MethodGet) {
+                g.getFeed(w, r, path[1], path[3], path[4])
+            }
+            
+        case len(path) == 7 && path[0] == "nodes" && path[2] == "feeds" && path[5] == "tasks":
+            if allow(w, r, http.MethodPost) {
+                g.postTask(w, r, path[1], path[3], path[4], path[6])
+            }
+            
+        default:
+            writeError(w, http.StatusNotFound, errors.New("not found"))
+    }
+}
+
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+    if r.Method == method {
+        return true
+    }
+    
+    w.Header().Set("Allow", method)
+    writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+    
+    return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    
+    if err := json.NewEncoder(w).Encode(v); err != nil {
+        log.Println("gateway: writeJSON(): err = ", err)
+    }
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+    writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func (g *Gateway) getNodes(w http.ResponseWriter, r *http.Request) {
+    root := r.URL.Query().Get("root")
+    
+    g.mu.Lock()
+    
+    list := make([]*Node, 0, len(g.nodes))
+    
+    for _, n := range g.nodes {
+        if root == "" || root == n.Root {
+            list = append(list, n)
+        }
+    }
+    
+    g.mu.Unlock()
+    
+    sort.Slice(list, func(i, j int) bool {
+        if list[i].Root != list[j].Root {
+            return list[i].Root < list[j].Root
+        }
+        if list[i].NodeName != list[j].NodeName {
+            return list[i].NodeName < list[j].NodeName
+        }
+        
+        return list[i].PlatformID < list[j].PlatformID
+    })
+    
+    writeJSON(w, http.StatusOK, list)
+}
+
+// find returns the feeds of nodename in root and platform, if they are not
+// empty, and with serviceID/feedID if they are not empty
+//
+func (g *Gateway) find(root string, nodename string, platform string, serviceID string, feedID string) []mqttfabric.FeedValue {
+    list := g.Cache.Snapshot(mqttfabric.FeedFilter{RootTopic: root, NodeName: nodename, PlatformID: platform, ServiceID: serviceID, FeedID: feedID})
+    
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].Topic < list[j].Topic
+    })
+    
+    return list
+}
+
+// task sends an offramp task. An empty root or platform is taken from the last
+// value of the feed. The topic is returned
+//
+func (g *Gateway) task(root string, nodename string, platform string, serviceID string, feedID string, taskID string, value interface{}) (string, error) {
+    if err := checkTask(root, nodename, platform, serviceID, feedID, taskID); err != nil {
+        return "", err
+    }
+    
+    if root == "" || platform == "" {
+        list := g.find(root, nodename, platform, serviceID, feedID)
+        
+        if len(list) != 1 {
+            return "", errUnknownFeed
+        }
+        
+        if root == "" {
+            root = list[0].RootTopic
+        }
+        if platform == "" {
+            platform = list[0].PlatformID
+        }
+    }
+    
+    // JSON numbers are float64, the analog tasks take integers
+    if v, ok := value.(float64); ok && v == float64(int(v)) {
+        value = int(v)
+    }
+    
+    if err := g.Fabric.CtrlTaskRoot(root, nodename, taskID, platform, serviceID, feedID, value); err != nil {
+        return "", err
+    }
+    
+    return g.Fabric.Root(root).CtrlOfframpTopic(nodename, taskID, platform, serviceID, feedID), nil
+}
+
+var errUnknownFeed = errors.New("the root or platform of the feed is not known, give them explicitly")
+
+// taskError is a task with a topic level that can't be published to
+//
+type taskError string
+
+func (e taskError) Error() string {
+    return string(e)
+}
+
+// checkTask returns a taskError if a topic level of the task is empty or has
+// a wildcard. The root and platform may be empty
+//
+func checkTask(root string, nodename string, platform string, serviceID string, feedID string, taskID string) error {
+    levels := []struct {
+        name, value     string
+        optional        bool
+    }{
+        {"root",        root,       true},
+        {"nodename",    nodename,   false},
+        {"platform",    platform,   true},
+        {"service",     serviceID,  false},
+        {"feed",        feedID,     false},
+        {"task",        taskID,     false},
+    }
+    
+    for _, l := range levels {
+        if l.value == "" && !l.optional {
+            return taskError("the " + l.name + " of the task is empty")
+        }
+        if strings.ContainsAny(l.value, "+#") {
+            return taskError("the " + l.name + " of the task '" + l.value + "' contains a wildcard")
+        }
+    }
+    
+    return nil
+}
+
+func (g *Gateway) getFeeds(w http.ResponseWriter, r *http.Request, nodename string) {
+    q    := r.URL.Query()
+    list := g.find(q.Get("root"), nodename, q.Get("platform"), "", "")
+    
+    if list == nil {
+        list = []mqttfabric.FeedValue{}
+    }
+    
+    writeJSON(w, http.StatusOK, list)
+}
+
+func (g *Gateway) getFeed(w http.ResponseWriter, r *http.Request, nodename string, serviceID string, feedID string) {
+    q    := r.URL.Query()
+    list := g.find(q.Get("root"), nodename, q.Get("platform"), serviceID, feedID)
+    
+    switch len(list) {
+        case 0:
+            writeError(w, http.StatusNotFound, errors.New("no value seen for " + nodename + "/" + serviceID + "/" + feedID))
+        case 1:
+            writeJSON(w, http.StatusOK, list[0])
+        default:
+            writeError(w, http.StatusConflict, errors.New("feed is in several roots or platforms, use ?root= and ?platform="))
+    }
+}
+
+func (g *Gateway) postTask(w http.ResponseWriter, r *http.Request, nodename string, serviceID string, feedID string, taskID string) {
+    var task Task
+    
+    if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+        writeError(w, http.StatusBadRequest, errors.New("body is not a task: " + err.Error()))
+        return
+    }
+    
+    platform := task.PlatformID
+    
+    if platform == "" {
+        platform = r.URL.Query().Get("platform")
+    }
+    
+    topic, err := g.task(r.URL.Query().Get("root"), nodename, platform, serviceID, feedID, taskID, task.Value)
+    
+    if err == errUnknownFeed {
+        writeError(w, http.StatusBadRequest, errors.New("the root or platform of the feed is not known, use ?root= and ?platform="))
+        return
+    } else if _, ok := err.(taskError); ok {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    } else if err != nil {
+        writeError(w, http.StatusBadGateway, err)
+        return
+    }
+    
+    writeJSON(w, http.StatusAccepted, map[string]string{"topic": topic})
+}
+
+func (g *Gateway) getEvents(w http.ResponseWriter, r *http.Request) {
+    flusher, ok := w.(http.Flusher)
+    
+    if !ok {
+        writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+        return
+    }
+    
+    q := r.URL.Query()
+    
+    updates, cancel := g.Cache.Watch(mqttfabric.FeedFilter{
+        RootTopic:  q.Get("root"),
+        NodeName:   q.Get("node"),
+        PlatformID: q.Get("platform"),
+        ServiceID:  q.Get("service"),
+        FeedID:     q.Get("feed"),
+    }, g.StreamBuffer)
+    
+    defer cancel()
+    
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+    
+    keepalive := time.NewTicker(30 * time.Second)
+    defer keepalive.Stop()
+    
+    for {
+        select {
+            case <-r.Context().Done():
+                return
+                
+            case <-keepalive.C:
+                w.Write([]byte(": keepalive\n\n"))
+                
+            case f, ok := <-updates:
+                if !ok {
+                    return
+                }
+                
+                data, err := json.Marshal(f)
+                
+                if err != nil {
+                    continue
+                }
+                
+                w.Write([]byte("event: onramp\ndata: "))
+                w.Write(data)
+                w.Write([]byte("\n\n"))
+        }
+        
+        flusher.Flush()
+    }
+}
@@ -0,0 +1,114 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package gateway
+
+import (
+    "io/ioutil"
+    "log"
+    "os"
+    "strings"
+    "testing"
+    "time"
+    "net/http"
+    "net/http/httptest"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+func TestPostTaskRejectsBadLevels(t *testing.T) {
+    log.SetOutput(ioutil.Discard)
+    t.Cleanup(func() { log.SetOutput(os.Stderr) })
+    
+    broker := mqttfabric.NewMemoryBroker()
+    
+    // everything published ends up here
+    published := make(chan *mqttfabric.Message, 16)
+    
+    spy := broker.NewTransport()
+    spy.SetHandlers(func() {}, func(err error) {}, func(msg *mqttfabric.Message) { published <- msg })
+    spy.Connect()
+    spy.Subscribe("fabric/+/$feeds/#", 0)
+    
+    connected := make(chan bool, 1)
+    
+    ctrl := mqttfabric.MqttFabricInitializeTransport(broker.NewTransport(), "fabric", "ctl", "pc", mqttfabric.CONTROLLER)
+    ctrl.SetOnConnectHandler(func(m *mqttfabric.MqttFabric) { connected <- true })
+    g    := NewGateway(ctrl)
+    
+    if err := g.Start(); err != nil {
+        t.Fatal(err)
+    }
+    
+    ctrl.Start()
+    defer ctrl.Stop()
+    
+    select {
+        case <-connected:
+        case <-time.After(time.Second):
+            t.Fatal("not connected")
+    }
+    
+    post := func(path string) int {
+        w := httptest.NewRecorder()
+        g.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path + "?root=fabric&platform=esp", strings.NewReader(`{"value": true}`)))
+        
+        return w.Code
+    }
+    
+    for _, path := range []string{
+        "/nodes/+/feeds/digital_out/lamp/tasks/t1",
+        "/nodes/%23/feeds/digital_out/lamp/tasks/t1",
+        "/nodes/hall/feeds/+/lamp/tasks/t1",
+        "/nodes/hall/feeds/digital_out/la%23mp/tasks/t1",
+        "/nodes/hall/feeds/digital_out/lamp/tasks/+",
+        "/nodes//feeds/digital_out/lamp/tasks/t1",
+        "/nodes/hall/feeds//lamp/tasks/t1",
+        "/nodes/hall/feeds/digital_out//tasks/t1",
+    } {
+        if code := post(path); code != http.StatusBadRequest {
+            t.Errorf("POST %s = %d, want 400", path, code)
+        }
+    }
+    
+    select {
+        case msg := <-published:
+            t.Errorf("published %s", msg.Topic)
+        case <-time.After(50 * time.Millisecond):
+    }
+    
+    if code := post("/nodes/hall/feeds/digital_out/lamp/tasks/t1"); code != http.StatusAccepted {
+        t.Errorf("POST of a good task = %d, want 202", code)
+    }
+    
+    select {
+        case msg := <-published:
+            if !strings.HasPrefix(msg.Topic, "fabric/hall/") {
+                t.Errorf("published %s", msg.Topic)
+            }
+        case <-time.After(time.Second):
+            t.Error("the good task was not published")
+    }
+}
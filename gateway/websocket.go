@@ -0,0 +1,262 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package gateway
+
+import (
+    "log"
+    "sync"
+    "time"
+    "net/http"
+    "github.com/gorilla/websocket"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+const (
+    WS_SUBSCRIBE        = "subscribe"       // client: start sending updates matching the filter
+    WS_UNSUBSCRIBE      = "unsubscribe"     // client: stop the subscription with the id
+    WS_TASK             = "task"            // client: send an offramp task
+    WS_UPDATE           = "update"          // server: a feed value
+    WS_ACK              = "ack"             // server: the request with the id is done
+    WS_ERROR            = "error"           // server: the request with the id failed
+    WS_DROPPED          = "dropped"         // server: updates were dropped since the client was too slow
+)
+
+// WSMessage is sent both ways on the WebSocket. Subscriptions filter on root,
+// nodename, platform_id, service_id and feed_id, where empty or "+" matches anything.
+// The current values matching a new subscription are sent right away
+//
+//   {"op": "subscribe", "id": "1", "nodename": "kitchen", "service_id": "analog_in"}
+//   {"op": "task", "id": "2", "nodename": "kitchen", "service_id": "digital_out", "feed_id": "relay1", "task_id": "digital_write", "value": true}
+//   {"op": "update", "id": "1", "feed": {...}}
+//
+type WSMessage struct {
+    Op              string      `json:"op"`
+    ID              string      `json:"id,omitempty"`
+    
+    Root            string      `json:"root,omitempty"`
+    NodeName        string      `json:"nodename,omitempty"`
+    PlatformID      string      `json:"platform_id,omitempty"`
+    ServiceID       string      `json:"service_id,omitempty"`
+    FeedID          string      `json:"feed_id,omitempty"`
+    TaskID          string      `json:"task_id,omitempty"`
+    Value           interface{} `json:"value,omitempty"`
+    
+    Feed            *mqttfabric.FeedValue   `json:"feed,omitempty"`
+    Topic           string      `json:"topic,omitempty"`
+    Error           string      `json:"error,omitempty"`
+    Dropped         int         `json:"dropped,omitempty"`
+}
+
+// socket is one WebSocket connection
+//
+type socket struct {
+    conn            *websocket.Conn
+    send            chan *WSMessage
+    
+    mu              sync.Mutex
+    subscriptions   map[string]mqttfabric.FeedFilter
+    dropped         int
+}
+
+const (
+    wsWriteWait         = 10 * time.Second
+    wsPongWait          = 60 * time.Second
+    wsPingPeriod        = wsPongWait * 9 / 10
+    wsMaxMessage        = 64 * 1024
+    wsWatchBuffer       = 1024
+)
+
+// update queues v for every subscription matching it
+//
+func (s *socket) update(v mqttfabric.FeedValue) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    for id, f := range s.subscriptions {
+        if f.Match(v.FeedKey) {
+            s.queue(&WSMessage{Op: WS_UPDATE, ID: id, Feed: &v})
+        }
+    }
+}
+
+// queue sends msg unless the buffer is full, s.mu must be held
+//
+func (s *socket) queue(msg *WSMessage) {
+    if s.dropped > 0 {
+        select {
+            case s.send <- &WSMessage{Op: WS_DROPPED, Dropped: s.dropped}:
+                s.dropped = 0
+            default:
+                s.dropped++
+                return
+        }
+    }
+    
+    select {
+        case s.send <- msg:
+        default:
+            s.dropped++
+    }
+}
+
+func (s *socket) reply(msg *WSMessage) {
+    s.mu.Lock()
+    s.queue(msg)
+    s.mu.Unlock()
+}
+
+func (g *Gateway) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+    upgrader := websocket.Upgrader{CheckOrigin: g.CheckOrigin}
+    
+    conn, err := upgrader.Upgrade(w, r, nil)
+    
+    if err != nil {
+        // the upgrader has replied already
+        log.Println("gateway: serveWebSocket(): err = ", err)
+        return
+    }
+    
+    s := &socket{
+        conn:           conn,
+        send:           make(chan *WSMessage, g.StreamBuffer),
+        subscriptions:  make(map[string]mqttfabric.FeedFilter),
+    }
+    
+    // the subscriptions are matched by the socket, so one watch is enough. It
+    // is emptied right away, the backpressure is handled by s.send
+    updates, cancel := g.Cache.Watch(mqttfabric.FeedFilter{}, wsWatchBuffer)
+    
+    go func() {
+        for v := range updates {
+            s.update(v)
+        }
+    }()
+    
+    done := make(chan struct{})
+    
+    go s.writer(done)
+    
+    g.reader(s)
+    
+    cancel()
+    close(done)
+}
+
+func (s *socket) writer(done chan struct{}) {
+    ping := time.NewTicker(wsPingPeriod)
+    
+    defer func() {
+        ping.Stop()
+        s.conn.Close()
+    }()
+    
+    for {
+        select {
+            case <-done:
+                s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+                s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+                return
+                
+            case msg := <-s.send:
+                s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+                
+                if err := s.conn.WriteJSON(msg); err != nil {
+                    // the reader sees the connection close too
+                    s.conn.Close()
+                    return
+                }
+                
+            case <-ping.C:
+                s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+                
+                if err := s.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+                    s.conn.Close()
+                    return
+                }
+        }
+    }
+}
+
+func (g *Gateway) reader(s *socket) {
+    s.conn.SetReadLimit(wsMaxMessage)
+    s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+    s.conn.SetPongHandler(func(string) error {
+        return s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+    })
+    
+    for {
+        var msg WSMessage
+        
+        if err := s.conn.ReadJSON(&msg); err != nil {
+            if _, ok := err.(*websocket.CloseError); !ok {
+                log.Println("gateway: reader(): err = ", err)
+            }
+            return
+        }
+        
+        switch msg.Op {
+            case WS_SUBSCRIBE:
+                g.subscribe(s, &msg)
+                
+            case WS_UNSUBSCRIBE:
+                s.mu.Lock()
+                delete(s.subscriptions, msg.ID)
+                s.mu.Unlock()
+                
+                s.reply(&WSMessage{Op: WS_ACK, ID: msg.ID})
+                
+            case WS_TASK:
+                topic, err := g.task(msg.Root, msg.NodeName, msg.PlatformID, msg.ServiceID, msg.FeedID, msg.TaskID, msg.Value)
+                
+                if err != nil {
+                    s.reply(&WSMessage{Op: WS_ERROR, ID: msg.ID, Error: err.Error()})
+                } else {
+                    s.reply(&WSMessage{Op: WS_ACK, ID: msg.ID, Topic: topic})
+                }
+                
+            default:
+                s.reply(&WSMessage{Op: WS_ERROR, ID: msg.ID, Error: "unknown op '" + msg.Op + "'"})
+        }
+    }
+}
+
+// subscribe adds the subscription and sends the current values matching it.
+// An update arriving in between may be sent twice
+//
+func (g *Gateway) subscribe(s *socket, msg *WSMessage) {
+    f := mqttfabric.FeedFilter{RootTopic: msg.Root, NodeName: msg.NodeName, PlatformID: msg.PlatformID, ServiceID: msg.ServiceID, FeedID: msg.FeedID}
+    
+    s.mu.Lock()
+    s.subscriptions[msg.ID] = f
+    s.queue(&WSMessage{Op: WS_ACK, ID: msg.ID})
+    s.mu.Unlock()
+    
+    for _, v := range g.Cache.Snapshot(f) {
+        v := v
+        s.reply(&WSMessage{Op: WS_UPDATE, ID: msg.ID, Feed: &v})
+    }
+}
@@ -0,0 +1,58 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+//go:build unix
+
+package history
+
+import (
+    "os"
+    "syscall"
+    "path/filepath"
+)
+
+// lockDir takes the writer lock of the store in dir. The lock is released by
+// closing the file, or by the kernel when the process dies
+//
+func lockDir(dir string) (*os.File, error) {
+    f, err := os.OpenFile(filepath.Join(dir, lockName), os.O_CREATE | os.O_RDWR, 0644)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX | syscall.LOCK_NB); err != nil {
+        f.Close()
+        
+        if err == syscall.EWOULDBLOCK {
+            return nil, ErrLocked
+        }
+        
+        return nil, err
+    }
+    
+    return f, nil
+}
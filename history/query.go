@@ -0,0 +1,214 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package history
+
+import (
+    "os"
+    "sort"
+    "time"
+    "strings"
+    "path/filepath"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// Bucket is the summary of the numeric values of a feed in a time bucket
+//
+type Bucket struct {
+    mqttfabric.FeedKey
+    
+    Start           time.Time   `json:"start"`
+    Count           int         `json:"count"`
+    Min             float64     `json:"min"`
+    Max             float64     `json:"max"`
+    Avg             float64     `json:"avg"`
+}
+
+// Query returns the points of the feeds matching filter with from <= time < to,
+// ordered by time. A zero from or to is unbounded
+//
+func (s *Store) Query(filter mqttfabric.FeedFilter, from time.Time, to time.Time) ([]Point, error) {
+    var points []Point
+    
+    err := s.scan(from, to, func(p *Point) {
+        if filter.Match(p.FeedKey) {
+            points = append(points, *p)
+        }
+    })
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    sort.SliceStable(points, func(i, j int) bool {
+        return points[i].Time.Before(points[j].Time)
+    })
+    
+    return points, nil
+}
+
+// scan calls fn for the points with from <= time < to
+//
+func (s *Store) scan(from time.Time, to time.Time, fn func(p *Point)) error {
+    s.mu.Lock()
+    
+    if s.w != nil {
+        if err := s.w.Flush(); err != nil {
+            s.mu.Unlock()
+            return err
+        }
+    }
+    
+    segments := append([]*segment{}, s.segments...)
+    
+    if s.active != nil {
+        a := *s.active
+        segments = append(segments, &a)
+    }
+    
+    // the segments are read without the lock, a segment removed by the
+    // retention in the meantime is skipped
+    s.mu.Unlock()
+    
+    for _, seg := range segments {
+        if !seg.open && ((!from.IsZero() && seg.end.Before(from)) || (!to.IsZero() && !seg.start.Before(to))) {
+            continue
+        }
+        
+        read := func(p *Point) bool {
+            if (from.IsZero() || !p.Time.Before(from)) && (to.IsZero() || p.Time.Before(to)) {
+                fn(p)
+            }
+            
+            return true
+        }
+        
+        err := readSegment(seg.path, read)
+        
+        // the active segment of another writer may have been closed
+        if os.IsNotExist(err) && seg.open {
+            if names, _ := filepath.Glob(strings.TrimSuffix(seg.path, segmentExt) + "-*" + segmentExt); len(names) == 1 {
+                err = readSegment(names[0], read)
+            }
+        }
+        
+        if err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+    
+    return nil
+}
+
+// Downsample returns min, max and average per feed and bucket of the numeric
+// values of the feeds matching filter with from <= time < to. The buckets
+// start at from, or at the first point if from is zero. A zero bucket gives
+// one bucket per feed
+//
+func (s *Store) Downsample(filter mqttfabric.FeedFilter, from time.Time, to time.Time, bucket time.Duration) ([]Bucket, error) {
+    points, err := s.Query(filter, from, to)
+    
+    if err != nil || len(points) == 0 {
+        return nil, err
+    }
+    
+    origin := from
+    
+    if origin.IsZero() {
+        origin = points[0].Time
+    }
+    
+    type key struct {
+        feed    mqttfabric.FeedKey
+        n       int64
+    }
+    
+    buckets := make(map[key]*Bucket)
+    sums    := make(map[key]float64)
+    
+    for _, p := range points {
+        v, ok := mqttfabric.NumericValue(p.Value)
+        
+        if !ok {
+            continue
+        }
+        
+        var n int64
+        
+        if bucket > 0 {
+            n = int64(p.Time.Sub(origin) / bucket)
+        }
+        
+        k := key{p.FeedKey, n}
+        b := buckets[k]
+        
+        if b == nil {
+            b = &Bucket{FeedKey: p.FeedKey, Start: origin.Add(time.Duration(n) * bucket), Min: v, Max: v}
+            buckets[k] = b
+        }
+        
+        b.Count++
+        sums[k] += v
+        
+        if v < b.Min {
+            b.Min = v
+        }
+        if v > b.Max {
+            b.Max = v
+        }
+    }
+    
+    list := make([]Bucket, 0, len(buckets))
+    
+    for k, b := range buckets {
+        b.Avg = sums[k] / float64(b.Count)
+        list  = append(list, *b)
+    }
+    
+    sort.Slice(list, func(i, j int) bool {
+        a, b := list[i].FeedKey, list[j].FeedKey
+        
+        if a != b {
+            if a.RootTopic != b.RootTopic {
+                return a.RootTopic < b.RootTopic
+            }
+            if a.NodeName != b.NodeName {
+                return a.NodeName < b.NodeName
+            }
+            if a.PlatformID != b.PlatformID {
+                return a.PlatformID < b.PlatformID
+            }
+            if a.ServiceID != b.ServiceID {
+                return a.ServiceID < b.ServiceID
+            }
+            return a.FeedID < b.FeedID
+        }
+        
+        return list[i].Start.Before(list[j].Start)
+    })
+    
+    return list, nil
+}
@@ -0,0 +1,656 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+// Package history is an embedded, file-backed store of onramp feed values
+//
+// Points are appended to segment files of JSON lines in a directory. The
+// active segment is named "<start>.seg" and renamed to "<start>-<end>.seg"
+// when it is full or old enough, times are nanoseconds since the epoch. Old
+// segments are removed by age and total size, and Compact() merges small
+// segments and drops expired points. One writer at a time holds the lock of
+// the directory, readers open it with OpenReadOnly()
+//
+package history
+
+import (
+    "os"
+    "log"
+    "sort"
+    "sync"
+    "time"
+    "bufio"
+    "errors"
+    "strconv"
+    "strings"
+    "path/filepath"
+    "encoding/json"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// Point is one feed value
+//
+type Point struct {
+    mqttfabric.FeedKey
+    
+    Time            time.Time   `json:"ts"`
+    Value           interface{} `json:"value"`
+}
+
+// Options ...
+//
+type Options struct {
+    SegmentSize     int64           // roll the active segment at this size, default 4 MiB
+    SegmentAge      time.Duration   // or when it is this old, default 1 hour
+    MaxAge          time.Duration   // remove points older than this, 0 keeps them
+    MaxSize         int64           // remove the oldest segments above this total size, 0 is no limit
+}
+
+type segment struct {
+    path            string
+    start           time.Time       // of the oldest point
+    end             time.Time       // of the newest point
+    size            int64
+    opened          time.Time       // when the active segment was created
+    open            bool            // the active segment of another writer, end is unknown
+}
+
+// Store ...
+//
+type Store struct {
+    Options
+    
+    dir             string
+    mu              sync.Mutex
+    segments        []*segment      // closed segments, oldest first
+    active          *segment
+    file            *os.File
+    w               *bufio.Writer
+    lock            *os.File        // nil for a read-only store
+}
+
+const (
+    segmentExt  = ".seg"
+    lockName    = "LOCK"
+)
+
+var (
+    // ErrLocked is returned by Open() if another writer has the store open
+    ErrLocked   = errors.New("history: the store is locked by another writer")
+    // ErrReadOnly is returned when a read-only store is changed
+    ErrReadOnly = errors.New("history: the store is read-only")
+)
+
+// Open opens or creates the store in dir for writing. It fails with ErrLocked
+// while another process has it open for writing. An active segment left by a
+// crash is closed
+//
+func Open(dir string, opts Options) (*Store, error) {
+    if opts.SegmentSize <= 0 {
+        opts.SegmentSize = 4 * 1024 * 1024
+    }
+    if opts.SegmentAge <= 0 {
+        opts.SegmentAge = time.Hour
+    }
+    
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+    
+    lock, err := lockDir(dir)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    s, err := load(dir, opts, true)
+    
+    if err != nil {
+        lock.Close()
+        return nil, err
+    }
+    
+    s.lock = lock
+    
+    return s, nil
+}
+
+// OpenReadOnly opens the store in dir for queries. It can be used while a
+// writer has the store open, the active segment of the writer is read as it is
+//
+func OpenReadOnly(dir string) (*Store, error) {
+    if _, err := os.Stat(dir); err != nil {
+        return nil, err
+    }
+    
+    return load(dir, Options{}, false)
+}
+
+// load reads the segment names in dir, the active segments are closed if
+// recovery is set
+//
+func load(dir string, opts Options, recovery bool) (*Store, error) {
+    s := &Store{Options: opts, dir: dir}
+    
+    names, err := filepath.Glob(filepath.Join(dir, "*" + segmentExt))
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    for _, name := range names {
+        seg, closed, err := parseName(name)
+        
+        if err != nil {
+            log.Println("history: Open(): skipping ", name, ": ", err)
+            continue
+        }
+        
+        if !closed && recovery {
+            if seg, err = recoverSegment(seg); err != nil {
+                return nil, err
+            }
+        } else if !closed {
+            seg.open = true
+        }
+        
+        if fi, err := os.Stat(seg.path); err == nil {
+            seg.size = fi.Size()
+        }
+        
+        s.segments = append(s.segments, seg)
+    }
+    
+    sort.Slice(s.segments, func(i, j int) bool {
+        return s.segments[i].start.Before(s.segments[j].start)
+    })
+    
+    return s, nil
+}
+
+func segmentName(start time.Time, end time.Time) string {
+    name := strconv.FormatInt(start.UnixNano(), 10)
+    
+    if !end.IsZero() {
+        name += "-" + strconv.FormatInt(end.UnixNano(), 10)
+    }
+    
+    return name + segmentExt
+}
+
+// parseName returns the segment of a file and whether it is closed
+//
+func parseName(path string) (*segment, bool, error) {
+    parts := strings.Split(strings.TrimSuffix(filepath.Base(path), segmentExt), "-")
+    
+    if len(parts) > 2 {
+        return nil, false, errors.New("not a segment name")
+    }
+    
+    var times []time.Time
+    
+    for _, p := range parts {
+        ns, err := strconv.ParseInt(p, 10, 64)
+        
+        if err != nil {
+            return nil, false, errors.New("not a segment name")
+        }
+        
+        times = append(times, time.Unix(0, ns))
+    }
+    
+    seg := &segment{path: path, start: times[0]}
+    
+    if len(times) == 1 {
+        return seg, false, nil
+    }
+    
+    seg.end = times[1]
+    
+    return seg, true, nil
+}
+
+// recoverSegment closes a segment that was active when the process stopped
+//
+func recoverSegment(seg *segment) (*segment, error) {
+    seg.end = seg.start
+    
+    err := readSegment(seg.path, func(p *Point) bool {
+        if p.Time.Before(seg.start) {
+            seg.start = p.Time
+        }
+        if p.Time.After(seg.end) {
+            seg.end = p.Time
+        }
+        
+        return true
+    })
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    path := filepath.Join(filepath.Dir(seg.path), segmentName(seg.start, seg.end))
+    
+    if err := os.Rename(seg.path, path); err != nil {
+        return nil, err
+    }
+    
+    seg.path = path
+    
+    return seg, nil
+}
+
+// readSegment calls fn for every point in the file at path until fn returns
+// false. Lines that can't be parsed, like a partial last line, are skipped
+//
+func readSegment(path string, fn func(p *Point) bool) error {
+    f, err := os.Open(path)
+    
+    if err != nil {
+        return err
+    }
+    
+    defer f.Close()
+    
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+    
+    for scanner.Scan() {
+        var p Point
+        
+        if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+            continue
+        }
+        
+        if !fn(&p) {
+            return nil
+        }
+    }
+    
+    return scanner.Err()
+}
+
+// Append adds p to the active segment, p.Time is set to now if it is zero
+//
+func (s *Store) Append(p Point) error {
+    if s.lock == nil {
+        return ErrReadOnly
+    }
+    if p.Time.IsZero() {
+        p.Time = time.Now()
+    }
+    
+    line, err := json.Marshal(&p)
+    
+    if err != nil {
+        return err
+    }
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if s.active != nil && (s.active.size >= s.SegmentSize || time.Since(s.active.opened) >= s.SegmentAge) {
+        // the point goes to a new segment even if the old one failed
+        if err := s.roll(); err != nil {
+            log.Println("history: Append(): err = ", err)
+        }
+    }
+    
+    if s.active == nil {
+        seg := &segment{start: p.Time, end: p.Time, opened: time.Now()}
+        seg.path = filepath.Join(s.dir, segmentName(seg.start, time.Time{}))
+        
+        f, err := os.OpenFile(seg.path, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0644)
+        
+        if err != nil {
+            return err
+        }
+        
+        s.active = seg
+        s.file   = f
+        s.w      = bufio.NewWriter(f)
+    }
+    
+    n, err := s.w.Write(append(line, '\n'))
+    
+    s.active.size += int64(n)
+    
+    if p.Time.Before(s.active.start) {
+        s.active.start = p.Time
+    }
+    if p.Time.After(s.active.end) {
+        s.active.end = p.Time
+    }
+    
+    return err
+}
+
+// roll closes the active segment and applies the retention, s.mu must be held.
+// The segment is given up on errors, the next Append() opens a new one and the
+// next Open() recovers it
+//
+func (s *Store) roll() error {
+    if s.active == nil {
+        return nil
+    }
+    
+    seg, f, w := s.active, s.file, s.w
+    
+    s.active = nil
+    s.file   = nil
+    s.w      = nil
+    
+    err := w.Flush()
+    
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return err
+    }
+    
+    path := filepath.Join(s.dir, segmentName(seg.start, seg.end))
+    
+    if err := os.Rename(seg.path, path); err != nil {
+        return err
+    }
+    
+    seg.path   = path
+    s.segments = append(s.segments, seg)
+    
+    return s.retain()
+}
+
+// Flush writes the buffered points of the active segment to disk
+//
+func (s *Store) Flush() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if s.w == nil {
+        return nil
+    }
+    
+    return s.w.Flush()
+}
+
+// Close closes the active segment and releases the lock
+//
+func (s *Store) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if s.lock == nil {
+        return nil
+    }
+    
+    err := s.roll()
+    
+    s.lock.Close()
+    s.lock = nil
+    
+    return err
+}
+
+// Retain removes the closed segments older than MaxAge and the oldest ones
+// while the store is larger than MaxSize
+//
+func (s *Store) Retain() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if s.lock == nil {
+        return ErrReadOnly
+    }
+    
+    return s.retain()
+}
+
+func (s *Store) retain() error {
+    var total int64
+    
+    for _, seg := range s.segments {
+        total += seg.size
+    }
+    
+    if s.active != nil {
+        total += s.active.size
+    }
+    
+    for len(s.segments) > 0 {
+        seg     := s.segments[0]
+        expired := s.MaxAge > 0 && time.Since(seg.end) > s.MaxAge
+        full    := s.MaxSize > 0 && total > s.MaxSize
+        
+        if !expired && !full {
+            break
+        }
+        
+        if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        
+        total     -= seg.size
+        s.segments = s.segments[1:]
+    }
+    
+    return nil
+}
+
+// Compact merges runs of closed segments into segments of up to SegmentSize
+// and drops the points older than MaxAge
+//
+func (s *Store) Compact() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if s.lock == nil {
+        return ErrReadOnly
+    }
+    
+    if err := s.retain(); err != nil {
+        return err
+    }
+    
+    var compacted []*segment
+    
+    for i := 0; i < len(s.segments); {
+        // collect a run of segments fitting in one
+        j    := i + 1
+        size := s.segments[i].size
+        
+        for j < len(s.segments) && size + s.segments[j].size <= s.SegmentSize {
+            size += s.segments[j].size
+            j++
+        }
+        
+        run := s.segments[i:j]
+        i    = j
+        
+        if len(run) == 1 && !s.hasExpired(run[0]) {
+            compacted = append(compacted, run[0])
+            continue
+        }
+        
+        seg, err := s.merge(run)
+        
+        if err != nil {
+            return err
+        }
+        
+        if seg != nil {
+            compacted = append(compacted, seg)
+        }
+    }
+    
+    s.segments = compacted
+    
+    return nil
+}
+
+func (s *Store) hasExpired(seg *segment) bool {
+    return s.MaxAge > 0 && time.Since(seg.start) > s.MaxAge
+}
+
+// merge writes the points of run to one new segment and removes the old
+// ones. It returns nil if no point is left
+//
+func (s *Store) merge(run []*segment) (*segment, error) {
+    var cutoff time.Time
+    
+    if s.MaxAge > 0 {
+        cutoff = time.Now().Add(-s.MaxAge)
+    }
+    
+    tmp, err := os.CreateTemp(s.dir, "compact-*.tmp")
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    defer os.Remove(tmp.Name())
+    
+    w   := bufio.NewWriter(tmp)
+    seg := &segment{}
+    
+    for _, old := range run {
+        err := readSegment(old.path, func(p *Point) bool {
+            if p.Time.Before(cutoff) {
+                return true
+            }
+            
+            line, err := json.Marshal(p)
+            
+            if err != nil {
+                return true
+            }
+            
+            n, _ := w.Write(append(line, '\n'))
+            seg.size += int64(n)
+            
+            if seg.start.IsZero() || p.Time.Before(seg.start) {
+                seg.start = p.Time
+            }
+            if p.Time.After(seg.end) {
+                seg.end = p.Time
+            }
+            
+            return true
+        })
+        
+        if err != nil {
+            tmp.Close()
+            return nil, err
+        }
+    }
+    
+    if err := w.Flush(); err != nil {
+        tmp.Close()
+        return nil, err
+    }
+    if err := tmp.Close(); err != nil {
+        return nil, err
+    }
+    
+    if seg.size > 0 {
+        seg.path = filepath.Join(s.dir, segmentName(seg.start, seg.end))
+        
+        // the name can be the one of a segment in the run, which is removed below
+        for _, old := range run {
+            if old.path != seg.path {
+                continue
+            }
+            if err := os.Remove(old.path); err != nil {
+                return nil, err
+            }
+        }
+        
+        if err := os.Rename(tmp.Name(), seg.path); err != nil {
+            return nil, err
+        }
+    }
+    
+    for _, old := range run {
+        if old.path == seg.path {
+            continue
+        }
+        if err := os.Remove(old.path); err != nil && !os.IsNotExist(err) {
+            return nil, err
+        }
+    }
+    
+    if seg.size == 0 {
+        return nil, nil
+    }
+    
+    return seg, nil
+}
+
+// Attach records the onramp values of all roots of m, except the retained
+// ones. Call it before m.Start()
+//
+func (s *Store) Attach(m *mqttfabric.MqttFabric) error {
+    for _, f := range m.Roots {
+        any := mqttfabric.FABRIC_TOPIC_ANY
+        
+        if err := m.SubscribeHandler(f.CtrlOnrampSubscription(any, any, any, any), 0, s.onOnramp); err != nil {
+            return err
+        }
+    }
+    
+    return nil
+}
+
+func (s *Store) onOnramp(m *mqttfabric.MqttFabric, msg *mqttfabric.Message) {
+    if msg.Retained {
+        // an old value, it is delivered again on every connect
+        return
+    }
+    
+    t, err := m.ParseTopic(msg.Topic)
+    
+    if err != nil || t.Kind != mqttfabric.TOPIC_ONRAMP {
+        return
+    }
+    
+    o, err := mqttfabric.BlueMixParse(string(msg.Payload))
+    
+    if err != nil {
+        return
+    }
+    
+    // the "ts" of the envelope is when the value was sampled, Append() uses
+    // the receive time without it
+    err = s.Append(Point{
+        FeedKey:    mqttfabric.FeedKey{RootTopic: t.RootTopic, NodeName: t.NodeName, PlatformID: t.PlatformID, ServiceID: t.ServiceID, FeedID: t.FeedID},
+        Time:       o.Time,
+        Value:      o.T,
+    })
+    
+    if err != nil {
+        log.Println("history: onOnramp(): err = ", err)
+    }
+}
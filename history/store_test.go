@@ -0,0 +1,422 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package history
+
+import (
+    "io/ioutil"
+    "log"
+    "os"
+    "strconv"
+    "testing"
+    "time"
+    "encoding/json"
+    "path/filepath"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+var base = time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+
+func point(feedID string, t time.Time, v interface{}) Point {
+    return Point{FeedKey: mqttfabric.FeedKey{RootTopic: "fabric", NodeName: "dev1", PlatformID: "esp", ServiceID: "analog_in", FeedID: feedID}, Time: t, Value: v}
+}
+
+func openStore(t *testing.T, dir string, opts Options) *Store {
+    log.SetOutput(ioutil.Discard)
+    t.Cleanup(func() { log.SetOutput(os.Stderr) })
+    
+    s, err := Open(dir, opts)
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    t.Cleanup(func() { s.Close() })
+    
+    return s
+}
+
+func appendAll(t *testing.T, s *Store, points ...Point) {
+    for _, p := range points {
+        if err := s.Append(p); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+// rollNow closes the active segment like a full one
+//
+func rollNow(t *testing.T, s *Store) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if err := s.roll(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+    names, err := filepath.Glob(filepath.Join(dir, "*" + segmentExt))
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    for i, name := range names {
+        names[i] = filepath.Base(name)
+    }
+    
+    return names
+}
+
+func queryTimes(t *testing.T, s *Store, filter mqttfabric.FeedFilter) []time.Time {
+    points, err := s.Query(filter, time.Time{}, time.Time{})
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    var times []time.Time
+    
+    for _, p := range points {
+        times = append(times, p.Time)
+    }
+    
+    return times
+}
+
+func sameTimes(got []time.Time, want ...time.Time) bool {
+    if len(got) != len(want) {
+        return false
+    }
+    
+    for i := range got {
+        if !got[i].Equal(want[i]) {
+            return false
+        }
+    }
+    
+    return true
+}
+
+func TestAppendQuery(t *testing.T) {
+    dir := t.TempDir()
+    s   := openStore(t, dir, Options{})
+    
+    appendAll(t, s,
+        point("temp", base.Add(2 * time.Minute), 21.5),
+        point("temp", base, 20.5),
+        point("hum",  base.Add(time.Minute), 40.0),
+    )
+    
+    before := time.Now()
+    appendAll(t, s, point("hum", time.Time{}, 41.0))
+    
+    // the active segment is read too, ordered by time
+    got := queryTimes(t, s, mqttfabric.FeedFilter{FeedID: "temp"})
+    
+    if !sameTimes(got, base, base.Add(2 * time.Minute)) {
+        t.Errorf("temp points at %v", got)
+    }
+    
+    points, err := s.Query(mqttfabric.FeedFilter{FeedID: "hum"}, base.Add(time.Minute), time.Time{})
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(points) != 2 || points[0].Value != 40.0 || points[1].Time.Before(before) {
+        t.Errorf("hum points %+v", points)
+    }
+    
+    // to is exclusive
+    if got := queryTimes(t, s, mqttfabric.FeedFilter{}); len(got) != 4 {
+        t.Errorf("got %d points, want 4", len(got))
+    }
+    if points, _ := s.Query(mqttfabric.FeedFilter{}, base, base.Add(time.Minute)); len(points) != 1 {
+        t.Errorf("got %d points in the first minute, want 1", len(points))
+    }
+    
+    if _, err := Open(dir, Options{}); err != ErrLocked {
+        t.Errorf("second Open() err = %v, want ErrLocked", err)
+    }
+    
+    r, err := OpenReadOnly(dir)
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := r.Append(point("temp", base, 1.0)); err != ErrReadOnly {
+        t.Errorf("read-only Append() err = %v", err)
+    }
+    
+    s.Flush()
+    
+    // the active segment of the writer is read as it is
+    if got := queryTimes(t, r, mqttfabric.FeedFilter{FeedID: "temp"}); !sameTimes(got, base, base.Add(2 * time.Minute)) {
+        t.Errorf("read-only temp points at %v", got)
+    }
+}
+
+func TestRoll(t *testing.T) {
+    dir := t.TempDir()
+    s   := openStore(t, dir, Options{SegmentSize: 1})
+    
+    appendAll(t, s,
+        point("temp", base, 1.0),
+        point("temp", base.Add(time.Minute), 2.0),
+        point("temp", base.Add(2 * time.Minute), 3.0),
+    )
+    
+    // every point fills a segment, the last one is still active
+    names := segmentFiles(t, dir)
+    
+    if len(names) != 3 {
+        t.Fatalf("segments %v", names)
+    }
+    
+    closed := 0
+    
+    for _, name := range names {
+        if _, ok, _ := parseName(name); ok {
+            closed++
+        }
+    }
+    
+    if closed != 2 {
+        t.Errorf("%d closed segments in %v, want 2", closed, names)
+    }
+    
+    if err := s.Close(); err != nil {
+        t.Fatal(err)
+    }
+    
+    want := segmentName(base.Add(2 * time.Minute), base.Add(2 * time.Minute))
+    
+    if names := segmentFiles(t, dir); len(names) != 3 || names[2] != want {
+        t.Errorf("segments after Close() %v, want %s last", names, want)
+    }
+    
+    // the lock is released
+    s = openStore(t, dir, Options{})
+    
+    if got := queryTimes(t, s, mqttfabric.FeedFilter{}); !sameTimes(got, base, base.Add(time.Minute), base.Add(2 * time.Minute)) {
+        t.Errorf("points at %v", got)
+    }
+}
+
+func TestRecoverSegment(t *testing.T) {
+    dir := t.TempDir()
+    s   := openStore(t, dir, Options{})
+    
+    appendAll(t, s,
+        point("temp", base.Add(time.Minute), 1.0),
+        point("temp", base, 2.0),
+    )
+    
+    // stop without closing the segment, with a partial last line
+    s.Flush()
+    s.file.WriteString(`{"ts":"2026-01-01T11:00:00Z","val`)
+    s.file.Close()
+    s.lock.Close()
+    s.lock = nil
+    
+    s = openStore(t, dir, Options{})
+    
+    want := segmentName(base, base.Add(time.Minute))
+    
+    if names := segmentFiles(t, dir); len(names) != 1 || names[0] != want {
+        t.Errorf("segments %v, want %s", names, want)
+    }
+    
+    if got := queryTimes(t, s, mqttfabric.FeedFilter{}); !sameTimes(got, base, base.Add(time.Minute)) {
+        t.Errorf("points at %v", got)
+    }
+}
+
+func TestCompactNameCollision(t *testing.T) {
+    dir := t.TempDir()
+    s   := openStore(t, dir, Options{})
+    
+    // the merged segment gets the name of the first one, which spans both
+    appendAll(t, s, point("temp", base, 1.0), point("temp", base.Add(2 * time.Minute), 3.0))
+    rollNow(t, s)
+    appendAll(t, s, point("temp", base.Add(time.Minute), 2.0))
+    rollNow(t, s)
+    
+    if err := s.Compact(); err != nil {
+        t.Fatal(err)
+    }
+    
+    want := segmentName(base, base.Add(2 * time.Minute))
+    
+    if names := segmentFiles(t, dir); len(names) != 1 || names[0] != want {
+        t.Errorf("segments %v, want %s", names, want)
+    }
+    if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) != 0 {
+        t.Errorf("left %v", tmp)
+    }
+    if got := queryTimes(t, s, mqttfabric.FeedFilter{}); !sameTimes(got, base, base.Add(time.Minute), base.Add(2 * time.Minute)) {
+        t.Errorf("points at %v", got)
+    }
+}
+
+func TestRetainSize(t *testing.T) {
+    dir := t.TempDir()
+    
+    line, _ := json.Marshal(point("temp", base, 1.0))
+    
+    // room for two points
+    s := openStore(t, dir, Options{SegmentSize: 1, MaxSize: 2 * int64(len(line) + 1)})
+    
+    for i := 0; i < 4; i++ {
+        appendAll(t, s, point("temp", base.Add(time.Duration(i) * time.Minute), float64(i)))
+    }
+    
+    if err := s.Close(); err != nil {
+        t.Fatal(err)
+    }
+    
+    if names := segmentFiles(t, dir); len(names) != 2 {
+        t.Errorf("segments %v, want 2", names)
+    }
+    
+    s = openStore(t, dir, Options{})
+    
+    if got := queryTimes(t, s, mqttfabric.FeedFilter{}); !sameTimes(got, base.Add(2 * time.Minute), base.Add(3 * time.Minute)) {
+        t.Errorf("points at %v", got)
+    }
+}
+
+func TestRetainAge(t *testing.T) {
+    dir := t.TempDir()
+    s   := openStore(t, dir, Options{MaxAge: time.Hour})
+    now := time.Now()
+    
+    appendAll(t, s, point("temp", now.Add(-3 * time.Hour), 1.0))
+    rollNow(t, s)
+    appendAll(t, s, point("temp", now.Add(-2 * time.Hour), 2.0), point("temp", now, 3.0))
+    rollNow(t, s)
+    
+    // the first segment is expired as a whole, the second one partly
+    if err := s.Retain(); err != nil {
+        t.Fatal(err)
+    }
+    if names := segmentFiles(t, dir); len(names) != 1 || names[0] != segmentName(now.Add(-2 * time.Hour), now) {
+        t.Errorf("segments after Retain() %v", names)
+    }
+    
+    if err := s.Compact(); err != nil {
+        t.Fatal(err)
+    }
+    if names := segmentFiles(t, dir); len(names) != 1 || names[0] != segmentName(now, now) {
+        t.Errorf("segments after Compact() %v", names)
+    }
+    if got := queryTimes(t, s, mqttfabric.FeedFilter{}); !sameTimes(got, now) {
+        t.Errorf("points at %v", got)
+    }
+}
+
+func TestDownsample(t *testing.T) {
+    s := openStore(t, t.TempDir(), Options{})
+    
+    appendAll(t, s,
+        point("temp", base.Add(10 * time.Second), 1.0),
+        point("temp", base.Add(50 * time.Second), 3.0),
+        point("temp", base.Add(80 * time.Second), 5.0),
+        point("temp", base.Add(90 * time.Second), "off"),
+        point("door", base.Add(30 * time.Second), true),
+    )
+    
+    buckets, err := s.Downsample(mqttfabric.FeedFilter{}, base, time.Time{}, time.Minute)
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    want := []struct {
+        feed            string
+        start           time.Time
+        count           int
+        min, max, avg   float64
+    }{
+        {"door", base,                  1, 1, 1, 1},
+        {"temp", base,                  2, 1, 3, 2},
+        {"temp", base.Add(time.Minute), 1, 5, 5, 5},
+    }
+    
+    if len(buckets) != len(want) {
+        t.Fatalf("buckets %+v", buckets)
+    }
+    
+    for i, w := range want {
+        b := buckets[i]
+        
+        if b.FeedID != w.feed || !b.Start.Equal(w.start) || b.Count != w.count || b.Min != w.min || b.Max != w.max || b.Avg != w.avg {
+            t.Errorf("bucket %d = %+v, want %+v", i, b, w)
+        }
+    }
+    
+    // one bucket per feed, starting at the first point
+    buckets, _ = s.Downsample(mqttfabric.FeedFilter{FeedID: "temp"}, time.Time{}, time.Time{}, 0)
+    
+    if len(buckets) != 1 || buckets[0].Count != 3 || buckets[0].Avg != 3 || !buckets[0].Start.Equal(base.Add(10 * time.Second)) {
+        t.Errorf("buckets %+v", buckets)
+    }
+}
+
+func TestOnOnrampUsesEnvelopeTime(t *testing.T) {
+    s := openStore(t, t.TempDir(), Options{})
+    m := mqttfabric.MqttFabricInitializeTransport(mqttfabric.NewMemoryBroker().NewTransport(), "fabric", "dev1", "esp", mqttfabric.DEVICE)
+    
+    topic   := m.Roots[0].DeviceOnrampTopic(mqttfabric.SERVICE_ID_ANALOG_IN, "temp")
+    payload := func(value string, ts string) []byte {
+        return []byte(`{"d":{"_type":"float","feed_id":"temp","value":` + value + ts + `}}`)
+    }
+    sampled := strconv.FormatInt(base.UnixNano() / int64(time.Millisecond), 10)
+    
+    before := time.Now()
+    
+    s.onOnramp(m, &mqttfabric.Message{Topic: topic, Payload: payload("20.5", `,"ts":` + sampled)})
+    s.onOnramp(m, &mqttfabric.Message{Topic: topic, Payload: payload("21.5", "")})
+    s.onOnramp(m, &mqttfabric.Message{Topic: topic, Payload: payload("19.5", ""), Retained: true})
+    
+    points, err := s.Query(mqttfabric.FeedFilter{}, time.Time{}, time.Time{})
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(points) != 2 {
+        t.Fatalf("points %+v", points)
+    }
+    
+    // the sampled one keeps its time, the other gets the receive time
+    if !points[0].Time.Equal(base) || points[0].Value != 20.5 || points[0].FeedID != "temp" || points[0].NodeName != "dev1" {
+        t.Errorf("sampled point %+v", points[0])
+    }
+    if points[1].Time.Before(before) || points[1].Value != 21.5 {
+        t.Errorf("received point %+v", points[1])
+    }
+}
@@ -0,0 +1,341 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+// Package homeassistant publishes Home Assistant MQTT discovery configs for
+// fabric feeds and turns Home Assistant commands into fabric offramp tasks
+//
+// The feeds are found from the device descriptors and from the onramp traffic.
+// The state topics in the configs are the fabric onramp topics, so the bridge
+// only has to publish the configs and handle the commands
+//
+package homeassistant
+
+import (
+    "log"
+    "math"
+    "sync"
+    "regexp"
+    "strconv"
+    "strings"
+    "encoding/json"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// Device is the device block of a discovery config
+//
+type Device struct {
+    Identifiers     []string    `json:"identifiers"`
+    Name            string      `json:"name"`
+    Model           string      `json:"model,omitempty"`
+    Manufacturer    string      `json:"manufacturer,omitempty"`
+}
+
+// Config is a discovery config
+//
+type Config struct {
+    Name                    string      `json:"name"`
+    UniqueID                string      `json:"unique_id"`
+    StateTopic              string      `json:"state_topic,omitempty"`
+    ValueTemplate           string      `json:"value_template,omitempty"`
+    CommandTopic            string      `json:"command_topic,omitempty"`
+    PayloadOn               string      `json:"payload_on,omitempty"`
+    PayloadOff              string      `json:"payload_off,omitempty"`
+    StateOn                 string      `json:"state_on,omitempty"`
+    StateOff                string      `json:"state_off,omitempty"`
+    UnitOfMeasurement       string      `json:"unit_of_measurement,omitempty"`
+    Min                     *float64    `json:"min,omitempty"`
+    Max                     *float64    `json:"max,omitempty"`
+    AvailabilityTopic       string      `json:"availability_topic,omitempty"`
+    AvailabilityTemplate    string      `json:"availability_template,omitempty"`
+    PayloadAvailable        string      `json:"payload_available,omitempty"`
+    PayloadNotAvailable     string      `json:"payload_not_available,omitempty"`
+    Device                  Device      `json:"device"`
+}
+
+// feed identifies a fabric feed
+//
+type feed struct {
+    root            string
+    nodename        string
+    platformID      string
+    serviceID       string
+    feedID          string
+}
+
+// Bridge ...
+//
+type Bridge struct {
+    Fabric          *mqttfabric.MqttFabric
+    DiscoveryPrefix string      // default "homeassistant"
+    CommandPrefix   string      // default "fabric2ha"
+    
+    mu              sync.Mutex
+    announced       map[feed]string     // feed to config topic
+    commands        map[string]feed     // command topic to feed
+}
+
+// NewBridge creates a bridge on m, which should be a CONTROLLER. Call Start()
+// before m.Start()
+//
+func NewBridge(m *mqttfabric.MqttFabric) *Bridge {
+    return &Bridge{
+        Fabric:             m,
+        DiscoveryPrefix:    "homeassistant",
+        CommandPrefix:      "fabric2ha",
+        announced:          make(map[feed]string),
+        commands:           make(map[string]feed),
+    }
+}
+
+// Start subscribes to the descriptors, the onramp traffic and the commands
+//
+func (b *Bridge) Start() error {
+    for _, f := range b.Fabric.Roots {
+        any := mqttfabric.FABRIC_TOPIC_ANY
+        
+        if err := b.Fabric.SubscribeHandler(f.DescriptorSubscription(any, any), 1, b.onDescriptor); err != nil {
+            return err
+        }
+        if err := b.Fabric.SubscribeHandler(f.CtrlOnrampSubscription(any, any, any, any), 0, b.onOnramp); err != nil {
+            return err
+        }
+    }
+    
+    return b.Fabric.SubscribeHandler(b.CommandPrefix + "/#", 1, b.onCommand)
+}
+
+// component returns the Home Assistant component for a service, or "" if the
+// service is not bridged
+//
+func component(serviceID string) string {
+    switch serviceID {
+        case mqttfabric.SERVICE_ID_DIGITAL_IN:
+            return "binary_sensor"
+        case mqttfabric.SERVICE_ID_DIGITAL_OUT:
+            return "switch"
+        case mqttfabric.SERVICE_ID_ANALOG_IN:
+            return "sensor"
+        case mqttfabric.SERVICE_ID_ANALOG_OUT:
+            return "number"
+        case mqttfabric.SERVICE_ID_TEXT:
+            return "text"
+    }
+    
+    return ""
+}
+
+var invalidID = regexp.MustCompile("[^a-zA-Z0-9_-]+")
+
+func sanitize(s string) string {
+    return invalidID.ReplaceAllString(s, "_")
+}
+
+func (f feed) objectID() string {
+    return sanitize(f.root + "_" + f.nodename + "_" + f.platformID + "_" + f.serviceID + "_" + f.feedID)
+}
+
+// announce publishes the discovery config for f, fd may be nil
+//
+func (b *Bridge) announce(f feed, fd *mqttfabric.FeedDescriptor) {
+    comp := component(f.serviceID)
+    
+    if comp == "" {
+        return
+    }
+    
+    root := b.Fabric.Root(f.root)
+    
+    if root == nil {
+        return
+    }
+    
+    b.mu.Lock()
+    _, done := b.announced[f]
+    b.mu.Unlock()
+    
+    // onramp traffic only announces feeds not seen before, descriptors always
+    if done && fd == nil {
+        return
+    }
+    
+    objectID := f.objectID()
+    
+    c := &Config{
+        Name:                   f.feedID,
+        UniqueID:               "fabric_" + objectID,
+        StateTopic:             root.CtrlOnrampSubscription(f.nodename, f.platformID, f.serviceID, f.feedID),
+        ValueTemplate:          "{{ value_json.d.value }}",
+        AvailabilityTopic:      root.StatusSubscription(f.nodename, f.platformID),
+        AvailabilityTemplate:   "{{ 'online' if value_json.d.status == 'online' else 'offline' }}",
+        PayloadAvailable:       "online",
+        PayloadNotAvailable:    "offline",
+        Device:                 Device{
+            Identifiers:    []string{sanitize("fabric_" + f.root + "_" + f.nodename + "_" + f.platformID)},
+            Name:           f.nodename + " " + f.platformID,
+            Model:          f.platformID,
+            Manufacturer:   "MQTT fabric",
+        },
+    }
+    
+    switch comp {
+        case "binary_sensor":
+            c.ValueTemplate = "{{ 'ON' if value_json.d.value else 'OFF' }}"
+            c.PayloadOn     = "ON"
+            c.PayloadOff    = "OFF"
+            
+        case "switch":
+            c.ValueTemplate = "{{ 'ON' if value_json.d.value else 'OFF' }}"
+            c.PayloadOn     = "ON"
+            c.PayloadOff    = "OFF"
+            c.StateOn       = "ON"
+            c.StateOff      = "OFF"
+    }
+    
+    if comp == "switch" || comp == "number" || comp == "text" {
+        c.CommandTopic = b.CommandPrefix + "/" + objectID + "/set"
+    }
+    
+    if fd != nil {
+        c.UnitOfMeasurement = fd.Unit
+        
+        if comp == "number" {
+            c.Min = fd.Min
+            c.Max = fd.Max
+        }
+    }
+    
+    msg, err := json.Marshal(c)
+    
+    if err != nil {
+        log.Println("homeassistant: announce(): err = ", err)
+        return
+    }
+    
+    topic := b.DiscoveryPrefix + "/" + comp + "/" + sanitize(f.nodename) + "/" + objectID + "/config"
+    
+    b.mu.Lock()
+    b.announced[f] = topic
+    
+    if c.CommandTopic != "" {
+        b.commands[c.CommandTopic] = f
+    }
+    b.mu.Unlock()
+    
+    b.Fabric.Publish(topic, 1, true, msg)
+}
+
+// remove deletes the discovery configs of a node
+//
+func (b *Bridge) remove(root string, nodename string, platformID string) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    
+    for f, topic := range b.announced {
+        if f.root == root && f.nodename == nodename && f.platformID == platformID {
+            b.Fabric.Publish(topic, 1, true, []byte{})
+            delete(b.announced, f)
+        }
+    }
+    
+    for topic, f := range b.commands {
+        if f.root == root && f.nodename == nodename && f.platformID == platformID {
+            delete(b.commands, topic)
+        }
+    }
+}
+
+func (b *Bridge) onDescriptor(m *mqttfabric.MqttFabric, msg *mqttfabric.Message) {
+    t, err := m.ParseTopic(msg.Topic)
+    
+    if err != nil {
+        return
+    }
+    
+    if len(msg.Payload) == 0 {
+        b.remove(t.RootTopic, t.NodeName, t.PlatformID)
+        return
+    }
+    
+    d, err := mqttfabric.DescriptorParse(string(msg.Payload))
+    
+    if err != nil {
+        log.Println("homeassistant: onDescriptor(): err = ", err)
+        return
+    }
+    
+    for _, s := range d.Services {
+        for _, fd := range s.Feeds {
+            b.announce(feed{t.RootTopic, d.NodeName, d.PlatformID, s.ServiceID, fd.FeedID}, fd)
+        }
+    }
+}
+
+func (b *Bridge) onOnramp(m *mqttfabric.MqttFabric, msg *mqttfabric.Message) {
+    t, err := m.ParseTopic(msg.Topic)
+    
+    if err != nil || t.Kind != mqttfabric.TOPIC_ONRAMP {
+        return
+    }
+    
+    b.announce(feed{t.RootTopic, t.NodeName, t.PlatformID, t.ServiceID, t.FeedID}, nil)
+}
+
+func (b *Bridge) onCommand(m *mqttfabric.MqttFabric, msg *mqttfabric.Message) {
+    b.mu.Lock()
+    f, ok := b.commands[msg.Topic]
+    b.mu.Unlock()
+    
+    if !ok {
+        log.Println("homeassistant: onCommand(): unknown command topic ", msg.Topic)
+        return
+    }
+    
+    payload := strings.TrimSpace(string(msg.Payload))
+    
+    var err error
+    
+    switch f.serviceID {
+        case mqttfabric.SERVICE_ID_DIGITAL_OUT:
+            err = m.CtrlTaskRoot(f.root, f.nodename, mqttfabric.TASK_ID_DIGITAL_WRITE, f.platformID, f.serviceID, f.feedID, payload == "ON")
+            
+        case mqttfabric.SERVICE_ID_ANALOG_OUT:
+            v, perr := strconv.ParseFloat(payload, 64)
+            
+            if perr != nil {
+                log.Println("homeassistant: onCommand(): not a number: ", payload)
+                return
+            }
+            
+            err = m.CtrlTaskRoot(f.root, f.nodename, mqttfabric.TASK_ID_ANALOG_WRITE, f.platformID, f.serviceID, f.feedID, int(math.Round(v)))
+            
+        case mqttfabric.SERVICE_ID_TEXT:
+            err = m.CtrlTaskRoot(f.root, f.nodename, mqttfabric.TASK_ID_RAW, f.platformID, f.serviceID, f.feedID, string(msg.Payload))
+    }
+    
+    if err != nil {
+        log.Println("homeassistant: onCommand(): err = ", err)
+    }
+}
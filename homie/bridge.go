@@ -0,0 +1,388 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+// Package homie exposes fabric devices following the Homie 4 convention
+//
+//   root/nodename        -> Homie device "<root>-<nodename>"
+//   platformID/serviceID -> Homie node "<platform_id>-<service_id>"
+//   feedID               -> Homie property
+//
+// The $state of a device follows the fabric status: online is ready, offline
+// is disconnected and disconnected (the LWT) is lost. Writing to the /set topic
+// of a digital_out, analog_out or text property sends an offramp task.
+//
+// Only one will can be set per connection, so the Homie devices are not set
+// to lost when the bridge itself goes away. A zero-length retained message
+// deletes the retained one, so $extensions, which would be empty, is left out
+// and empty or null values are not published
+//
+package homie
+
+import (
+    "fmt"
+    "log"
+    "math"
+    "sort"
+    "sync"
+    "regexp"
+    "strconv"
+    "strings"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+const (
+    STATE_INIT          = "init"
+    STATE_READY         = "ready"
+    STATE_DISCONNECTED  = "disconnected"
+    STATE_LOST          = "lost"
+)
+
+type property struct {
+    id              string
+    datatype        string
+    settable        bool
+    
+    root            string
+    nodename        string
+    platformID      string
+    serviceID       string
+    feedID          string
+}
+
+type node struct {
+    id              string
+    properties      map[string]*property
+}
+
+type device struct {
+    id              string
+    nodes           map[string]*node
+    statuses        map[string]mqttfabric.Status     // per platform id
+}
+
+// Bridge ...
+//
+type Bridge struct {
+    Fabric          *mqttfabric.MqttFabric
+    BaseTopic       string      // default "homie"
+    
+    mu              sync.Mutex
+    devices         map[string]*device
+    sets            map[string]*property    // set topic to property
+}
+
+// NewBridge creates a bridge on m, which should be a CONTROLLER. Call Start()
+// before m.Start()
+//
+func NewBridge(m *mqttfabric.MqttFabric) *Bridge {
+    return &Bridge{
+        Fabric:     m,
+        BaseTopic:  "homie",
+        devices:    make(map[string]*device),
+        sets:       make(map[string]*property),
+    }
+}
+
+// Start subscribes to the status messages, the onramp traffic and the /set topics
+//
+func (b *Bridge) Start() error {
+    any := mqttfabric.FABRIC_TOPIC_ANY
+    
+    for _, f := range b.Fabric.Roots {
+        if err := b.Fabric.SubscribeHandler(f.StatusSubscription(any, any), 1, b.onStatus); err != nil {
+            return err
+        }
+        if err := b.Fabric.SubscribeHandler(f.CtrlOnrampSubscription(any, any, any, any), 0, b.onOnramp); err != nil {
+            return err
+        }
+    }
+    
+    return b.Fabric.SubscribeHandler(b.BaseTopic + "/+/+/+/set", 1, b.onSet)
+}
+
+var invalidID = regexp.MustCompile("[^a-z0-9-]+")
+
+// ID turns s into a valid Homie id
+//
+func ID(s string) string {
+    id := strings.Trim(invalidID.ReplaceAllString(strings.ToLower(s), "-"), "-")
+    
+    if id == "" {
+        return "x"
+    }
+    
+    return id
+}
+
+// Datatype returns the Homie datatype of a BlueMixObject value
+//
+func Datatype(v interface{}) string {
+    switch v.(type) {
+        case bool:
+            return "boolean"
+        case int:
+            return "integer"
+        case float64:
+            return "float"
+    }
+    
+    return "string"
+}
+
+// Format returns a value as Homie payload
+//
+func Format(v interface{}) string {
+    switch x := v.(type) {
+        case nil:
+            return ""
+        case bool:
+            return strconv.FormatBool(x)
+        case int:
+            return strconv.Itoa(x)
+        case float64:
+            return strconv.FormatFloat(x, 'f', -1, 64)
+    }
+    
+    return fmt.Sprint(v)
+}
+
+func settable(serviceID string) bool {
+    return serviceID == mqttfabric.SERVICE_ID_DIGITAL_OUT || serviceID == mqttfabric.SERVICE_ID_ANALOG_OUT || serviceID == mqttfabric.SERVICE_ID_TEXT
+}
+
+func (b *Bridge) publish(topic string, value string) {
+    b.Fabric.Publish(b.BaseTopic + "/" + topic, 1, true, []byte(value))
+}
+
+// state returns the Homie state of d, b.mu must be held
+//
+func (d *device) state() string {
+    state := ""
+    
+    for _, s := range d.statuses {
+        switch s {
+            case mqttfabric.FABRIC_ONLINE:
+                return STATE_READY
+            case mqttfabric.FABRIC_DISCONNECTED:
+                state = STATE_LOST
+            case mqttfabric.FABRIC_OFFLINE:
+                if state == "" {
+                    state = STATE_DISCONNECTED
+                }
+        }
+    }
+    
+    if state == "" {
+        // no status seen but it is sending
+        return STATE_READY
+    }
+    
+    return state
+}
+
+func sortedKeys(m map[string]bool) string {
+    list := make([]string, 0, len(m))
+    
+    for k := range m {
+        list = append(list, k)
+    }
+    
+    sort.Strings(list)
+    
+    return strings.Join(list, ",")
+}
+
+// publishDevice publishes all attributes of d, b.mu must be held
+//
+func (b *Bridge) publishDevice(d *device, nodename string) {
+    b.publish(d.id + "/$state", STATE_INIT)
+    b.publish(d.id + "/$homie", "4.0.0")
+    b.publish(d.id + "/$name", nodename)
+    
+    nodes := make(map[string]bool)
+    
+    for _, n := range d.nodes {
+        nodes[n.id] = true
+        
+        props := make(map[string]bool)
+        
+        for _, p := range n.properties {
+            props[p.id] = true
+            
+            b.publish(d.id + "/" + n.id + "/" + p.id + "/$name", p.feedID)
+            b.publish(d.id + "/" + n.id + "/" + p.id + "/$datatype", p.datatype)
+            b.publish(d.id + "/" + n.id + "/" + p.id + "/$settable", strconv.FormatBool(p.settable))
+        }
+        
+        b.publish(d.id + "/" + n.id + "/$name", n.id)
+        b.publish(d.id + "/" + n.id + "/$type", "fabric")
+        b.publish(d.id + "/" + n.id + "/$properties", sortedKeys(props))
+    }
+    
+    b.publish(d.id + "/$nodes", sortedKeys(nodes))
+    b.publish(d.id + "/$state", d.state())
+}
+
+func (b *Bridge) device(root string, nodename string) *device {
+    id := ID(root + "-" + nodename)
+    d  := b.devices[id]
+    
+    if d == nil {
+        d = &device{id: id, nodes: make(map[string]*node), statuses: make(map[string]mqttfabric.Status)}
+        b.devices[id] = d
+    }
+    
+    return d
+}
+
+func (b *Bridge) onStatus(m *mqttfabric.MqttFabric, msg *mqttfabric.Message) {
+    t, err := m.ParseTopic(msg.Topic)
+    
+    if err != nil {
+        return
+    }
+    
+    s, err := mqttfabric.StatusParse(string(msg.Payload))
+    
+    if err != nil || s.ClassType != mqttfabric.DEVICE {
+        return
+    }
+    
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    
+    d := b.device(t.RootTopic, s.NodeName)
+    d.statuses[s.PlatformID] = s.Status
+    
+    if len(d.nodes) > 0 {
+        b.publish(d.id + "/$state", d.state())
+    }
+}
+
+func (b *Bridge) onOnramp(m *mqttfabric.MqttFabric, msg *mqttfabric.Message) {
+    t, err := m.ParseTopic(msg.Topic)
+    
+    if err != nil || t.Kind != mqttfabric.TOPIC_ONRAMP {
+        return
+    }
+    
+    o, err := mqttfabric.BlueMixParse(string(msg.Payload))
+    
+    if err != nil {
+        return
+    }
+    
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    
+    d      := b.device(t.RootTopic, t.NodeName)
+    nodeID := ID(t.PlatformID + "-" + t.ServiceID)
+    n      := d.nodes[nodeID]
+    
+    if n == nil {
+        n = &node{id: nodeID, properties: make(map[string]*property)}
+        d.nodes[nodeID] = n
+    }
+    
+    propID  := ID(t.FeedID)
+    p       := n.properties[propID]
+    changed := false
+    
+    if p == nil {
+        p = &property{
+            id:         propID,
+            datatype:   Datatype(o.T),
+            settable:   settable(t.ServiceID),
+            root:       t.RootTopic,
+            nodename:   t.NodeName,
+            platformID: t.PlatformID,
+            serviceID:  t.ServiceID,
+            feedID:     t.FeedID,
+        }
+        
+        n.properties[propID] = p
+        changed = true
+        
+        if p.settable {
+            b.sets[b.BaseTopic + "/" + d.id + "/" + n.id + "/" + p.id + "/set"] = p
+        }
+    } else if dt := Datatype(o.T); dt != p.datatype && o.T != nil {
+        p.datatype = dt
+        changed    = true
+    }
+    
+    if changed {
+        b.publishDevice(d, t.NodeName)
+    }
+    
+    if v := Format(o.T); v != "" {
+        b.publish(d.id + "/" + n.id + "/" + p.id, v)
+    }
+}
+
+func (b *Bridge) onSet(m *mqttfabric.MqttFabric, msg *mqttfabric.Message) {
+    b.mu.Lock()
+    p := b.sets[msg.Topic]
+    b.mu.Unlock()
+    
+    if p == nil {
+        log.Println("homie: onSet(): unknown property ", msg.Topic)
+        return
+    }
+    
+    payload := strings.TrimSpace(string(msg.Payload))
+    
+    var err error
+    
+    switch p.serviceID {
+        case mqttfabric.SERVICE_ID_DIGITAL_OUT:
+            v, perr := strconv.ParseBool(payload)
+            
+            if perr != nil {
+                log.Println("homie: onSet(): not a boolean: ", payload)
+                return
+            }
+            
+            err = m.CtrlTaskRoot(p.root, p.nodename, mqttfabric.TASK_ID_DIGITAL_WRITE, p.platformID, p.serviceID, p.feedID, v)
+            
+        case mqttfabric.SERVICE_ID_ANALOG_OUT:
+            v, perr := strconv.ParseFloat(payload, 64)
+            
+            if perr != nil {
+                log.Println("homie: onSet(): not a number: ", payload)
+                return
+            }
+            
+            err = m.CtrlTaskRoot(p.root, p.nodename, mqttfabric.TASK_ID_ANALOG_WRITE, p.platformID, p.serviceID, p.feedID, int(math.Round(v)))
+            
+        case mqttfabric.SERVICE_ID_TEXT:
+            err = m.CtrlTaskRoot(p.root, p.nodename, mqttfabric.TASK_ID_RAW, p.platformID, p.serviceID, p.feedID, string(msg.Payload))
+    }
+    
+    if err != nil {
+        log.Println("homie: onSet(): err = ", err)
+    }
+}
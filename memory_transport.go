@@ -0,0 +1,356 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "sync"
+    "errors"
+    "strings"
+)
+
+// TopicMatch reports whether topic matches the subscription filter, using the
+// MQTT rules for '+' and '#'
+//
+func TopicMatch(filter string, topic string) bool {
+    f := strings.Split(filter, "/")
+    t := strings.Split(topic, "/")
+    
+    // wildcards at the first level do not match topics starting with '$'
+    if strings.HasPrefix(topic, "$") && (f[0] == "+" || f[0] == "#") {
+        return false
+    }
+    
+    for i := range f {
+        if f[i] == "#" {
+            return true
+        }
+        if i >= len(t) {
+            return false
+        }
+        if f[i] != "+" && f[i] != t[i] {
+            return false
+        }
+    }
+    
+    return len(f) == len(t)
+}
+
+// MemoryBroker is an in-process broker for simulations and tests. It supports
+// retained messages and wills but no persistent sessions
+//
+type MemoryBroker struct {
+    mu              sync.Mutex
+    clients         map[*MemoryTransport]bool
+    retained        map[string]*Message
+}
+
+// NewMemoryBroker ...
+//
+func NewMemoryBroker() *MemoryBroker {
+    return &MemoryBroker{
+        clients:    make(map[*MemoryTransport]bool),
+        retained:   make(map[string]*Message),
+    }
+}
+
+// NewTransport returns a transport connecting to b
+//
+func (b *MemoryBroker) NewTransport() *MemoryTransport {
+    return &MemoryTransport{broker: b, subs: make(map[string]byte)}
+}
+
+func (b *MemoryBroker) publish(msg *Message) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    
+    if msg.Retained {
+        if len(msg.Payload) == 0 {
+            delete(b.retained, msg.Topic)
+        } else {
+            b.retained[msg.Topic] = msg
+        }
+    }
+    
+    for c := range b.clients {
+        c.mu.Lock()
+        
+        for filter, qos := range c.subs {
+            if TopicMatch(filter, msg.Topic) {
+                if qos > msg.QoS {
+                    qos = msg.QoS
+                }
+                
+                // retained is only set for messages sent because of a subscribe
+                c.queue(&Message{Topic: msg.Topic, Payload: msg.Payload, QoS: qos, Properties: msg.Properties})
+                break
+            }
+        }
+        
+        c.mu.Unlock()
+    }
+}
+
+// MemoryTransport is a Transport connected to a MemoryBroker
+//
+type MemoryTransport struct {
+    broker          *MemoryBroker
+    mu              sync.Mutex
+    subs            map[string]byte
+    will            *Message
+    connected       bool
+    
+    pending         []*Message
+    wakeup          chan struct{}
+    done            chan struct{}
+    
+    onConnect       TransportConnectHandler
+    onLost          TransportConnectionLostHandler
+    onMessage       TransportMessageHandler
+}
+
+// queue is called with t.mu held
+func (t *MemoryTransport) queue(msg *Message) {
+    if !t.connected {
+        return
+    }
+    
+    t.pending = append(t.pending, msg)
+    
+    select {
+        case t.wakeup <- struct{}{}:
+        default:
+    }
+}
+
+// deliver calls the message handler from its own goroutine so handlers may
+// publish without deadlocking
+func (t *MemoryTransport) deliver(wakeup chan struct{}, done chan struct{}) {
+    for {
+        select {
+            case <-wakeup:
+            case <-done:
+                return
+        }
+        
+        for {
+            t.mu.Lock()
+            
+            if len(t.pending) == 0 {
+                t.mu.Unlock()
+                break
+            }
+            
+            msg      := t.pending[0]
+            t.pending = t.pending[1:]
+            
+            t.mu.Unlock()
+            
+            if t.onMessage != nil {
+                t.onMessage(msg)
+            }
+        }
+    }
+}
+
+// QueueDepth returns the number of messages waiting to be delivered
+//
+func (t *MemoryTransport) QueueDepth() int {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    
+    return len(t.pending)
+}
+
+// SetWill ...
+//
+func (t *MemoryTransport) SetWill(topic string, payload []byte, qos byte, retain bool) {
+    t.will = &Message{Topic: topic, Payload: payload, QoS: qos, Retained: retain}
+}
+
+// SetHandlers ...
+//
+func (t *MemoryTransport) SetHandlers(onConnect TransportConnectHandler, onConnectionLost TransportConnectionLostHandler, onMessage TransportMessageHandler) {
+    t.onConnect = onConnect
+    t.onLost    = onConnectionLost
+    t.onMessage = onMessage
+}
+
+// Connect ...
+//
+func (t *MemoryTransport) Connect() error {
+    t.mu.Lock()
+    
+    if t.connected {
+        t.mu.Unlock()
+        return errors.New("Connect: already connected")
+    }
+    
+    t.connected = true
+    t.pending   = nil
+    t.wakeup    = make(chan struct{}, 1)
+    t.done      = make(chan struct{})
+    
+    go t.deliver(t.wakeup, t.done)
+    
+    t.mu.Unlock()
+    
+    t.broker.mu.Lock()
+    t.broker.clients[t] = true
+    t.broker.mu.Unlock()
+    
+    if t.onConnect != nil {
+        go t.onConnect()
+    }
+    
+    return nil
+}
+
+func (t *MemoryTransport) disconnect() bool {
+    t.broker.mu.Lock()
+    delete(t.broker.clients, t)
+    t.broker.mu.Unlock()
+    
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    
+    if !t.connected {
+        return false
+    }
+    
+    t.connected = false
+    t.subs      = make(map[string]byte)
+    
+    close(t.done)
+    
+    return true
+}
+
+// Disconnect disconnects without sending the will
+//
+func (t *MemoryTransport) Disconnect(quiesce uint) {
+    t.disconnect()
+}
+
+// Drop simulates a lost connection: the will is published and the connection
+// lost handler is called
+//
+func (t *MemoryTransport) Drop() {
+    if !t.disconnect() {
+        return
+    }
+    
+    if t.will != nil {
+        t.broker.publish(t.will)
+    }
+    
+    if t.onLost != nil {
+        go t.onLost(errors.New("Drop: connection dropped"))
+    }
+}
+
+// IsConnected ...
+//
+func (t *MemoryTransport) IsConnected() bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    
+    return t.connected
+}
+
+// Publish ...
+//
+func (t *MemoryTransport) Publish(topic string, qos byte, retain bool, payload []byte) error {
+    return t.PublishProperties(topic, qos, retain, payload, nil)
+}
+
+// PublishProperties ...
+//
+func (t *MemoryTransport) PublishProperties(topic string, qos byte, retain bool, payload []byte, props *Properties) error {
+    if !t.IsConnected() {
+        return errors.New("Publish: not connected")
+    }
+    if strings.ContainsAny(topic, "+#") {
+        return errors.New("Publish: wildcard in topic")
+    }
+    
+    t.broker.publish(&Message{Topic: topic, Payload: payload, QoS: qos, Retained: retain, Properties: props})
+    
+    return nil
+}
+
+// Subscribe ...
+//
+func (t *MemoryTransport) Subscribe(topic string, qos byte) error {
+    t.mu.Lock()
+    
+    if !t.connected {
+        t.mu.Unlock()
+        return errors.New("Subscribe: not connected")
+    }
+    
+    t.subs[topic] = qos
+    
+    t.mu.Unlock()
+    
+    // send the matching retained messages
+    t.broker.mu.Lock()
+    defer t.broker.mu.Unlock()
+    
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    
+    for _, msg := range t.broker.retained {
+        if TopicMatch(topic, msg.Topic) {
+            q := qos
+            
+            if q > msg.QoS {
+                q = msg.QoS
+            }
+            
+            t.queue(&Message{Topic: msg.Topic, Payload: msg.Payload, QoS: q, Retained: true, Properties: msg.Properties})
+        }
+    }
+    
+    return nil
+}
+
+// Unsubscribe ...
+//
+func (t *MemoryTransport) Unsubscribe(topics ...string) error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    
+    if !t.connected {
+        return errors.New("Unsubscribe: not connected")
+    }
+    
+    for _, topic := range topics {
+        delete(t.subs, topic)
+    }
+    
+    return nil
+}
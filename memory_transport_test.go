@@ -0,0 +1,190 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "testing"
+    "time"
+)
+
+func TestTopicMatch(t *testing.T) {
+    cases := []struct {
+        filter, topic   string
+        match           bool
+    }{
+        {"a/b/c",   "a/b/c",    true},
+        {"a/b/c",   "a/b",      false},
+        {"a/b",     "a/b/c",    false},
+        {"a/+/c",   "a/x/c",    true},
+        {"a/+/c",   "a/x/y/c",  false},
+        {"a/+",     "a/",       true},          // an empty level is a level
+        {"+/+",     "/b",       true},
+        {"a/#",     "a",        true},          // # includes the parent level
+        {"a/#",     "a/b/c",    true},
+        {"a/#",     "b/c",      false},
+        {"#",       "a/b",      true},
+        {"#",       "$SYS/x",   false},         // wildcards don't match $ topics at the first level
+        {"+/x",     "$SYS/x",   false},
+        {"$SYS/#",  "$SYS/x",   true},
+        {"fabric/+/$feeds/$onramp/#", "fabric/dev1/$feeds/$onramp/esp/analog_in/t", true},
+    }
+    
+    for _, c := range cases {
+        if got := TopicMatch(c.filter, c.topic); got != c.match {
+            t.Errorf("TopicMatch(%q, %q) = %v, want %v", c.filter, c.topic, got, c.match)
+        }
+    }
+}
+
+// memoryClient is a connected MemoryTransport whose messages go to a channel
+//
+type memoryClient struct {
+    *MemoryTransport
+    
+    messages        chan *Message
+    lost            chan error
+}
+
+func newMemoryClient(t *testing.T, b *MemoryBroker) *memoryClient {
+    c := &memoryClient{MemoryTransport: b.NewTransport(), messages: make(chan *Message, 16), lost: make(chan error, 1)}
+    
+    c.SetHandlers(func() {}, func(err error) { c.lost <- err }, func(msg *Message) { c.messages <- msg })
+    
+    if err := c.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    
+    return c
+}
+
+func (c *memoryClient) next(t *testing.T) *Message {
+    select {
+        case msg := <-c.messages:
+            return msg
+        case <-time.After(time.Second):
+            t.Fatal("no message")
+    }
+    
+    return nil
+}
+
+func (c *memoryClient) none(t *testing.T) {
+    select {
+        case msg := <-c.messages:
+            t.Errorf("unexpected message %s %s", msg.Topic, msg.Payload)
+        case <-time.After(50 * time.Millisecond):
+    }
+}
+
+func TestMemoryBrokerRetained(t *testing.T) {
+    b := NewMemoryBroker()
+    
+    live := newMemoryClient(t, b)
+    live.Subscribe("a/#", 2)
+    
+    pub := newMemoryClient(t, b)
+    pub.Publish("a/b", 1, true, []byte("one"))
+    
+    // subscribers at the time get it without the retain flag
+    if msg := live.next(t); string(msg.Payload) != "one" || msg.Retained || msg.QoS != 1 {
+        t.Errorf("live got %s retained %v qos %d", msg.Payload, msg.Retained, msg.QoS)
+    }
+    
+    // later ones with it, at the lower QoS
+    late := newMemoryClient(t, b)
+    late.Subscribe("a/+", 0)
+    
+    if msg := late.next(t); string(msg.Payload) != "one" || !msg.Retained || msg.QoS != 0 {
+        t.Errorf("late got %s retained %v qos %d", msg.Payload, msg.Retained, msg.QoS)
+    }
+    
+    // an empty retained message clears it
+    pub.Publish("a/b", 1, true, nil)
+    
+    cleared := newMemoryClient(t, b)
+    cleared.Subscribe("a/b", 1)
+    cleared.none(t)
+    
+    if err := pub.Publish("a/+", 0, false, []byte("x")); err == nil {
+        t.Error("publish to a wildcard topic did not fail")
+    }
+}
+
+func TestMemoryBrokerWill(t *testing.T) {
+    b := NewMemoryBroker()
+    
+    watcher := newMemoryClient(t, b)
+    watcher.Subscribe("status/+", 1)
+    
+    dev := newMemoryClient(t, b)
+    dev.SetWill("status/dev", []byte("lost"), 1, true)
+    
+    // a clean disconnect doesn't send the will
+    dev.Disconnect(0)
+    watcher.none(t)
+    
+    dev = newMemoryClient(t, b)
+    dev.SetWill("status/dev", []byte("lost"), 1, true)
+    dev.Drop()
+    
+    if msg := watcher.next(t); msg.Topic != "status/dev" || string(msg.Payload) != "lost" {
+        t.Errorf("watcher got %s %s", msg.Topic, msg.Payload)
+    }
+    
+    select {
+        case <-dev.lost:
+        case <-time.After(time.Second):
+            t.Error("connection lost handler not called")
+    }
+    
+    if dev.IsConnected() {
+        t.Error("still connected after Drop")
+    }
+    if err := dev.Publish("status/dev", 0, false, []byte("x")); err == nil {
+        t.Error("publish after Drop did not fail")
+    }
+    
+    // the will was retained
+    late := newMemoryClient(t, b)
+    late.Subscribe("status/dev", 1)
+    
+    if msg := late.next(t); string(msg.Payload) != "lost" || !msg.Retained {
+        t.Errorf("late got %s retained %v", msg.Payload, msg.Retained)
+    }
+}
+
+func TestMemoryBrokerUnsubscribe(t *testing.T) {
+    b := NewMemoryBroker()
+    
+    c := newMemoryClient(t, b)
+    c.Subscribe("a/b", 0)
+    c.Unsubscribe("a/b")
+    
+    newMemoryClient(t, b).Publish("a/b", 0, false, []byte("x"))
+    
+    c.none(t)
+}
@@ -0,0 +1,149 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "time"
+    "sync/atomic"
+)
+
+// HandlerBuckets are the upper bounds in seconds of the handler latency histogram
+//
+var HandlerBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// QueueTransport is implemented by transports that queue received messages
+// before they are handled
+//
+type QueueTransport interface {
+    Transport
+    
+    QueueDepth() int
+}
+
+// ClientMetrics is a snapshot of the client counters of a MqttFabric
+//
+type ClientMetrics struct {
+    Connected       bool
+    Connects        uint64
+    Disconnects     uint64
+    Publishes       uint64
+    PublishErrors   uint64
+    Received        uint64
+    Rejected        uint64          // messages failing the signature verification or decryption
+    Denied          uint64          // tasks denied by the ACL
+    
+    HandlerCount    uint64
+    HandlerSeconds  float64         // total time spent handling messages
+    HandlerBuckets  []uint64        // cumulative counts for HandlerBuckets
+    
+    InFlight        int64           // messages being handled now
+    QueueDepth      int             // messages waiting in the transport, -1 if it can't tell
+}
+
+type clientMetrics struct {
+    connects        uint64
+    disconnects     uint64
+    publishes       uint64
+    publishErrors   uint64
+    received        uint64
+    rejected        uint64
+    denied          uint64
+    handlerCount    uint64
+    handlerNanos    uint64
+    buckets         []uint64
+    inFlight        int64
+}
+
+func (c *clientMetrics) publish(err error) {
+    atomic.AddUint64(&c.publishes, 1)
+    
+    if err != nil {
+        atomic.AddUint64(&c.publishErrors, 1)
+    }
+}
+
+func (c *clientMetrics) publishError() {
+    atomic.AddUint64(&c.publishErrors, 1)
+}
+
+// receive counts a message and returns the time handling it starts
+func (c *clientMetrics) receive() time.Time {
+    atomic.AddUint64(&c.received, 1)
+    atomic.AddInt64(&c.inFlight, 1)
+    
+    return time.Now()
+}
+
+func (c *clientMetrics) reject() {
+    atomic.AddUint64(&c.rejected, 1)
+}
+
+func (c *clientMetrics) handled(start time.Time) {
+    d := time.Since(start)
+    
+    atomic.AddInt64(&c.inFlight, -1)
+    atomic.AddUint64(&c.handlerCount, 1)
+    atomic.AddUint64(&c.handlerNanos, uint64(d))
+    
+    for i, bound := range HandlerBuckets {
+        if d.Seconds() <= bound {
+            atomic.AddUint64(&c.buckets[i], 1)
+        }
+    }
+}
+
+// Metrics returns the client counters
+//
+func (m *MqttFabric) Metrics() ClientMetrics {
+    c := &m.metrics
+    
+    r := ClientMetrics{
+        Connected:      m.Transport.IsConnected(),
+        Connects:       atomic.LoadUint64(&c.connects),
+        Disconnects:    atomic.LoadUint64(&c.disconnects),
+        Publishes:      atomic.LoadUint64(&c.publishes),
+        PublishErrors:  atomic.LoadUint64(&c.publishErrors),
+        Received:       atomic.LoadUint64(&c.received),
+        Rejected:       atomic.LoadUint64(&c.rejected),
+        Denied:         atomic.LoadUint64(&c.denied),
+        HandlerCount:   atomic.LoadUint64(&c.handlerCount),
+        HandlerSeconds: time.Duration(atomic.LoadUint64(&c.handlerNanos)).Seconds(),
+        HandlerBuckets: make([]uint64, len(c.buckets)),
+        InFlight:       atomic.LoadInt64(&c.inFlight),
+        QueueDepth:     -1,
+    }
+    
+    for i := range c.buckets {
+        r.HandlerBuckets[i] = atomic.LoadUint64(&c.buckets[i])
+    }
+    
+    if t, ok := m.Transport.(QueueTransport); ok {
+        r.QueueDepth = t.QueueDepth()
+    }
+    
+    return r
+}
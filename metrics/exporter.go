@@ -0,0 +1,248 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+// Package metrics exports the client metrics of a MqttFabric and the numeric
+// onramp feeds in the Prometheus text format
+//
+//   fabric_client_*                         connects, publishes, handler latency ...
+//   fabric_feed_value{root,node,platform,service,feed}
+//   fabric_feed_updated_seconds{...}        when the value was received
+//
+// Booleans are exported as 0 and 1, feeds with other values are left out.
+// No Prometheus client library is needed
+//
+package metrics
+
+import (
+    "io"
+    "fmt"
+    "sort"
+    "bufio"
+    "strconv"
+    "strings"
+    "net/http"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// Exporter is an http.Handler serving the metrics
+//
+type Exporter struct {
+    Fabric          *mqttfabric.MqttFabric
+    Cache           *mqttfabric.FeedCache   // the feed values, may be shared with others
+    Namespace       string                  // metric name prefix, default "fabric"
+    Services        []string                // services exported as feeds, all if empty
+}
+
+// NewExporter creates an exporter for m exporting the analog_in and digital_in
+// feeds. Call Start() before m.Start()
+//
+func NewExporter(m *mqttfabric.MqttFabric) *Exporter {
+    return &Exporter{
+        Fabric:     m,
+        Cache:      mqttfabric.NewFeedCache(),
+        Namespace:  "fabric",
+        Services:   []string{mqttfabric.SERVICE_ID_ANALOG_IN, mqttfabric.SERVICE_ID_DIGITAL_IN},
+    }
+}
+
+// Start attaches the cache
+//
+func (e *Exporter) Start() error {
+    return e.Cache.Attach(e.Fabric)
+}
+
+func formatFloat(v float64) string {
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats name/value pairs as {name="value",...}
+//
+func labels(pairs ...string) string {
+    var b strings.Builder
+    
+    b.WriteByte('{')
+    
+    for i := 0; i + 1 < len(pairs); i += 2 {
+        if i > 0 {
+            b.WriteByte(',')
+        }
+        
+        b.WriteString(pairs[i])
+        b.WriteString(`="`)
+        b.WriteString(labelEscaper.Replace(pairs[i + 1]))
+        b.WriteByte('"')
+    }
+    
+    b.WriteByte('}')
+    
+    return b.String()
+}
+
+func (e *Exporter) header(w io.Writer, name string, kind string, help string) {
+    fmt.Fprintf(w, "# HELP %s_%s %s\n# TYPE %s_%s %s\n", e.Namespace, name, help, e.Namespace, name, kind)
+}
+
+func (e *Exporter) sample(w io.Writer, name string, labels string, value float64) {
+    fmt.Fprintf(w, "%s_%s%s %s\n", e.Namespace, name, labels, formatFloat(value))
+}
+
+// WriteClient writes the client metrics
+//
+func (e *Exporter) WriteClient(w io.Writer) {
+    c := e.Fabric.Metrics()
+    
+    connected := 0.0
+    
+    if c.Connected {
+        connected = 1
+    }
+    
+    counters := []struct {
+        name    string
+        help    string
+        value   uint64
+    }{
+        {"client_connects_total",          "Connections established.",                 c.Connects},
+        {"client_disconnects_total",       "Connections lost.",                        c.Disconnects},
+        {"client_publishes_total",         "Messages published.",                      c.Publishes},
+        {"client_publish_errors_total",    "Publishes that failed.",                   c.PublishErrors},
+        {"client_messages_received_total", "Messages received.",                       c.Received},
+        {"client_messages_rejected_total", "Messages failing verification.",           c.Rejected},
+        {"client_tasks_denied_total",      "Tasks denied by the ACL.",                 c.Denied},
+    }
+    
+    e.header(w, "client_connected", "gauge", "1 if the client is connected.")
+    e.sample(w, "client_connected", "", connected)
+    
+    for _, counter := range counters {
+        e.header(w, counter.name, "counter", counter.help)
+        e.sample(w, counter.name, "", float64(counter.value))
+    }
+    
+    e.header(w, "client_handler_seconds", "histogram", "Time spent handling received messages.")
+    
+    for i, bound := range mqttfabric.HandlerBuckets {
+        e.sample(w, "client_handler_seconds_bucket", labels("le", formatFloat(bound)), float64(c.HandlerBuckets[i]))
+    }
+    
+    e.sample(w, "client_handler_seconds_bucket", labels("le", "+Inf"), float64(c.HandlerCount))
+    e.sample(w, "client_handler_seconds_sum", "", c.HandlerSeconds)
+    e.sample(w, "client_handler_seconds_count", "", float64(c.HandlerCount))
+    
+    e.header(w, "client_handlers_in_flight", "gauge", "Messages being handled.")
+    e.sample(w, "client_handlers_in_flight", "", float64(c.InFlight))
+    
+    if c.QueueDepth >= 0 {
+        e.header(w, "client_queue_depth", "gauge", "Received messages waiting to be handled.")
+        e.sample(w, "client_queue_depth", "", float64(c.QueueDepth))
+    }
+}
+
+func (e *Exporter) exported(serviceID string) bool {
+    if len(e.Services) == 0 {
+        return true
+    }
+    
+    for _, s := range e.Services {
+        if s == serviceID {
+            return true
+        }
+    }
+    
+    return false
+}
+
+// WriteFeeds writes the numeric feeds
+//
+func (e *Exporter) WriteFeeds(w io.Writer) {
+    values := e.Cache.Snapshot(mqttfabric.FeedFilter{})
+    
+    sort.Slice(values, func(i, j int) bool {
+        return values[i].Topic < values[j].Topic
+    })
+    
+    type sample struct {
+        labels  string
+        value   float64
+        updated float64
+    }
+    
+    var samples []sample
+    
+    for _, v := range values {
+        if !e.exported(v.ServiceID) {
+            continue
+        }
+        
+        n, ok := mqttfabric.NumericValue(v.Value)
+        
+        if !ok {
+            continue
+        }
+        
+        var updated float64
+        
+        if !v.Time.IsZero() {
+            updated = float64(v.Time.UnixNano()) / 1e9
+        }
+        
+        samples = append(samples, sample{
+            labels:     labels("root", v.RootTopic, "node", v.NodeName, "platform", v.PlatformID, "service", v.ServiceID, "feed", v.FeedID),
+            value:      n,
+            updated:    updated,
+        })
+    }
+    
+    e.header(w, "feed_value", "gauge", "Last value of an onramp feed.")
+    
+    for _, s := range samples {
+        e.sample(w, "feed_value", s.labels, s.value)
+    }
+    
+    e.header(w, "feed_updated_seconds", "gauge", "When the last value of an onramp feed was received, seconds since the epoch.")
+    
+    for _, s := range samples {
+        // retained values of unknown age
+        if s.updated > 0 {
+            e.sample(w, "feed_updated_seconds", s.labels, s.updated)
+        }
+    }
+}
+
+// ServeHTTP ...
+//
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    
+    bw := bufio.NewWriter(w)
+    
+    e.WriteClient(bw)
+    e.WriteFeeds(bw)
+    
+    bw.Flush()
+}
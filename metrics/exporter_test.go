@@ -0,0 +1,95 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package metrics
+
+import (
+    "io/ioutil"
+    "log"
+    "os"
+    "strings"
+    "testing"
+    "time"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+func TestWriteFeedsKeepsFractions(t *testing.T) {
+    log.SetOutput(ioutil.Discard)
+    t.Cleanup(func() { log.SetOutput(os.Stderr) })
+    
+    broker := mqttfabric.NewMemoryBroker()
+    
+    connected := make(chan bool, 2)
+    
+    ctrl := mqttfabric.MqttFabricInitializeTransport(broker.NewTransport(), "fabric", "ctl", "pc", mqttfabric.CONTROLLER)
+    ctrl.SetOnConnectHandler(func(m *mqttfabric.MqttFabric) { connected <- true })
+    e    := NewExporter(ctrl)
+    
+    if err := e.Start(); err != nil {
+        t.Fatal(err)
+    }
+    
+    ctrl.Start()
+    defer ctrl.Stop()
+    
+    dev := mqttfabric.MqttFabricInitializeTransport(broker.NewTransport(), "fabric", "dev1", "esp", mqttfabric.DEVICE)
+    dev.SetOnConnectHandler(func(m *mqttfabric.MqttFabric) { connected <- true })
+    dev.Start()
+    defer dev.Stop()
+    
+    for i := 0; i < 2; i++ {
+        select {
+            case <-connected:
+            case <-time.After(time.Second):
+                t.Fatal("not connected")
+        }
+    }
+    
+    if err := dev.DevicePub(mqttfabric.SERVICE_ID_ANALOG_IN, "temp", 21.7); err != nil {
+        t.Fatal(err)
+    }
+    dev.DevicePub(mqttfabric.SERVICE_ID_ANALOG_IN, "count", 3)
+    
+    var out strings.Builder
+    
+    for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+        out.Reset()
+        e.WriteFeeds(&out)
+        
+        if strings.Contains(out.String(), `feed="temp"`) && strings.Contains(out.String(), `feed="count"`) {
+            break
+        }
+    }
+    
+    for _, want := range []string{
+        `fabric_feed_value{root="fabric",node="dev1",platform="esp",service="analog_in",feed="temp"} 21.7`,
+        `fabric_feed_value{root="fabric",node="dev1",platform="esp",service="analog_in",feed="count"} 3`,
+    } {
+        if !strings.Contains(out.String(), want + "\n") {
+            t.Errorf("missing %s in\n%s", want, out.String())
+        }
+    }
+}
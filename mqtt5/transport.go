@@ -0,0 +1,493 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+// Package mqtt5 is an MQTT 5 transport for the fabric using paho.golang
+//
+// Fabric concepts are mapped to MQTT 5 features:
+//
+//   - offramp tasks carry a response topic (the onramp topic of the result)
+//     and correlation data, which the device echoes in the value it publishes
+//     while handling the task
+//   - actor and platform id's are sent as user properties
+//   - momentary writes expire after MqttFabric.MomentaryExpiry seconds
+//   - reason codes from the broker are returned as *ReasonCodeError
+//
+// The connection is managed by autopaho, which reconnects when it is lost.
+// The package is built against github.com/eclipse/paho.golang v0.23.0
+//
+package mqtt5
+
+import (
+    "log"
+    "net"
+    "sort"
+    "time"
+    "sync"
+    "errors"
+    "strconv"
+    "context"
+    "net/url"
+    "github.com/eclipse/paho.golang/paho"
+    "github.com/eclipse/paho.golang/autopaho"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// ReasonCodeError is returned when the broker answers with a failure reason code
+//
+type ReasonCodeError struct {
+    Op              string
+    Code            byte
+    Reason          string
+}
+
+func (e *ReasonCodeError) Error() string {
+    s := e.Op + ": reason code 0x" + strconv.FormatUint(uint64(e.Code), 16)
+    
+    if e.Reason != "" {
+        s += " (" + e.Reason + ")"
+    }
+    
+    return s
+}
+
+func reasonCodeError(op string, code byte, reason string) error {
+    if code < 0x80 {
+        return nil
+    }
+    
+    return &ReasonCodeError{Op: op, Code: code, Reason: reason}
+}
+
+// Transport implements mqttfabric.PropertiesTransport
+//
+type Transport struct {
+    Broker          string          // host:port
+    ClientID        string
+    KeepAlive       uint16          // seconds
+    Username        string
+    Password        []byte
+    Timeout         time.Duration   // for connect, publish and subscribe
+    RetryDelay      time.Duration   // between connection attempts
+    
+    cm              *autopaho.ConnectionManager
+    will            *paho.WillMessage
+    connected       bool
+    mu              sync.Mutex
+    queue           chan *mqttfabric.Message
+    done            chan struct{}
+    
+    onConnect       mqttfabric.TransportConnectHandler
+    onLost          mqttfabric.TransportConnectionLostHandler
+    onMessage       mqttfabric.TransportMessageHandler
+}
+
+// NewTransport ...
+//
+func NewTransport(broker string, port int, keepalive int, clientID string) *Transport {
+    return &Transport{
+        Broker:     net.JoinHostPort(broker, strconv.Itoa(port)),
+        ClientID:   clientID,
+        KeepAlive:  uint16(keepalive),
+        Timeout:    10 * time.Second,
+        RetryDelay: 5 * time.Second,
+    }
+}
+
+// SetWill ...
+//
+func (t *Transport) SetWill(topic string, payload []byte, qos byte, retain bool) {
+    t.will = &paho.WillMessage{Topic: topic, Payload: payload, QoS: qos, Retain: retain}
+}
+
+// SetHandlers ...
+//
+func (t *Transport) SetHandlers(onConnect mqttfabric.TransportConnectHandler, onConnectionLost mqttfabric.TransportConnectionLostHandler, onMessage mqttfabric.TransportMessageHandler) {
+    t.onConnect = onConnect
+    t.onLost    = onConnectionLost
+    t.onMessage = onMessage
+}
+
+// Connect connects to the broker and returns once the first connection is up
+// or Timeout has passed. Lost connections are re-established in the background
+// and the connect handler is called again every time
+//
+func (t *Transport) Connect() error {
+    u, err := url.Parse("mqtt://" + t.Broker)
+    
+    if err != nil {
+        return err
+    }
+    
+    // messages are handed to the fabric from a separate goroutine so handlers
+    // may publish without blocking the client's reader
+    queue := make(chan *mqttfabric.Message, 256)
+    done  := make(chan struct{})
+    
+    t.mu.Lock()
+    t.queue = queue
+    t.done  = done
+    t.mu.Unlock()
+    
+    go func() {
+        for {
+            select {
+                case msg := <-queue:
+                    if t.onMessage != nil {
+                        t.onMessage(msg)
+                    }
+                case <-done:
+                    return
+            }
+        }
+    }()
+    
+    cfg := autopaho.ClientConfig{
+        ServerUrls:                     []*url.URL{u},
+        KeepAlive:                      t.KeepAlive,
+        CleanStartOnInitialConnection:  true,
+        ConnectRetryDelay:              t.RetryDelay,
+        ConnectTimeout:                 t.Timeout,
+        WillMessage:                    t.will,
+        OnConnectionUp: func(cm *autopaho.ConnectionManager, ca *paho.Connack) {
+            // set here, the connect handler publishes before AwaitConnection returns
+            t.mu.Lock()
+            t.cm        = cm
+            t.connected = true
+            t.mu.Unlock()
+            
+            if t.onConnect != nil {
+                go t.onConnect()
+            }
+        },
+        OnConnectionDown: func() bool {
+            t.lost(errors.New("connection lost"))
+            return true
+        },
+        OnConnectError: func(err error) {
+            log.Println("mqtt5: connect; ", err)
+        },
+        ClientConfig: paho.ClientConfig{
+            ClientID:           t.ClientID,
+            OnPublishReceived:  []func(paho.PublishReceived) (bool, error){
+                func(pr paho.PublishReceived) (bool, error) {
+                    select {
+                        case queue <- fromPublish(pr.Packet):
+                        case <-done:
+                    }
+                    return true, nil
+                },
+            },
+            OnServerDisconnect: func(d *paho.Disconnect) {
+                reason := ""
+                
+                if d.Properties != nil {
+                    reason = d.Properties.ReasonString
+                }
+                
+                log.Println("mqtt5: disconnected by server; ", &ReasonCodeError{Op: "Disconnect", Code: d.ReasonCode, Reason: reason})
+            },
+        },
+    }
+    
+    if t.Username != "" {
+        cfg.ConnectUsername = t.Username
+        cfg.ConnectPassword = t.Password
+    }
+    
+    cm, err := autopaho.NewConnection(context.Background(), cfg)
+    
+    if err != nil {
+        close(done)
+        return err
+    }
+    
+    ctx, cancel := context.WithTimeout(context.Background(), t.Timeout)
+    defer cancel()
+    
+    if err := cm.AwaitConnection(ctx); err != nil {
+        t.mu.Lock()
+        t.cm        = nil
+        t.connected = false
+        t.mu.Unlock()
+        
+        cm.Disconnect(context.Background())
+        close(done)
+        return err
+    }
+    
+    return nil
+}
+
+func (t *Transport) lost(err error) {
+    t.mu.Lock()
+    wasConnected := t.connected
+    t.connected   = false
+    t.mu.Unlock()
+    
+    if wasConnected {
+        log.Println("mqtt5: connection lost; ", err)
+        
+        if t.onLost != nil {
+            t.onLost(err)
+        }
+    }
+}
+
+// Disconnect ...
+//
+func (t *Transport) Disconnect(quiesce uint) {
+    time.Sleep(time.Duration(quiesce) * time.Millisecond)
+    
+    t.mu.Lock()
+    cm         := t.cm
+    done       := t.done
+    t.cm        = nil
+    t.done      = nil
+    t.connected = false
+    t.mu.Unlock()
+    
+    if cm == nil {
+        return
+    }
+    
+    ctx, cancel := context.WithTimeout(context.Background(), t.Timeout)
+    defer cancel()
+    
+    cm.Disconnect(ctx)
+    
+    if done != nil {
+        close(done)
+    }
+}
+
+// conn returns the connection manager while connected, nil otherwise
+//
+func (t *Transport) conn() *autopaho.ConnectionManager {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    
+    if !t.connected {
+        return nil
+    }
+    
+    return t.cm
+}
+
+// QueueDepth returns the number of received messages waiting for the handler
+//
+func (t *Transport) QueueDepth() int {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    
+    return len(t.queue)
+}
+
+// IsConnected ...
+//
+func (t *Transport) IsConnected() bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    
+    return t.connected
+}
+
+// Publish ...
+//
+func (t *Transport) Publish(topic string, qos byte, retain bool, payload []byte) error {
+    return t.PublishProperties(topic, qos, retain, payload, nil)
+}
+
+// PublishProperties ...
+//
+func (t *Transport) PublishProperties(topic string, qos byte, retain bool, payload []byte, props *mqttfabric.Properties) error {
+    cm := t.conn()
+    
+    if cm == nil {
+        return errors.New("PublishProperties: not connected")
+    }
+    
+    ctx, cancel := context.WithTimeout(context.Background(), t.Timeout)
+    defer cancel()
+    
+    pr, err := cm.Publish(ctx, &paho.Publish{
+        Topic:      topic,
+        QoS:        qos,
+        Retain:     retain,
+        Payload:    payload,
+        Properties: toPublishProperties(props),
+    })
+    
+    if err != nil {
+        return err
+    }
+    
+    if pr != nil {
+        reason := ""
+        
+        if pr.Properties != nil {
+            reason = pr.Properties.ReasonString
+        }
+        
+        return reasonCodeError("Publish", pr.ReasonCode, reason)
+    }
+    
+    return nil
+}
+
+// Subscribe ...
+//
+func (t *Transport) Subscribe(topic string, qos byte) error {
+    cm := t.conn()
+    
+    if cm == nil {
+        return errors.New("Subscribe: not connected")
+    }
+    
+    ctx, cancel := context.WithTimeout(context.Background(), t.Timeout)
+    defer cancel()
+    
+    sa, err := cm.Subscribe(ctx, &paho.Subscribe{
+        Subscriptions: []paho.SubscribeOptions{
+            {Topic: topic, QoS: qos},
+        },
+    })
+    
+    if err != nil {
+        return err
+    }
+    
+    for _, code := range sa.Reasons {
+        if rerr := reasonCodeError("Subscribe", code, ""); rerr != nil {
+            return rerr
+        }
+    }
+    
+    return nil
+}
+
+// Unsubscribe ...
+//
+func (t *Transport) Unsubscribe(topics ...string) error {
+    cm := t.conn()
+    
+    if cm == nil {
+        return errors.New("Unsubscribe: not connected")
+    }
+    
+    ctx, cancel := context.WithTimeout(context.Background(), t.Timeout)
+    defer cancel()
+    
+    ua, err := cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+    
+    if err != nil {
+        return err
+    }
+    
+    for _, code := range ua.Reasons {
+        if rerr := reasonCodeError("Unsubscribe", code, ""); rerr != nil {
+            return rerr
+        }
+    }
+    
+    return nil
+}
+
+func toPublishProperties(props *mqttfabric.Properties) *paho.PublishProperties {
+    if props == nil {
+        return nil
+    }
+    
+    pp := &paho.PublishProperties{
+        ResponseTopic:      props.ResponseTopic,
+        CorrelationData:    props.CorrelationData,
+    }
+    
+    if props.MessageExpiry > 0 {
+        expiry := props.MessageExpiry
+        pp.MessageExpiry = &expiry
+    }
+    
+    keys := make([]string, 0, len(props.UserProperties))
+    
+    for k := range props.UserProperties {
+        keys = append(keys, k)
+    }
+    
+    sort.Strings(keys)
+    
+    for _, k := range keys {
+        pp.User = append(pp.User, paho.UserProperty{Key: k, Value: props.UserProperties[k]})
+    }
+    
+    return pp
+}
+
+func fromPublish(p *paho.Publish) *mqttfabric.Message {
+    msg := &mqttfabric.Message{Topic: p.Topic, Payload: p.Payload, QoS: p.QoS, Retained: p.Retain}
+    
+    if p.Properties != nil {
+        props := &mqttfabric.Properties{
+            ResponseTopic:      p.Properties.ResponseTopic,
+            CorrelationData:    p.Properties.CorrelationData,
+            UserProperties:     map[string]string{},
+        }
+        
+        if p.Properties.MessageExpiry != nil {
+            props.MessageExpiry = *p.Properties.MessageExpiry
+        }
+        
+        for _, u := range p.Properties.User {
+            props.UserProperties[u.Key] = u.Value
+        }
+        
+        msg.Properties = props
+    }
+    
+    return msg
+}
+
+// NewFromConfig creates an MqttFabric using an MQTT 5 transport
+//
+func NewFromConfig(c *mqttfabric.Config) (*mqttfabric.MqttFabric, error) {
+    if err := c.Validate(); err != nil {
+        return nil, err
+    }
+    
+    clientid := c.ClientID
+    
+    if clientid == "" {
+        clientid = mqttfabric.DefaultClientID()
+    }
+    
+    t := NewTransport(c.Broker, c.Port, c.KeepAlive, clientid)
+    
+    if c.Username != "" {
+        t.Username = c.Username
+        t.Password = []byte(c.Password)
+    }
+    
+    return mqttfabric.NewFromConfigTransport(c, t)
+}
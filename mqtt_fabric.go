@@ -27,14 +27,15 @@
 package mqttfabric
 
 import (
+    "fmt"
     "log"
     "time"
     "strconv"
     "os"
-    "strings"
-    "unsafe"
-    "encoding/json"
-    MQTT "github.com/mikejac/paho.mqtt.golang"  // import the Paho Go MQTT library
+    "sync"
+    "errors"
+    "sync/atomic"
+    MQTT "github.com/eclipse/paho.mqtt.golang"  // import the Paho Go MQTT library
 )
 
 // OnConnectHandler ...
@@ -58,40 +59,71 @@ type OnOfframpHandler func( mqtt            *MqttFabric,
                             serviceID       string,
                             feedID          string,
                             msg             string)
+// OnRootOnrampHandler ...
+type OnRootOnrampHandler func(  mqtt            *MqttFabric,
+                                topic           *FabricTopic,
+                                msg             string)
+// OnRootOfframpHandler ...
+type OnRootOfframpHandler func( mqtt            *MqttFabric,
+                                topic           *FabricTopic,
+                                msg             string)
                             
 // MqttFabric ...
 //
 type MqttFabric struct {
-    Options         *MQTT.ClientOptions
-    Mqtt            *MQTT.Client
+    Options         *MQTT.ClientOptions     // nil unless the Paho transport is used
+    Mqtt            MQTT.Client             // nil unless the Paho transport is used
+    Transport       Transport
     F               *Fabric
+    Roots           []*Fabric       // Roots[0] is F
     StartTime       time.Time
     OnConnect       OnConnectHandler
     OnDisconnect    OnDisconnectHandler
     OnOnramp        OnOnrampHandler
     OnOfframp       OnOfframpHandler
+    OnRootOnramp    OnRootOnrampHandler
+    OnRootOfframp   OnRootOfframpHandler
+    OnDescriptor    OnDescriptorHandler
+    OnTaskError     OnTaskErrorHandler
+    MomentaryExpiry uint32          // MQTT 5 message expiry for momentary writes, seconds
+    Policies        map[string]Policy
+    DefaultPolicy   Policy
+    Tracer          *Tracer         // nil disables tracing
+    Signing         *Signing        // nil disables signing and verification
+    Encryption      *Encryption     // nil disables encryption
+    ACL             *ACL            // tasks sent to this node, nil allows all
+    
+    correlation     uint64
+    replies         taskReplies
+    descriptor      *Descriptor
+    registry        descriptorRegistry
+    subscriptions   []*subscription
+    subscriptionsMu sync.Mutex
+    metrics         clientMetrics
+    tracing         tracing
 }
 
 // Initialize ...
 //
 func MqttFabricInitialize(broker string, port int, keepalive int, rootTopic string, nodename string, platformID string, classType ClassType) *MqttFabric {
-    m := &MqttFabric{}
-
-    m.StartTime     = time.Now()
-    m.OnConnect     = nil
-    m.OnDisconnect  = nil
-    m.OnOnramp      = nil
-    m.OnOfframp     = nil
+    opts := pahoOptions(broker, port, keepalive, DefaultClientID())
     
-    m.F = FabricInitialize(rootTopic, nodename, platformID, classType)
-    var lwtTopic, lwtMsg = m.F.StatusMessage(FABRIC_DISCONNECTED, 0)
+    m := MqttFabricInitializeTransport(NewPahoTransport(opts), rootTopic, nodename, platformID, classType)
     
-    log.Println(lwtTopic)
-    log.Println(lwtMsg)
+    m.Options = opts
     
+    return m
+}
+
+// DefaultClientID returns the client id used when none is configured
+//
+func DefaultClientID() (string) {
     hostname, _ := os.Hostname()
-    clientid    := hostname + strconv.Itoa(time.Now().Second())
     
+    return hostname + strconv.Itoa(time.Now().Second())
+}
+
+func pahoOptions(broker string, port int, keepalive int, clientid string) *MQTT.ClientOptions {
     log.Printf("Initialize(): clientid = %s\n", clientid)
     
   	// create a ClientOptions struct setting the broker address, clientid, turn
@@ -99,14 +131,46 @@ func MqttFabricInitialize(broker string, port int, keepalive int, rootTopic stri
   	opts := MQTT.NewClientOptions().AddBroker("tcp://" + broker + ":" + strconv.Itoa(port))
   	opts.SetClientID(clientid)
     opts.SetCleanSession(true)
-    opts.SetDefaultPublishHandler(onMessage)
-    opts.SetOnConnectHandler(onConnect)
-    opts.SetConnectionLostHandler(onDisconnect)
     opts.SetKeepAlive(time.Duration(keepalive) * time.Second)
-    opts.SetWill(lwtTopic, lwtMsg, 2, true)
-    opts.SetUserData((unsafe.Pointer)(m))
     
-    m.Options = opts
+    return opts
+}
+
+// MqttFabricInitializeTransport ...
+//
+func MqttFabricInitializeTransport(transport Transport, rootTopic string, nodename string, platformID string, classType ClassType) *MqttFabric {
+    m := &MqttFabric{}
+
+    m.Transport     = transport
+    m.StartTime     = time.Now()
+    m.OnConnect     = nil
+    m.OnDisconnect  = nil
+    m.OnOnramp      = nil
+    m.OnOfframp     = nil
+    m.OnRootOnramp  = nil
+    m.OnRootOfframp = nil
+    
+    m.MomentaryExpiry = 5
+    m.Policies        = make(map[string]Policy)
+    m.DefaultPolicy   = Policy{QoS: 0, Retain: false}
+    
+    m.SetPolicy(FABRIC_SYS, FABRIC_CMD_STATUS, 2, true)
+    m.SetPolicy(FABRIC_SYS, FABRIC_CMD_DESCRIPTOR, 1, true)
+    m.SetPolicy(FABRIC_SYS, FABRIC_CMD_TASK_ERROR, 1, false)
+    
+    m.registry.descriptors = make(map[string]*Descriptor)
+    m.metrics.buckets      = make([]uint64, len(HandlerBuckets))
+    
+    if t, ok := transport.(*PahoTransport); ok && t.OnPublishError == nil {
+        t.OnPublishError = func(err error) {
+            m.metrics.publishError()
+        }
+    }
+    
+    m.F     = FabricInitialize(rootTopic, nodename, platformID, classType)
+    m.Roots = []*Fabric{m.F}
+    
+    transport.SetHandlers(m.onConnect, m.onDisconnect, m.onMessage)
     
     return m
 }
@@ -139,15 +203,96 @@ func (m *MqttFabric) SetOnOfframpHandler(handler OnOfframpHandler) *MqttFabric {
 	return m
 }
 
+// SetOnRootOnrampHandler ...
+//
+func (m *MqttFabric) SetOnRootOnrampHandler(handler OnRootOnrampHandler) *MqttFabric {
+    m.OnRootOnramp = handler
+    return m
+}
+
+// SetOnRootOfframpHandler ...
+//
+func (m *MqttFabric) SetOnRootOfframpHandler(handler OnRootOfframpHandler) *MqttFabric {
+    m.OnRootOfframp = handler
+    return m
+}
+
+// AddRoot adds another root topic served over the same connection. The node
+// uses the same nodename, platform id and class type under every root. Note
+// that the LWT can only be set for one topic, so only the primary root gets
+// the 'disconnected' status when the connection is lost. Stop() publishes
+// 'offline' under every root, but after a crash the status under the added
+// roots stays 'online' until the node connects again
+//
+func (m *MqttFabric) AddRoot(rootTopic string) *Fabric {
+    if f := m.Root(rootTopic); f != nil {
+        return f
+    }
+    
+    f := FabricInitialize(rootTopic, m.F.NodeName, m.F.PlatformID, m.F.ClassType)
+    
+    m.Roots = append(m.Roots, f)
+    
+    return f
+}
+
+// Root returns the Fabric for rootTopic or nil if it has not been added
+//
+func (m *MqttFabric) Root(rootTopic string) *Fabric {
+    for _, f := range m.Roots {
+        if f.RootTopic == rootTopic {
+            return f
+        }
+    }
+    
+    return nil
+}
+
+// SubscribeAll subscribes to the topic returned by topicFn under every root
+//
+func (m *MqttFabric) SubscribeAll(qos byte, topicFn func(f *Fabric) string) {
+    for _, f := range m.Roots {
+        topic := topicFn(f)
+        
+        log.Println(topic)
+        
+        if err := m.Transport.Subscribe(topic, qos); err != nil {
+            log.Println("SubscribeAll(): err = ", err)
+        }
+    }
+}
+
+// ParseTopic splits topic into its fabric parts using the longest matching root
+//
+func (m *MqttFabric) ParseTopic(topic string) (*FabricTopic, error) {
+    roots := make([]string, len(m.Roots))
+    
+    for i, f := range m.Roots {
+        roots[i] = f.RootTopic
+    }
+    
+    return ParseTopicRoots(roots, topic)
+}
+
 // Start ...
 //
 func (m *MqttFabric) Start() (bool) {
+    var lwtTopic, lwtMsg = m.F.StatusMessage(FABRIC_DISCONNECTED, 0)
+    var policy           = m.Policy(FABRIC_SYS, FABRIC_CMD_STATUS)
+    
+    log.Println(lwtTopic)
+    log.Println(lwtMsg)
+    
+    m.Transport.SetWill(lwtTopic, []byte(lwtMsg), policy.QoS, policy.Retain)
+    
     // create and start a client
-    m.Mqtt = MQTT.NewClient(m.Options)
-
-    if token := m.Mqtt.Connect(); token.Wait() && token.Error() != nil {
-        panic(token.Error())
+    if err := m.Transport.Connect(); err != nil {
+        panic(err)
   	}
+    
+    if t, ok := m.Transport.(*PahoTransport); ok {
+        m.Mqtt = t.Client
+    }
       
     return true
 }
@@ -155,14 +300,92 @@ func (m *MqttFabric) Start() (bool) {
 // Stop ...
 //
 func (m *MqttFabric) Stop() {
-    var topic, msg = m.F.StatusMessage(FABRIC_OFFLINE, time.Now().Unix() - m.StartTime.Unix())
+    var policy = m.Policy(FABRIC_SYS, FABRIC_CMD_STATUS)
+    
+    for _, f := range m.Roots {
+        var topic, msg = f.StatusMessage(FABRIC_OFFLINE, time.Now().Unix() - m.StartTime.Unix())
+        
+        m.Publish(topic, policy.QoS, policy.Retain, []byte(msg))
+        
+        log.Println(topic)
+        log.Println(msg)
+    }
     
-    m.Mqtt.Publish(topic, 2, true, msg)
+    m.Transport.Disconnect(250)
+}
+
+// Publish ...
+//
+func (m *MqttFabric) Publish(topic string, qos byte, retain bool, payload []byte) error {
+    err := m.Transport.Publish(topic, qos, retain, payload)
     
-    log.Println(topic)
-    log.Println(msg)
+    m.metrics.publish(err)
+    
+    return err
+}
+
+// PublishProperties publishes with MQTT 5 properties if the transport supports
+// them, otherwise the properties are dropped
+//
+func (m *MqttFabric) PublishProperties(topic string, qos byte, retain bool, payload []byte, props *Properties) error {
+    var err error
+    
+    if t, ok := m.Transport.(PropertiesTransport); ok && props != nil {
+        err = t.PublishProperties(topic, qos, retain, payload, props)
+    } else {
+        err = m.Transport.Publish(topic, qos, retain, payload)
+    }
     
-    m.Mqtt.Disconnect(250)
+    m.metrics.publish(err)
+    
+    return err
+}
+
+// TaskProperties returns the MQTT 5 properties for an offramp task. The response
+// topic is the onramp topic where the device publishes the result of the task
+//
+func (m *MqttFabric) TaskProperties(nodename string, taskID string, platformID string, serviceID string, feedID string) *Properties {
+    return m.taskProperties(m.F, nodename, taskID, platformID, serviceID, feedID)
+}
+
+func (m *MqttFabric) taskProperties(f *Fabric, nodename string, taskID string, platformID string, serviceID string, feedID string) *Properties {
+    props := &Properties{
+        ResponseTopic:      f.CtrlOnrampSubscription(nodename, platformID, serviceID, feedID),
+        CorrelationData:    []byte(m.F.NodeName + "-" + strconv.FormatUint(atomic.AddUint64(&m.correlation, 1), 10)),
+        UserProperties:     map[string]string{
+            PROPERTY_ACTOR_ID:          m.F.ActorID,
+            PROPERTY_ACTOR_PLATFORM_ID: m.F.ActorPlatformID,
+        },
+    }
+    
+    if taskID == TASK_ID_DIGITAL_WRITE_MOMENTARY || taskID == TASK_ID_DIGITAL_WRITE_MOMENTARY_EX {
+        props.MessageExpiry = m.MomentaryExpiry
+    }
+    
+    return props
+}
+
+// DeviceProperties returns the MQTT 5 properties for an onramp value
+//
+func (m *MqttFabric) DeviceProperties() *Properties {
+    return &Properties{
+        UserProperties: map[string]string{
+            PROPERTY_NODENAME:      m.F.NodeName,
+            PROPERTY_PLATFORM_ID:   m.F.PlatformID,
+        },
+    }
+}
+
+// Subscribe ...
+//
+func (m *MqttFabric) Subscribe(topic string, qos byte) error {
+    return m.Transport.Subscribe(topic, qos)
+}
+
+// Unsubscribe ...
+//
+func (m *MqttFabric) Unsubscribe(topics ...string) error {
+    return m.Transport.Unsubscribe(topics...)
 }
 
 // Run ...
@@ -180,29 +403,25 @@ func (m *MqttFabric) Run() {
 // CtrlPubText ...
 //
 func (m *MqttFabric) CtrlPubText(nodename string, platformID string, feedID string, data string, qos byte, retain bool) {
-    topic := m.F.CtrlOfframpTopic(nodename, TASK_ID_RAW, platformID, SERVICE_ID_TEXT, feedID)
-    
-    log.Println(topic)
+    m.CtrlPubTextRoot(m.F.RootTopic, nodename, platformID, feedID, data, qos, retain)
+}
+
+// CtrlPubTextRoot is CtrlPubText under rootTopic, which must have been added
+// with AddRoot() unless it is the primary root
+//
+func (m *MqttFabric) CtrlPubTextRoot(rootTopic string, nodename string, platformID string, feedID string, data string, qos byte, retain bool) {
+    f := m.Root(rootTopic)
     
-    type Data struct {
-        Type        string `json:"_type"`
-        FeedID      string `json:"feed_id"`
-        Value       string `json:"value"`
+    if f == nil {
+        log.Println("CtrlPubText(): unknown root topic ", rootTopic)
+        return
     }
     
-    type D struct {
-        Data Data `json:"d"`
-    }
+    topic := f.CtrlOfframpTopic(nodename, TASK_ID_RAW, platformID, SERVICE_ID_TEXT, feedID)
     
-	jsonMsg := D{
-		Data: Data{
-			Type:       SERVICE_ID_TEXT,
-            FeedID:     feedID,
-            Value:      data,
-		},
-	}
+    log.Println(topic)
     
-    msg, err := json.Marshal(jsonMsg)
+    msg, err := m.encode(topic, SERVICE_ID_TEXT, feedID, data, "")
     
 	if err != nil {
 		log.Println("CtrlPubText(): err = ", err)
@@ -211,35 +430,31 @@ func (m *MqttFabric) CtrlPubText(nodename string, platformID string, feedID stri
     
     log.Println(string(msg))
     
-    m.Mqtt.Publish(topic, qos, retain, msg)
+    m.PublishProperties(topic, qos, retain, msg, m.taskProperties(f, nodename, TASK_ID_RAW, platformID, SERVICE_ID_TEXT, feedID))
 }
 
 // DevicePubText ...
 //
 func (m *MqttFabric) DevicePubText(feedID string, data string, qos byte, retain bool) {
-    topic := m.F.DeviceOnrampTopic(SERVICE_ID_TEXT, feedID)
-    
-    log.Println(topic)
+    m.DevicePubTextRoot(m.F.RootTopic, feedID, data, qos, retain)
+}
+
+// DevicePubTextRoot is DevicePubText under rootTopic, which must have been
+// added with AddRoot() unless it is the primary root
+//
+func (m *MqttFabric) DevicePubTextRoot(rootTopic string, feedID string, data string, qos byte, retain bool) {
+    f := m.Root(rootTopic)
     
-    type Data struct {
-        Type        string `json:"_type"`
-        FeedID      string `json:"feed_id"`
-        Value       string `json:"value"`
+    if f == nil {
+        log.Println("DevicePubText(): unknown root topic ", rootTopic)
+        return
     }
     
-    type D struct {
-        Data Data `json:"d"`
-    }
+    topic := f.DeviceOnrampTopic(SERVICE_ID_TEXT, feedID)
     
-	jsonMsg := D{
-		Data: Data{
-			Type:       SERVICE_ID_TEXT,
-            FeedID:     feedID,
-            Value:      data,
-		},
-	}
+    log.Println(topic)
     
-    msg, err := json.Marshal(jsonMsg)
+    msg, err := m.encode(topic, SERVICE_ID_TEXT, feedID, data, "")
     
 	if err != nil {
 		log.Println("DevicePubText(): err = ", err)
@@ -248,115 +463,302 @@ func (m *MqttFabric) DevicePubText(feedID string, data string, qos byte, retain
     
     log.Println(string(msg))
     
-    m.Mqtt.Publish(topic, qos, retain, msg)
+    m.PublishProperties(topic, qos, retain, msg, m.DeviceProperties())
+}
+
+// CtrlTask sends an offramp task to nodename using the policy for serviceID/feedID
+//
+func (m *MqttFabric) CtrlTask(nodename string, taskID string, platformID string, serviceID string, feedID string, value interface{}) error {
+    return m.CtrlTaskRoot(m.F.RootTopic, nodename, taskID, platformID, serviceID, feedID, value)
+}
+
+// CtrlTaskRoot sends an offramp task to nodename under rootTopic, which must
+// have been added with AddRoot() unless it is the primary root
+//
+func (m *MqttFabric) CtrlTaskRoot(rootTopic string, nodename string, taskID string, platformID string, serviceID string, feedID string, value interface{}) error {
+    return m.CtrlTaskTrace(SpanContext{}, rootTopic, nodename, taskID, platformID, serviceID, feedID, value)
+}
+
+// CtrlTaskTrace is CtrlTaskRoot as part of the trace of parent. The task starts
+// a new trace if parent is not valid and a Tracer is set
+//
+func (m *MqttFabric) CtrlTaskTrace(parent SpanContext, rootTopic string, nodename string, taskID string, platformID string, serviceID string, feedID string, value interface{}) error {
+    f := m.Root(rootTopic)
+    
+    if f == nil {
+        return errors.New("CtrlTaskRoot: unknown root topic '" + rootTopic + "'")
+    }
+    
+    topic  := f.CtrlOfframpTopic(nodename, taskID, platformID, serviceID, feedID)
+    policy := m.Policy(serviceID, feedID)
+    span   := m.Tracer.Start("fabric.publish", parent).SetAttribute("fabric.topic", topic).SetAttribute("fabric.task_id", taskID)
+    tp     := span.SpanContext().TraceParent()
+    
+    defer span.End()
+    
+    msg, err := m.encode(topic, serviceID, feedID, value, tp)
+    
+    if err != nil {
+        log.Println("CtrlTask(): err = ", err)
+        span.SetError(err)
+        return err
+    }
+    
+    err = m.PublishProperties(topic, policy.QoS, policy.Retain, msg, withTraceParent(m.taskProperties(f, nodename, taskID, platformID, serviceID, feedID), tp))
+    span.SetError(err)
+    
+    return err
+}
+
+// CtrlDigitalWrite ...
+//
+func (m *MqttFabric) CtrlDigitalWrite(nodename string, platformID string, feedID string, value bool) error {
+    return m.CtrlTask(nodename, TASK_ID_DIGITAL_WRITE, platformID, SERVICE_ID_DIGITAL_OUT, feedID, value)
+}
+
+// CtrlDigitalWriteMomentary ...
+//
+func (m *MqttFabric) CtrlDigitalWriteMomentary(nodename string, platformID string, feedID string, value bool) error {
+    return m.CtrlTask(nodename, TASK_ID_DIGITAL_WRITE_MOMENTARY, platformID, SERVICE_ID_DIGITAL_OUT, feedID, value)
+}
+
+// CtrlAnalogWrite ...
+//
+func (m *MqttFabric) CtrlAnalogWrite(nodename string, platformID string, feedID string, value int) error {
+    return m.CtrlTask(nodename, TASK_ID_ANALOG_WRITE, platformID, SERVICE_ID_ANALOG_OUT, feedID, value)
+}
+
+// DevicePub publishes an onramp value using the policy for serviceID/feedID.
+// Called from the handler of an offramp task for the same feed, the value is
+// traced as part of the task
+//
+func (m *MqttFabric) DevicePub(serviceID string, feedID string, value interface{}) error {
+    return m.DevicePubTrace(m.ActiveTrace(serviceID, feedID), serviceID, feedID, value)
+}
+
+// DevicePubRoot is DevicePub under rootTopic, which must have been added with
+// AddRoot() unless it is the primary root
+//
+func (m *MqttFabric) DevicePubRoot(rootTopic string, serviceID string, feedID string, value interface{}) error {
+    return m.devicePub(m.ActiveTrace(serviceID, feedID), rootTopic, serviceID, feedID, value)
+}
+
+// DevicePubTrace is DevicePub as part of the trace of parent
+//
+func (m *MqttFabric) DevicePubTrace(parent SpanContext, serviceID string, feedID string, value interface{}) error {
+    return m.devicePub(parent, m.F.RootTopic, serviceID, feedID, value)
+}
+
+func (m *MqttFabric) devicePub(parent SpanContext, rootTopic string, serviceID string, feedID string, value interface{}) error {
+    f := m.Root(rootTopic)
+    
+    if f == nil {
+        return errors.New("DevicePub: unknown root topic '" + rootTopic + "'")
+    }
+    
+    topic  := f.DeviceOnrampTopic(serviceID, feedID)
+    policy := m.Policy(serviceID, feedID)
+    span   := m.Tracer.Start("fabric.publish", parent).SetAttribute("fabric.topic", topic)
+    tp     := span.SpanContext().TraceParent()
+    
+    defer span.End()
+    
+    msg, err := m.encode(topic, serviceID, feedID, value, tp)
+    
+    if err != nil {
+        log.Println("DevicePub(): err = ", err)
+        span.SetError(err)
+        return err
+    }
+    
+    props := m.DeviceProperties()
+    
+    // the value published while a task for the feed is handled is its reply
+    props.CorrelationData = m.replies.get(serviceID, feedID)
+    
+    err = m.PublishProperties(topic, policy.QoS, policy.Retain, msg, withTraceParent(props, tp))
+    span.SetError(err)
+    
+    return err
 }
 
 // define a function for the default message handler
 //
-var onMessage MQTT.MessageHandler = func(client *MQTT.Client, msg MQTT.Message) {
+func (m *MqttFabric) onMessage(msg *Message) {
     //log.Printf("onMessage(): Topic   = %s\n", msg.Topic())
     //log.Printf("onMessage(): Payload = %s\n", msg.Payload())
+    defer m.metrics.handled(m.metrics.receive())
+    
+    var dispatch *Span
+    
+    if m.Tracer != nil {
+        dispatch = m.Tracer.Start("fabric.dispatch", messageTrace(msg)).SetAttribute("fabric.topic", msg.Topic)
+        defer dispatch.End()
+    }
+    
     defer func() {
         if r := recover(); r != nil {
             log.Println("onMessage(): panic recovered; ", r)
+            dispatch.SetError(fmt.Errorf("panic: %v", r))
         }
     }()
     
-    m := (*MqttFabric)(client.GetUserData())
-
-    tokenizer := strings.Split(msg.Topic(), "/")
-    count     := len(tokenizer)
-    //log.Printf("onMessage(): count = %d\n", count)
+    t, err := m.ParseTopic(msg.Topic)
     
-    if tokenizer[2] == "$commands" {
-        nodename   := tokenizer[1]
-        actorID    := tokenizer[4]
-        platformID := tokenizer[5]
-        cmd        := tokenizer[6]
+    if err == nil && (t.Kind == TOPIC_ONRAMP || t.Kind == TOPIC_OFFRAMP) {
+        own := m.ownMessage(t)
         
-        log.Printf("onMessage(): $commands\n")
-        log.Printf("onMessage(): nodename   = %s\n", nodename)
-        log.Printf("onMessage(): actorID    = %s\n", actorID)
-        log.Printf("onMessage(): platformID = %s\n", platformID)
-        log.Printf("onMessage(): cmd        = %s\n", cmd)
+        // own messages are verified too, anyone can publish to the own topics
+        // and the subscriptions get them
+        if m.Signing != nil && !m.verify(t, msg) {
+            dispatch.SetError(errors.New("onMessage: signature verification failed"))
+            return
+        }
+        
+        // the signature covers the encrypted value. Own messages are decrypted
+        // too, for the subscriptions
+        if m.Encryption != nil {
+            if msg = m.decrypt(t, msg); msg == nil {
+                dispatch.SetError(errors.New("onMessage: decryption failed"))
+                return
+            }
+        }
         
-    } else if tokenizer[2] == "$feeds" {
-        if count > 6 && tokenizer[3] == "$onramp" {
-            nodename   := tokenizer[1]
-            platformID := tokenizer[4]
-            serviceID  := tokenizer[5]
-            feedID     := tokenizer[6]
-
-            //fmt.Printf("onMessage(): $onramp\n")
-            //fmt.Printf("onMessage(): nodename        = %s\n", nodename)
-            //fmt.Printf("onMessage(): platformID      = %s\n", platformID)
-            //fmt.Printf("onMessage(): serviceID       = %s\n", serviceID)
-            //fmt.Printf("onMessage(): feedID          = %s\n", feedID)
+        if !own && m.ACL != nil && t.Kind == TOPIC_OFFRAMP && t.NodeName == m.F.NodeName && !m.authorize(t, msg) {
+            dispatch.SetError(errors.New("onMessage: task denied"))
+            return
+        }
+    }
+    
+    handled := m.dispatchSubscriptions(msg)
+    
+    if err != nil {
+        // other
+        if !handled {
+            log.Printf("onMessage(): other\n")
+        }
+        return
+    }
+    
+    switch t.Kind {
+        case TOPIC_COMMAND:
+            log.Printf("onMessage(): $commands\n")
+            log.Printf("onMessage(): root       = %s\n", t.RootTopic)
+            log.Printf("onMessage(): nodename   = %s\n", t.NodeName)
+            log.Printf("onMessage(): actorID    = %s\n", t.ActorID)
+            log.Printf("onMessage(): platformID = %s\n", t.PlatformID)
+            log.Printf("onMessage(): cmd        = %s\n", t.Command)
+            
+            if t.Command == FABRIC_CMD_DESCRIPTOR {
+                m.onDescriptor(t, msg)
+            }
+            if t.Command == FABRIC_CMD_TASK_ERROR {
+                m.onTaskError(t, msg)
+            }
+            
+        case TOPIC_ONRAMP:
+            if m.ownMessage(t) {
+                return
+            }
+            
+            if m.OnOnramp == nil && m.OnRootOnramp == nil {
+                return
+            }
+            
+            span := m.Tracer.Start("fabric.handler", dispatch.SpanContext()).SetAttribute("fabric.topic", msg.Topic)
+            defer span.End()
             
             if m.OnOnramp != nil {
-                if m.F.ClassType == CONTROLLER {
-                    m.OnOnramp(m, nodename, platformID, serviceID, feedID, string(msg.Payload()))
-                } else if m.F.ClassType == DEVICE && nodename != m.F.NodeName {
-                    m.OnOnramp(m, nodename, platformID, serviceID, feedID, string(msg.Payload()))                
-                }
+                m.OnOnramp(m, t.NodeName, t.PlatformID, t.ServiceID, t.FeedID, string(msg.Payload))
+            }
+            if m.OnRootOnramp != nil {
+                m.OnRootOnramp(m, t, string(msg.Payload))
+            }
+            
+        case TOPIC_OFFRAMP:
+            if m.ownMessage(t) {
+                return
+            }
+            
+            if m.OnOfframp == nil && m.OnRootOfframp == nil {
+                return
+            }
+            
+            span := m.Tracer.Start("fabric.handler", dispatch.SpanContext()).SetAttribute("fabric.topic", msg.Topic).SetAttribute("fabric.task_id", t.TaskID)
+            defer span.End()
+            
+            // values published for the feed by the handler belong to the task
+            if span != nil {
+                m.setActiveTrace(t.ServiceID, t.FeedID, span.SpanContext())
+                defer m.setActiveTrace(t.ServiceID, t.FeedID, SpanContext{})
+            }
+            
+            if msg.Properties != nil && len(msg.Properties.CorrelationData) > 0 {
+                m.replies.set(t.ServiceID, t.FeedID, msg.Properties.CorrelationData)
+                defer m.replies.set(t.ServiceID, t.FeedID, nil)
             }
             
-        } else if count >=10 && tokenizer[3] == "$offramp" {
-            nodename        := tokenizer[1]
-            actorID         := tokenizer[4]
-            actorPlatformID := tokenizer[5]
-            taskID          := tokenizer[6]
-            platformID      := tokenizer[7]
-            serviceID       := tokenizer[8]
-            feedID          := tokenizer[9]
-
-            //fmt.Printf("onMessage(): $offramp\n")
-            //fmt.Printf("onMessage(): nodename        = %s\n", nodename)
-            //fmt.Printf("onMessage(): actorID         = %s\n", actorID)
-            //fmt.Printf("onMessage(): actorPlatformID = %s\n", actorPlatformID)
-            //fmt.Printf("onMessage(): taskID          = %s\n", taskID)
-            //fmt.Printf("onMessage(): platformID      = %s\n", platformID)
-            //fmt.Printf("onMessage(): serviceID       = %s\n", serviceID)
-            //fmt.Printf("onMessage(): feedID          = %s\n", feedID)
-
             if m.OnOfframp != nil {
-                if m.F.ClassType == DEVICE {
-                    m.OnOfframp(m, nodename, actorID, actorPlatformID, taskID, platformID, serviceID, feedID, string(msg.Payload()))
-                } else if m.F.ClassType == CONTROLLER && nodename != m.F.NodeName {
-                    m.OnOfframp(m, nodename, actorID, actorPlatformID, taskID, platformID, serviceID, feedID, string(msg.Payload()))                
-                }
+                m.OnOfframp(m, t.NodeName, t.ActorID, t.ActorPlatformID, t.TaskID, t.PlatformID, t.ServiceID, t.FeedID, string(msg.Payload))
             }
-        } else {
-            // invalid
-            log.Printf("onMessage(): invalid feed\n")
-        }
-    } else {
-        // other
-        log.Printf("onMessage(): other\n")
+            if m.OnRootOfframp != nil {
+                m.OnRootOfframp(m, t, string(msg.Payload))
+            }
+    }
+}
 
+// ownMessage reports whether t is an echo of what this node publishes, which
+// the handlers don't get
+//
+func (m *MqttFabric) ownMessage(t *FabricTopic) bool {
+    switch t.Kind {
+        case TOPIC_ONRAMP:
+            return m.F.ClassType == DEVICE && t.NodeName == m.F.NodeName
+        case TOPIC_OFFRAMP:
+            return m.F.ClassType == CONTROLLER && t.NodeName == m.F.NodeName
     }
+    
+    return false
 }
 
 // define a function for the 
 //
-var onConnect MQTT.OnConnectHandler = func(client *MQTT.Client) {
+func (m *MqttFabric) onConnect() {
     log.Printf("onConnect():\n")
     
+    atomic.AddUint64(&m.metrics.connects, 1)
+    
     defer func() {
         if r := recover(); r != nil {
             log.Println("onConnect(): panic recovered; ", r)
         }
     }()
     
-    // get pointer to our MqttFabric data
-    m := (*MqttFabric)(client.GetUserData())
+    var policy = m.Policy(FABRIC_SYS, FABRIC_CMD_STATUS)
+    
+    for _, f := range m.Roots {
+        var topic, msg = f.StatusMessage(FABRIC_ONLINE, time.Now().Unix() - m.StartTime.Unix())
+        
+        m.Publish(topic, policy.QoS, policy.Retain, []byte(msg))
+        
+        log.Println(topic)
+        log.Println(msg)
+    }
+    
+    m.publishDescriptor()
+    m.resubscribe()
     
-    var topic, msg = m.F.StatusMessage(FABRIC_ONLINE, time.Now().Unix() - m.StartTime.Unix())
+    m.registry.mu.Lock()
+    watch := m.registry.watch
+    m.registry.mu.Unlock()
     
-    m.Mqtt.Publish(topic, 2, true, msg)
+    if watch {
+        m.subscribeDescriptors()
+    }
     
-    log.Println(topic)
-    log.Println(msg)
+    if m.OnTaskError != nil {
+        m.subscribeTaskErrors()
+    }
     
     if(m.OnConnect != nil) {
         m.OnConnect(m)
@@ -365,18 +767,17 @@ var onConnect MQTT.OnConnectHandler = func(client *MQTT.Client) {
 
 // define a function for the 
 //
-var onDisconnect MQTT.ConnectionLostHandler = func(client *MQTT.Client, err error) {
+func (m *MqttFabric) onDisconnect(err error) {
     log.Printf("onDisconnect():\n")
     
+    atomic.AddUint64(&m.metrics.disconnects, 1)
+    
     defer func() {
         if r := recover(); r != nil {
             log.Println("onDisconnect(): panic recovered; ", r)
         }
     }()
     
-    // get pointer to our MqttFabric data
-    m := (*MqttFabric)(client.GetUserData())
-    
     if(m.OnDisconnect != nil) {
         m.OnDisconnect(m)
     }
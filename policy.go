@@ -0,0 +1,68 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+// Policy is the QoS and retain flag used when publishing a feed
+//
+type Policy struct {
+    QoS             byte
+    Retain          bool
+}
+
+func policyKey(serviceID string, feedID string) (string) {
+    return serviceID + "/" + feedID
+}
+
+// SetPolicy sets the policy for serviceID/feedID. Use FABRIC_TOPIC_ANY as feedID
+// to set the policy for every feed of a service. The policies should be set
+// before Start() is called
+//
+func (m *MqttFabric) SetPolicy(serviceID string, feedID string, qos byte, retain bool) *MqttFabric {
+    m.Policies[policyKey(serviceID, feedID)] = Policy{QoS: qos, Retain: retain}
+    return m
+}
+
+// SetDefaultPolicy sets the policy used when no other policy matches
+//
+func (m *MqttFabric) SetDefaultPolicy(qos byte, retain bool) *MqttFabric {
+    m.DefaultPolicy = Policy{QoS: qos, Retain: retain}
+    return m
+}
+
+// Policy returns the policy for serviceID/feedID, falling back to the policy for
+// the service and then to the default policy
+//
+func (m *MqttFabric) Policy(serviceID string, feedID string) (Policy) {
+    if p, ok := m.Policies[policyKey(serviceID, feedID)]; ok {
+        return p
+    }
+    if p, ok := m.Policies[policyKey(serviceID, FABRIC_TOPIC_ANY)]; ok {
+        return p
+    }
+    
+    return m.DefaultPolicy
+}
@@ -0,0 +1,299 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "io"
+    "log"
+    "sync"
+    "time"
+    "bufio"
+    "errors"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+    "encoding/json"
+)
+
+// Record is one recorded message. The payload is stored as text when it is
+// valid UTF-8, otherwise base64 encoded in PayloadBase64
+//
+type Record struct {
+    Time            time.Time   `json:"ts"`
+    Topic           string      `json:"topic"`
+    QoS             byte        `json:"qos"`
+    Retain          bool        `json:"retain"`
+    Payload         string      `json:"payload,omitempty"`
+    PayloadBase64   []byte      `json:"payload_b64,omitempty"`
+}
+
+// NewRecord ...
+//
+func NewRecord(msg *Message) *Record {
+    r := &Record{Time: time.Now(), Topic: msg.Topic, QoS: msg.QoS, Retain: msg.Retained}
+    
+    if utf8.Valid(msg.Payload) {
+        r.Payload = string(msg.Payload)
+    } else {
+        r.PayloadBase64 = msg.Payload
+    }
+    
+    return r
+}
+
+// Bytes returns the payload
+//
+func (r *Record) Bytes() []byte {
+    if r.PayloadBase64 != nil {
+        return r.PayloadBase64
+    }
+    
+    return []byte(r.Payload)
+}
+
+// Recorder writes messages as lines of JSON
+//
+type Recorder struct {
+    w               io.Writer
+    mu              sync.Mutex
+}
+
+// NewRecorder ...
+//
+func NewRecorder(w io.Writer) *Recorder {
+    return &Recorder{w: w}
+}
+
+// Write records msg, it is safe to call from several goroutines
+//
+func (r *Recorder) Write(msg *Message) error {
+    line, err := json.Marshal(NewRecord(msg))
+    
+    if err != nil {
+        return err
+    }
+    
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    
+    _, err = r.w.Write(append(line, '\n'))
+    
+    return err
+}
+
+// Handler returns a message handler recording every message, errors are ignored
+//
+func (r *Recorder) Handler() TransportMessageHandler {
+    return func(msg *Message) {
+        r.Write(msg)
+    }
+}
+
+// RecordReader reads records written by a Recorder
+//
+type RecordReader struct {
+    scanner         *bufio.Scanner
+    line            int
+    
+    encryption      *Encryption
+    roots           []string
+}
+
+// NewRecordReader ...
+//
+func NewRecordReader(r io.Reader) *RecordReader {
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+    
+    return &RecordReader{scanner: scanner}
+}
+
+// SetDecryption makes Next() decrypt the values of the onramp and offramp
+// records with e. roots are the root topics of the recording, see
+// ParseTopicRoots(). Records that cannot be decrypted are returned as they are
+//
+func (rr *RecordReader) SetDecryption(e *Encryption, roots []string) *RecordReader {
+    rr.encryption = e
+    rr.roots      = roots
+    return rr
+}
+
+func (rr *RecordReader) decrypt(r *Record) {
+    t, err := ParseTopicRoots(rr.roots, r.Topic)
+    
+    if err != nil || (t.Kind != TOPIC_ONRAMP && t.Kind != TOPIC_OFFRAMP) {
+        return
+    }
+    
+    payload, err := rr.encryption.Decrypt(t, r.Topic, r.Bytes())
+    
+    if err != nil {
+        log.Println("RecordReader: line ", rr.line, ": ", r.Topic, ": err = ", err)
+        return
+    }
+    
+    r.Payload       = string(payload)
+    r.PayloadBase64 = nil
+}
+
+// Next returns the next record or io.EOF
+//
+func (rr *RecordReader) Next() (*Record, error) {
+    for rr.scanner.Scan() {
+        rr.line++
+        
+        line := strings.TrimSpace(rr.scanner.Text())
+        
+        if line == "" {
+            continue
+        }
+        
+        r := &Record{}
+        
+        if err := json.Unmarshal([]byte(line), r); err != nil {
+            return nil, errors.New("RecordReader: line " + strconv.Itoa(rr.line) + ": " + err.Error())
+        }
+        
+        if rr.encryption != nil {
+            rr.decrypt(r)
+        }
+        
+        return r, nil
+    }
+    
+    if err := rr.scanner.Err(); err != nil {
+        return nil, err
+    }
+    
+    return nil, io.EOF
+}
+
+// PublishFunc ...
+type PublishFunc func(topic string, qos byte, retain bool, payload []byte) error
+
+// Replayer publishes recorded messages again
+//
+type Replayer struct {
+    Publish         PublishFunc         // e.g. MqttFabric.Publish or Transport.Publish
+    Speed           float64             // 1 is the original timing, 2 twice as fast, 0 as fast as possible
+    Roots           []string            // root topics of the recording, used to parse the topics
+    RootTopics      map[string]string   // root topics to rewrite, old to new
+    NodeNames       map[string]string   // nodenames to rewrite, old to new
+}
+
+// NewReplayer ...
+//
+func NewReplayer(publish PublishFunc) *Replayer {
+    return &Replayer{
+        Publish:    publish,
+        Speed:      1,
+        RootTopics: make(map[string]string),
+        NodeNames:  make(map[string]string),
+    }
+}
+
+// Rewrite returns the topic and payload of r with the root topics and nodenames
+// rewritten. Status messages get the new nodename in the payload as well
+//
+func (p *Replayer) Rewrite(r *Record) (string, []byte) {
+    payload := r.Bytes()
+    
+    t, err := ParseTopicRoots(p.Roots, r.Topic)
+    
+    if err != nil {
+        // not a fabric topic; only the root can be rewritten
+        for oldRoot, newRoot := range p.RootTopics {
+            if strings.HasPrefix(r.Topic, oldRoot + "/") {
+                return newRoot + r.Topic[len(oldRoot):], payload
+            }
+        }
+        
+        return r.Topic, payload
+    }
+    
+    if newRoot, ok := p.RootTopics[t.RootTopic]; ok {
+        t.RootTopic = newRoot
+    }
+    if newNode, ok := p.NodeNames[t.NodeName]; ok {
+        t.NodeName = newNode
+    }
+    if newActor, ok := p.NodeNames[t.ActorID]; ok && t.Kind == TOPIC_OFFRAMP {
+        t.ActorID = newActor
+    }
+    
+    if t.Kind == TOPIC_COMMAND && t.Command == FABRIC_CMD_STATUS {
+        if s, err := StatusParse(string(payload)); err == nil {
+            f := FabricInitialize(t.RootTopic, t.NodeName, s.PlatformID, s.ClassType)
+            
+            if _, msg := f.StatusMessage(s.Status, s.Uptime); msg != "" {
+                payload = []byte(msg)
+            }
+        }
+    }
+    
+    return t.String(), payload
+}
+
+// Replay publishes every record from rr until EOF or until stop is closed
+//
+func (p *Replayer) Replay(rr *RecordReader, stop <-chan struct{}) error {
+    var last time.Time
+    
+    for {
+        r, err := rr.Next()
+        
+        if err == io.EOF {
+            return nil
+        } else if err != nil {
+            return err
+        }
+        
+        if p.Speed > 0 && !last.IsZero() && r.Time.After(last) {
+            delay := time.Duration(float64(r.Time.Sub(last)) / p.Speed)
+            
+            select {
+                case <-time.After(delay):
+                case <-stop:
+                    return nil
+            }
+        }
+        
+        last = r.Time
+        
+        topic, payload := p.Rewrite(r)
+        
+        if err := p.Publish(topic, r.QoS, r.Retain, payload); err != nil {
+            return err
+        }
+        
+        select {
+            case <-stop:
+                return nil
+            default:
+        }
+    }
+}
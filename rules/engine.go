@@ -0,0 +1,320 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package rules
+
+import (
+    "fmt"
+    "log"
+    "sync"
+    "time"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// Firing is a task run, or in dry-run mode not run, by a rule
+//
+type Firing struct {
+    Rule            string
+    Time            time.Time
+    Active          bool            // true for Then, false for Else
+    Task            *Task
+    DryRun          bool
+    Err             error
+}
+
+// String ...
+//
+func (f *Firing) String() string {
+    branch := "then"
+    
+    if !f.Active {
+        branch = "else"
+    }
+    
+    s := fmt.Sprintf("%s %s %s %s", f.Time.Format(time.RFC3339Nano), f.Rule, branch, f.Task)
+    
+    if f.DryRun {
+        s += " (dry-run)"
+    }
+    if f.Err != nil {
+        s += " error: " + f.Err.Error()
+    }
+    
+    return s
+}
+
+type conditionState struct {
+    known           bool
+    on              bool
+}
+
+type ruleState struct {
+    rule            *Rule
+    conditions      []conditionState
+    
+    active          bool
+    pending         bool
+    pendingValue    bool
+    pendingSince    time.Time
+}
+
+// RuleState is the state of a rule
+//
+type RuleState struct {
+    Name            string
+    Active          bool
+    Pending         bool            // the conditions changed and the debounce is running
+    Since           time.Time       // start of the debounce
+}
+
+// Engine evaluates a Set on the onramp values
+//
+type Engine struct {
+    Fabric          *mqttfabric.MqttFabric      // nil when only evaluating
+    DryRun          bool                        // report the tasks without sending them
+    TickInterval    time.Duration               // how often debounces and windows are checked
+    OnFire          func(f *Firing)
+    
+    mu              sync.Mutex
+    rules           []*ruleState
+    stop            chan struct{}
+}
+
+// NewEngine validates set and returns an engine for it. m may be nil to only
+// evaluate the rules, see Evaluate()
+//
+func NewEngine(m *mqttfabric.MqttFabric, set *Set) (*Engine, error) {
+    if err := set.Validate(); err != nil {
+        return nil, err
+    }
+    
+    e := &Engine{Fabric: m, TickInterval: 100 * time.Millisecond}
+    
+    for _, r := range set.Rules {
+        e.rules = append(e.rules, &ruleState{rule: r, conditions: make([]conditionState, len(r.When))})
+    }
+    
+    return e, nil
+}
+
+// Start subscribes to the onramp values of all roots. It must be called
+// before MqttFabric.Start()
+//
+func (e *Engine) Start() error {
+    for _, f := range e.Fabric.Roots {
+        if err := e.Fabric.SubscribeHandler(f.CtrlOnrampSubscription(mqttfabric.FABRIC_TOPIC_ANY, mqttfabric.FABRIC_TOPIC_ANY, mqttfabric.FABRIC_TOPIC_ANY, mqttfabric.FABRIC_TOPIC_ANY), 0, e.onOnramp); err != nil {
+            return err
+        }
+    }
+    
+    e.mu.Lock()
+    e.stop = make(chan struct{})
+    go e.run(e.stop)
+    e.mu.Unlock()
+    
+    return nil
+}
+
+// Stop stops the evaluation
+//
+func (e *Engine) Stop() {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    
+    if e.stop != nil {
+        close(e.stop)
+        e.stop = nil
+    }
+}
+
+func (e *Engine) run(stop chan struct{}) {
+    ticker := time.NewTicker(e.TickInterval)
+    defer ticker.Stop()
+    
+    for {
+        select {
+            case <-stop:
+                return
+            case now := <-ticker.C:
+                e.Tick(now)
+        }
+    }
+}
+
+func (e *Engine) onOnramp(m *mqttfabric.MqttFabric, msg *mqttfabric.Message) {
+    e.mu.Lock()
+    stopped := e.stop == nil
+    e.mu.Unlock()
+    
+    if stopped {
+        return
+    }
+    
+    t, err := m.ParseTopic(msg.Topic)
+    
+    if err != nil || t.Kind != mqttfabric.TOPIC_ONRAMP {
+        return
+    }
+    
+    o, err := mqttfabric.BlueMixParse(string(msg.Payload))
+    
+    if err != nil {
+        return
+    }
+    
+    e.Update(mqttfabric.FeedKey{RootTopic: t.RootTopic, NodeName: t.NodeName, PlatformID: t.PlatformID, ServiceID: t.ServiceID, FeedID: t.FeedID}, o.T, time.Now())
+}
+
+// Update evaluates the rules for a new value of a feed at time at
+//
+func (e *Engine) Update(k mqttfabric.FeedKey, value interface{}, at time.Time) {
+    var fired []*Firing
+    
+    e.mu.Lock()
+    
+    for _, rs := range e.rules {
+        changed := false
+        
+        for i, c := range rs.rule.When {
+            if c.Filter().Match(k) {
+                rs.conditions[i] = conditionState{known: true, on: c.test(value, rs.conditions[i].on)}
+                changed = true
+            }
+        }
+        
+        if changed {
+            fired = append(fired, e.evaluate(rs, at)...)
+        }
+    }
+    
+    e.mu.Unlock()
+    
+    e.fire(fired)
+}
+
+// Tick checks the windows and runs the tasks of rules whose debounce ended
+// before at. It is called every TickInterval after Start()
+//
+func (e *Engine) Tick(at time.Time) {
+    var fired []*Firing
+    
+    e.mu.Lock()
+    
+    for _, rs := range e.rules {
+        fired = append(fired, e.evaluate(rs, at)...)
+    }
+    
+    e.mu.Unlock()
+    
+    e.fire(fired)
+}
+
+// evaluate is called with e.mu held
+func (e *Engine) evaluate(rs *ruleState, at time.Time) []*Firing {
+    r   := rs.rule
+    raw := r.Window.Contains(at)
+    
+    for _, c := range rs.conditions {
+        raw = raw && c.known && c.on
+    }
+    
+    if raw == rs.active {
+        rs.pending = false
+        return nil
+    }
+    
+    if r.For <= 0 {
+        return e.change(rs, raw, at)
+    }
+    
+    if !rs.pending || rs.pendingValue != raw {
+        rs.pending      = true
+        rs.pendingValue = raw
+        rs.pendingSince = at
+    }
+    
+    if due := rs.pendingSince.Add(time.Duration(r.For)); !at.Before(due) {
+        return e.change(rs, raw, due)
+    }
+    
+    return nil
+}
+
+func (e *Engine) change(rs *ruleState, active bool, at time.Time) []*Firing {
+    rs.active  = active
+    rs.pending = false
+    
+    tasks := rs.rule.Then
+    
+    if !active {
+        tasks = rs.rule.Else
+    }
+    
+    var fired []*Firing
+    
+    for _, t := range tasks {
+        fired = append(fired, &Firing{Rule: rs.rule.Name, Time: at, Active: active, Task: t, DryRun: e.DryRun || e.Fabric == nil})
+    }
+    
+    return fired
+}
+
+func (e *Engine) fire(fired []*Firing) {
+    for _, f := range fired {
+        if !f.DryRun {
+            f.Err = f.Task.Send(e.Fabric)
+        }
+        
+        if f.Err != nil {
+            log.Println("rules: fire(): err = ", f.Err)
+        }
+        
+        if e.OnFire != nil {
+            e.OnFire(f)
+        }
+    }
+}
+
+// State returns the state of every rule
+//
+func (e *Engine) State() []RuleState {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    
+    var states []RuleState
+    
+    for _, rs := range e.rules {
+        s := RuleState{Name: rs.rule.Name, Active: rs.active, Pending: rs.pending}
+        
+        if rs.pending {
+            s.Since = rs.pendingSince
+        }
+        
+        states = append(states, s)
+    }
+    
+    return states
+}
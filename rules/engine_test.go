@@ -0,0 +1,135 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package rules
+
+import (
+    "os"
+    "time"
+    "testing"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// evaluate runs testdata/rules.yaml over testdata/recording.jsonl with the
+// windows in UTC
+//
+func evaluate(t *testing.T) []*Firing {
+    local     := time.Local
+    time.Local = time.UTC
+    defer func() { time.Local = local }()
+    
+    set, err := LoadRules("testdata/rules.yaml")
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    f, err := os.Open("testdata/recording.jsonl")
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    defer f.Close()
+    
+    fired, err := Evaluate(set, mqttfabric.NewRecordReader(f), []string{"fabric"})
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    return fired
+}
+
+func TestEvaluate(t *testing.T) {
+    want := []string{
+        // hysteresis: 20.5 keeps the heater on, only 21.2 turns it off
+        "2026-03-02T08:01:00Z heat then fabric/boiler/esp/digital_out/heater digital_write true (dry-run)",
+        "2026-03-02T08:03:00Z heat else fabric/boiler/esp/digital_out/heater digital_write false (dry-run)",
+        "2026-03-02T08:05:00Z heat then fabric/boiler/esp/digital_out/heater digital_write true (dry-run)",
+        
+        // debounce: the door bounces at 09:00:10 and has been open for 30s at 09:00:50
+        "2026-03-02T09:00:50Z door then fabric/hall/esp/digital_out/buzzer digital_write true (dry-run)",
+        "2026-03-02T09:02:30Z door else fabric/hall/esp/digital_out/buzzer digital_write false (dry-run)",
+        
+        // 20.7 is above 20.5, the fractions are kept
+        "2026-03-02T10:00:00Z fan then fabric/attic/esp/digital_out/fan digital_write true (dry-run)",
+        "2026-03-02T10:01:00Z fan else fabric/attic/esp/digital_out/fan digital_write false (dry-run)",
+        
+        // window over midnight: motion at 21:50 waits for 22:00, nothing at 23:59 and 00:30
+        "2026-03-02T22:00:00Z night then fabric/hall/esp/digital_out/light digital_write true (dry-run)",
+        "2026-03-03T06:00:00Z night else fabric/hall/esp/digital_out/light digital_write false (dry-run)",
+    }
+    
+    fired := evaluate(t)
+    
+    for i := 0; i < len(fired) || i < len(want); i++ {
+        got := "<none>"
+        exp := "<none>"
+        
+        if i < len(fired) {
+            got = fired[i].String()
+        }
+        if i < len(want) {
+            exp = want[i]
+        }
+        
+        if got != exp {
+            t.Errorf("firing %d:\n got  %s\n want %s", i, got, exp)
+        }
+    }
+}
+
+func TestWindowContains(t *testing.T) {
+    w := &Window{Between: "22:00-06:00", Days: []string{"mon"}}
+    
+    if err := w.validate(); err != nil {
+        t.Fatal(err)
+    }
+    
+    at := func(s string) time.Time {
+        v, _ := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+        return v
+    }
+    
+    // 2026-03-02 is a monday
+    cases := map[string]bool{
+        "2026-03-02 05:59": false,      // sunday night
+        "2026-03-02 21:59": false,
+        "2026-03-02 22:00": true,
+        "2026-03-02 23:59": true,
+        "2026-03-03 00:30": true,       // still monday night
+        "2026-03-03 05:59": true,
+        "2026-03-03 06:00": false,
+        "2026-03-03 22:00": false,      // tuesday
+    }
+    
+    for s, want := range cases {
+        if got := w.Contains(at(s)); got != want {
+            t.Errorf("Contains(%s) = %v, want %v", s, got, want)
+        }
+    }
+}
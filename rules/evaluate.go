@@ -0,0 +1,78 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package rules
+
+import (
+    "io"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// Evaluate runs set over recorded traffic, using the times of the records,
+// and returns the tasks the rules would have sent. roots are the root topics
+// of the recording, see mqttfabric.ParseTopicRoots()
+//
+func Evaluate(set *Set, rr *mqttfabric.RecordReader, roots []string) ([]*Firing, error) {
+    e, err := NewEngine(nil, set)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    var fired []*Firing
+    
+    e.OnFire = func(f *Firing) {
+        fired = append(fired, f)
+    }
+    
+    for {
+        r, err := rr.Next()
+        
+        if err == io.EOF {
+            return fired, nil
+        }
+        if err != nil {
+            return fired, err
+        }
+        
+        // debounces ending between the records
+        e.Tick(r.Time)
+        
+        t, err := mqttfabric.ParseTopicRoots(roots, r.Topic)
+        
+        if err != nil || t.Kind != mqttfabric.TOPIC_ONRAMP {
+            continue
+        }
+        
+        o, err := mqttfabric.BlueMixParse(string(r.Bytes()))
+        
+        if err != nil {
+            continue
+        }
+        
+        e.Update(mqttfabric.FeedKey{RootTopic: t.RootTopic, NodeName: t.NodeName, PlatformID: t.PlatformID, ServiceID: t.ServiceID, FeedID: t.FeedID}, o.T, r.Time)
+    }
+}
@@ -0,0 +1,414 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+// Package rules runs declarative "when this feed, do that task" rules on a
+// controller
+//
+package rules
+
+import (
+    "fmt"
+    "time"
+    "errors"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+    "gopkg.in/yaml.v2"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// Duration is a time.Duration written as "30s", "5m" etc. in rule files
+//
+type Duration time.Duration
+
+// UnmarshalJSON ...
+//
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var s string
+    
+    if err := json.Unmarshal(data, &s); err != nil {
+        return err
+    }
+    
+    v, err := time.ParseDuration(s)
+    *d = Duration(v)
+    
+    return err
+}
+
+// UnmarshalYAML ...
+//
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+    var s string
+    
+    if err := unmarshal(&s); err != nil {
+        return err
+    }
+    
+    v, err := time.ParseDuration(s)
+    *d = Duration(v)
+    
+    return err
+}
+
+// Condition is a test on the last value of a feed. Empty or "+" fields match
+// any feed, the value is then the last one of any matching feed. With Above
+// and Below both set the value must be in between. Without a comparison the
+// value must be true or non-zero.
+//
+// Hysteresis keeps a true Above (Below) condition true until the value drops
+// under Above - Hysteresis (rises over Below + Hysteresis)
+//
+type Condition struct {
+    RootTopic       string          `json:"root"         yaml:"root"`
+    NodeName        string          `json:"nodename"     yaml:"nodename"`
+    PlatformID      string          `json:"platform_id"  yaml:"platform_id"`
+    ServiceID       string          `json:"service_id"   yaml:"service_id"`
+    FeedID          string          `json:"feed_id"      yaml:"feed_id"`
+    
+    Above           *float64        `json:"above"        yaml:"above"`
+    Below           *float64        `json:"below"        yaml:"below"`
+    Equals          interface{}     `json:"equals"       yaml:"equals"`
+    Hysteresis      float64         `json:"hysteresis"   yaml:"hysteresis"`
+}
+
+// Filter returns the feeds c looks at
+//
+func (c *Condition) Filter() mqttfabric.FeedFilter {
+    return mqttfabric.FeedFilter{RootTopic: c.RootTopic, NodeName: c.NodeName, PlatformID: c.PlatformID, ServiceID: c.ServiceID, FeedID: c.FeedID}
+}
+
+// test evaluates c for v, on is the previous result
+//
+func (c *Condition) test(v interface{}, on bool) bool {
+    n, numeric := mqttfabric.NumericValue(v)
+    
+    if c.Equals != nil {
+        if e, ok := mqttfabric.NumericValue(c.Equals); ok && numeric {
+            if n != e {
+                return false
+            }
+        } else if fmt.Sprint(v) != fmt.Sprint(c.Equals) {
+            return false
+        }
+    }
+    
+    if c.Above != nil {
+        limit := *c.Above
+        
+        if on {
+            limit -= c.Hysteresis
+        }
+        if !numeric || n <= limit {
+            return false
+        }
+    }
+    
+    if c.Below != nil {
+        limit := *c.Below
+        
+        if on {
+            limit += c.Hysteresis
+        }
+        if !numeric || n >= limit {
+            return false
+        }
+    }
+    
+    if c.Equals == nil && c.Above == nil && c.Below == nil {
+        return numeric && n != 0
+    }
+    
+    return true
+}
+
+// Window limits a rule to a time of day ("22:00-06:00" wraps over midnight)
+// and to days of the week ("mon", "tue", ...) in local time. The days are the
+// ones the window starts on, "mon" with "22:00-06:00" ends tuesday morning.
+// Outside of the window the conditions of the rule count as false
+//
+type Window struct {
+    Between         string          `json:"between"      yaml:"between"`
+    Days            []string        `json:"days"         yaml:"days"`
+    
+    from, to        int             // minutes since midnight
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseClock(s string) (int, error) {
+    t, err := time.Parse("15:04", strings.TrimSpace(s))
+    
+    if err != nil {
+        return 0, errors.New("'" + s + "' is not HH:MM")
+    }
+    
+    return t.Hour() * 60 + t.Minute(), nil
+}
+
+func (w *Window) validate() error {
+    if w.Between != "" {
+        parts := strings.Split(w.Between, "-")
+        
+        if len(parts) != 2 {
+            return errors.New("between must be HH:MM-HH:MM")
+        }
+        
+        var err error
+        
+        if w.from, err = parseClock(parts[0]); err != nil {
+            return err
+        }
+        if w.to, err = parseClock(parts[1]); err != nil {
+            return err
+        }
+    }
+    
+    for _, d := range w.Days {
+        ok := false
+        
+        for _, wd := range weekdays {
+            if strings.ToLower(d) == wd {
+                ok = true
+            }
+        }
+        
+        if !ok {
+            return errors.New("unknown day '" + d + "'")
+        }
+    }
+    
+    return nil
+}
+
+// Contains reports whether t is inside the window
+//
+func (w *Window) Contains(t time.Time) bool {
+    if w == nil {
+        return true
+    }
+    
+    t = t.Local()
+    m := t.Hour() * 60 + t.Minute()
+    
+    timed := w.Between != "" && w.from != w.to
+    wraps := timed && w.from > w.to
+    
+    if len(w.Days) > 0 {
+        // the morning part of a window over midnight belongs to the day before
+        start := t
+        
+        if wraps && m < w.to {
+            start = t.AddDate(0, 0, -1)
+        }
+        
+        day := weekdays[start.Weekday()]
+        ok  := false
+        
+        for _, d := range w.Days {
+            if strings.ToLower(d) == day {
+                ok = true
+            }
+        }
+        
+        if !ok {
+            return false
+        }
+    }
+    
+    if !timed {
+        return true
+    }
+    
+    if !wraps {
+        return m >= w.from && m < w.to
+    }
+    
+    return m >= w.from || m < w.to
+}
+
+// Task is an offramp task sent by a rule. TaskID defaults to the write task
+// of the service
+//
+type Task struct {
+    RootTopic       string          `json:"root"         yaml:"root"`
+    NodeName        string          `json:"nodename"     yaml:"nodename"`
+    PlatformID      string          `json:"platform_id"  yaml:"platform_id"`
+    ServiceID       string          `json:"service_id"   yaml:"service_id"`
+    FeedID          string          `json:"feed_id"      yaml:"feed_id"`
+    TaskID          string          `json:"task_id"      yaml:"task_id"`
+    Value           interface{}     `json:"value"        yaml:"value"`
+}
+
+// String ...
+//
+func (t *Task) String() string {
+    return fmt.Sprintf("%s/%s/%s/%s/%s %s %v", t.RootTopic, t.NodeName, t.PlatformID, t.ServiceID, t.FeedID, t.TaskID, t.Value)
+}
+
+// Validate checks t and fills in the defaults, rootTopic is used if t has no
+// root topic
+//
+func (t *Task) Validate(rootTopic string) error {
+    if t.RootTopic == "" {
+        t.RootTopic = rootTopic
+    }
+    if t.NodeName == "" || t.PlatformID == "" || t.ServiceID == "" || t.FeedID == "" {
+        return errors.New("task without nodename, platform_id, service_id or feed_id")
+    }
+    if t.TaskID == "" {
+        t.TaskID = defaultTask(t.ServiceID)
+    }
+    
+    // JSON numbers are float64
+    if f, ok := t.Value.(float64); ok && f == float64(int(f)) {
+        t.Value = int(f)
+    }
+    
+    return nil
+}
+
+// Send sends t from m, under the primary root of m if t has no root topic
+//
+func (t *Task) Send(m *mqttfabric.MqttFabric) error {
+    root := t.RootTopic
+    
+    if root == "" {
+        root = m.F.RootTopic
+    }
+    
+    return m.CtrlTaskRoot(root, t.NodeName, t.TaskID, t.PlatformID, t.ServiceID, t.FeedID, t.Value)
+}
+
+func defaultTask(serviceID string) string {
+    switch serviceID {
+        case mqttfabric.SERVICE_ID_DIGITAL_OUT:
+            return mqttfabric.TASK_ID_DIGITAL_WRITE
+        case mqttfabric.SERVICE_ID_ANALOG_OUT:
+            return mqttfabric.TASK_ID_ANALOG_WRITE
+    }
+    
+    return mqttfabric.TASK_ID_RAW
+}
+
+// Rule runs the Then tasks when all its conditions become true and the Else
+// tasks when they become false again. For is the debounce: the new state must
+// hold that long before the tasks run
+//
+type Rule struct {
+    Name            string          `json:"name"         yaml:"name"`
+    When            []*Condition    `json:"when"         yaml:"when"`
+    For             Duration        `json:"for"          yaml:"for"`
+    Window          *Window         `json:"window"       yaml:"window"`
+    Then            []*Task         `json:"then"         yaml:"then"`
+    Else            []*Task         `json:"else"         yaml:"else"`
+}
+
+// Set is the content of a rule file. RootTopic is the default for the
+// conditions and tasks
+//
+type Set struct {
+    RootTopic       string          `json:"root_topic"   yaml:"root_topic"`
+    Rules           []*Rule         `json:"rules"        yaml:"rules"`
+}
+
+// LoadRules reads a .json or .yaml/.yml file
+//
+func LoadRules(path string) (*Set, error) {
+    data, err := ioutil.ReadFile(path)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    s := &Set{}
+    
+    switch strings.ToLower(filepath.Ext(path)) {
+        case ".json":
+            err = json.Unmarshal(data, s)
+        case ".yaml", ".yml":
+            err = yaml.Unmarshal(data, s)
+        default:
+            return nil, errors.New("LoadRules: unknown file type '" + filepath.Ext(path) + "'")
+    }
+    
+    if err != nil {
+        return nil, errors.New("LoadRules: " + path + ": " + err.Error())
+    }
+    
+    return s, s.Validate()
+}
+
+// Validate checks the rules and fills in the defaults
+//
+func (s *Set) Validate() error {
+    names := make(map[string]bool)
+    
+    for i, r := range s.Rules {
+        if r.Name == "" {
+            r.Name = fmt.Sprintf("rule%d", i + 1)
+        }
+        if names[r.Name] {
+            return errors.New("Validate: duplicate rule '" + r.Name + "'")
+        }
+        
+        names[r.Name] = true
+        
+        if len(r.When) == 0 {
+            return errors.New("Validate: " + r.Name + ": no conditions")
+        }
+        if len(r.Then) == 0 && len(r.Else) == 0 {
+            return errors.New("Validate: " + r.Name + ": no tasks")
+        }
+        if r.For < 0 {
+            return errors.New("Validate: " + r.Name + ": negative for")
+        }
+        
+        for _, c := range r.When {
+            if c.RootTopic == "" {
+                c.RootTopic = s.RootTopic
+            }
+            if c.Hysteresis < 0 {
+                return errors.New("Validate: " + r.Name + ": negative hysteresis")
+            }
+        }
+        
+        if r.Window != nil {
+            if err := r.Window.validate(); err != nil {
+                return errors.New("Validate: " + r.Name + ": " + err.Error())
+            }
+        }
+        
+        for _, t := range append(append([]*Task{}, r.Then...), r.Else...) {
+            if err := t.Validate(s.RootTopic); err != nil {
+                return errors.New("Validate: " + r.Name + ": " + err.Error())
+            }
+        }
+    }
+    
+    return nil
+}
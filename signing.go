@@ -0,0 +1,549 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "log"
+    "sync"
+    "time"
+    "errors"
+    "strconv"
+    "io/ioutil"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/ed25519"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/base64"
+)
+
+const (
+    SIGN_HMAC_SHA256    = "hs256"
+    SIGN_ED25519        = "ed25519"
+)
+
+// SignaturePolicy says what happens to unsigned messages and messages failing
+// the verification
+//
+type SignaturePolicy int
+
+const (
+    SIGNATURE_DROP      SignaturePolicy = 0     // the handlers never see them
+    SIGNATURE_FLAG      SignaturePolicy = 1     // delivered with an empty FabricTopic.Signer
+)
+
+var (
+    errUnsigned     = errors.New("verify: message is not signed")
+    errUnknownKey   = errors.New("verify: unknown key")
+    errWrongSigner  = errors.New("verify: signer is not the sender")
+    errBadSignature = errors.New("verify: bad signature")
+    errStale        = errors.New("verify: timestamp outside the allowed skew")
+    errReplayed     = errors.New("verify: nonce seen before")
+    errRetainedTask = errors.New("verify: retained task")
+)
+
+// SigningKey is the key of one node. Secret is used with SIGN_HMAC_SHA256, the
+// key pair with SIGN_ED25519. PrivateKey is only needed for the own node
+//
+type SigningKey struct {
+    Algorithm       string
+    Secret          []byte
+    PublicKey       ed25519.PublicKey
+    PrivateKey      ed25519.PrivateKey
+}
+
+func (k *SigningKey) sign(data []byte) ([]byte, error) {
+    switch k.Algorithm {
+        case SIGN_HMAC_SHA256:
+            if len(k.Secret) == 0 {
+                return nil, errors.New("sign: no secret")
+            }
+            mac := hmac.New(sha256.New, k.Secret)
+            mac.Write(data)
+            return mac.Sum(nil), nil
+            
+        case SIGN_ED25519:
+            if len(k.PrivateKey) != ed25519.PrivateKeySize {
+                return nil, errors.New("sign: no private key")
+            }
+            return ed25519.Sign(k.PrivateKey, data), nil
+    }
+    
+    return nil, errors.New("sign: unknown algorithm '" + k.Algorithm + "'")
+}
+
+func (k *SigningKey) verify(data []byte, sig []byte) bool {
+    switch k.Algorithm {
+        case SIGN_HMAC_SHA256:
+            if len(k.Secret) == 0 {
+                return false
+            }
+            mac := hmac.New(sha256.New, k.Secret)
+            mac.Write(data)
+            return hmac.Equal(mac.Sum(nil), sig)
+            
+        case SIGN_ED25519:
+            pub := k.PublicKey
+            
+            if len(pub) != ed25519.PublicKeySize && len(k.PrivateKey) == ed25519.PrivateKeySize {
+                pub = k.PrivateKey.Public().(ed25519.PublicKey)
+            }
+            if len(pub) != ed25519.PublicKeySize {
+                return false
+            }
+            return ed25519.Verify(pub, data, sig)
+    }
+    
+    return false
+}
+
+// Keyring holds the keys of the nodes, by nodename
+//
+type Keyring struct {
+    mu              sync.RWMutex
+    keys            map[string]*SigningKey
+}
+
+// NewKeyring ...
+//
+func NewKeyring() *Keyring {
+    return &Keyring{keys: make(map[string]*SigningKey)}
+}
+
+// Add sets the key of nodename, replacing the old one
+//
+func (r *Keyring) Add(nodename string, key *SigningKey) *Keyring {
+    r.mu.Lock()
+    r.keys[nodename] = key
+    r.mu.Unlock()
+    
+    return r
+}
+
+// AddHMAC sets a shared secret for nodename
+//
+func (r *Keyring) AddHMAC(nodename string, secret []byte) *Keyring {
+    return r.Add(nodename, &SigningKey{Algorithm: SIGN_HMAC_SHA256, Secret: secret})
+}
+
+// AddEd25519 sets the key pair of nodename, priv may be nil for other nodes
+//
+func (r *Keyring) AddEd25519(nodename string, pub ed25519.PublicKey, priv ed25519.PrivateKey) *Keyring {
+    return r.Add(nodename, &SigningKey{Algorithm: SIGN_ED25519, PublicKey: pub, PrivateKey: priv})
+}
+
+// Remove ...
+//
+func (r *Keyring) Remove(nodename string) {
+    r.mu.Lock()
+    delete(r.keys, nodename)
+    r.mu.Unlock()
+}
+
+// Key returns the key of nodename or nil
+//
+func (r *Keyring) Key(nodename string) *SigningKey {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    
+    return r.keys[nodename]
+}
+
+// KeyConfig is a key in a keyring file, the keys and the secret are base64
+//
+type KeyConfig struct {
+    Algorithm       string      `json:"alg"`
+    Secret          string      `json:"secret,omitempty"`
+    PublicKey       string      `json:"public_key,omitempty"`
+    PrivateKey      string      `json:"private_key,omitempty"`
+}
+
+// LoadKeyring reads a JSON file mapping nodenames to a KeyConfig:
+//
+//    {"kitchen": {"alg": "ed25519", "public_key": "..."}, "ctrl": {"alg": "hs256", "secret": "..."}}
+//
+func LoadKeyring(path string) (*Keyring, error) {
+    data, err := ioutil.ReadFile(path)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    var keys map[string]KeyConfig
+    
+    if err := json.Unmarshal(data, &keys); err != nil {
+        return nil, errors.New("LoadKeyring: " + path + ": " + err.Error())
+    }
+    
+    r := NewKeyring()
+    
+    for nodename, kc := range keys {
+        k, err := kc.key()
+        
+        if err != nil {
+            return nil, errors.New("LoadKeyring: " + nodename + ": " + err.Error())
+        }
+        
+        r.Add(nodename, k)
+    }
+    
+    return r, nil
+}
+
+func (kc KeyConfig) key() (*SigningKey, error) {
+    k := &SigningKey{Algorithm: kc.Algorithm}
+    
+    decode := func(s string, size int) ([]byte, error) {
+        if s == "" {
+            return nil, nil
+        }
+        
+        b, err := base64.StdEncoding.DecodeString(s)
+        
+        if err != nil {
+            return nil, err
+        }
+        if size > 0 && len(b) != size {
+            return nil, errors.New("wrong key size")
+        }
+        
+        return b, nil
+    }
+    
+    var err error
+    
+    switch kc.Algorithm {
+        case SIGN_HMAC_SHA256:
+            if k.Secret, err = decode(kc.Secret, 0); err == nil && len(k.Secret) == 0 {
+                err = errors.New("no secret")
+            }
+            
+        case SIGN_ED25519:
+            var pub, priv []byte
+            
+            if pub, err = decode(kc.PublicKey, ed25519.PublicKeySize); err != nil {
+                break
+            }
+            if priv, err = decode(kc.PrivateKey, ed25519.PrivateKeySize); err != nil {
+                break
+            }
+            if pub == nil && priv == nil {
+                err = errors.New("no public or private key")
+            }
+            
+            k.PublicKey  = pub
+            k.PrivateKey = priv
+            
+        default:
+            err = errors.New("unknown algorithm '" + kc.Algorithm + "'")
+    }
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    return k, nil
+}
+
+// signedData is the "d" envelope with the signature fields. The value is kept
+// as raw JSON since the signature covers its bytes
+//
+type signedData struct {
+    Type            string          `json:"_type"`
+    FeedID          string          `json:"feed_id"`
+    Value           json.RawMessage `json:"value"`
+    TraceParent     string          `json:"traceparent,omitempty"`
+    Timestamp       int64           `json:"ts,omitempty"`        // unix milliseconds
+    Nonce           string          `json:"nonce,omitempty"`
+    KeyID           string          `json:"kid,omitempty"`       // nodename of the signer
+    Algorithm       string          `json:"alg,omitempty"`
+    Signature       string          `json:"sig,omitempty"`
+}
+
+// signedString is what the signature covers, the topic included so a message
+// cannot be replayed to another node or feed
+//
+func (d *signedData) signedString(topic string) []byte {
+    s := "fabric-sig-1\n" +
+         topic + "\n" +
+         d.Algorithm + "\n" +
+         d.KeyID + "\n" +
+         strconv.FormatInt(d.Timestamp, 10) + "\n" +
+         d.Nonce + "\n" +
+         d.Type + "\n" +
+         d.FeedID + "\n" +
+         d.TraceParent + "\n"
+    
+    return append([]byte(s), d.Value...)
+}
+
+// SignEnvelope builds the "d" envelope for a value published to topic, signed
+// with key as nodename
+//
+func SignEnvelope(topic string, nodename string, key *SigningKey, valueType string, feedID string, value interface{}, traceparent string) ([]byte, error) {
+    raw, err := json.Marshal(value)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    nonce := make([]byte, 12)
+    
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, err
+    }
+    
+    d := signedData{
+        Type:           valueType,
+        FeedID:         feedID,
+        Value:          raw,
+        TraceParent:    traceparent,
+        Timestamp:      time.Now().UnixNano() / int64(time.Millisecond),
+        Nonce:          hex.EncodeToString(nonce),
+        KeyID:          nodename,
+        Algorithm:      key.Algorithm,
+    }
+    
+    sig, err := key.sign(d.signedString(topic))
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    d.Signature = base64.StdEncoding.EncodeToString(sig)
+    
+    type D struct {
+        Data signedData `json:"d"`
+    }
+    
+    return json.Marshal(D{Data: d})
+}
+
+// Signing signs the onramp values and offramp tasks published by a MqttFabric
+// and verifies the ones it receives. A message must be signed by the node
+// publishing it: the nodename for onramp values, the actor id for tasks
+//
+type Signing struct {
+    Keyring         *Keyring
+    Policy          SignaturePolicy
+    MaxSkew         time.Duration                       // allowed clock difference, 30s by default
+    MaxRetainedAge  time.Duration                       // age limit for retained values, 24h by default
+    OnReject        func(topic string, err error)       // called for every dropped or flagged message
+    
+    mu              sync.Mutex
+    seen            map[string]time.Time
+    pruned          time.Time
+}
+
+// NewSigning ...
+//
+func NewSigning(keyring *Keyring, policy SignaturePolicy) *Signing {
+    return &Signing{
+        Keyring:        keyring,
+        Policy:         policy,
+        MaxSkew:        30 * time.Second,
+        MaxRetainedAge: 24 * time.Hour,
+        seen:           make(map[string]time.Time),
+    }
+}
+
+// SetSigning enables signing and verification, nil disables it. Messages are
+// signed only if the keyring has a key for the own nodename
+//
+func (m *MqttFabric) SetSigning(s *Signing) *MqttFabric {
+    m.Signing = s
+    return m
+}
+
+// encode builds the "d" envelope for a value published to topic, with the
+// value encrypted and the envelope signed when enabled
+//
+func (m *MqttFabric) encode(topic string, valueType string, feedID string, value interface{}, traceparent string) ([]byte, error) {
+    if m.Encryption != nil {
+        t, err := m.ParseTopic(topic)
+        
+        if err != nil {
+            return nil, err
+        }
+        
+        if value, err = m.Encryption.Encrypt(t, topic, value); err != nil {
+            return nil, err
+        }
+    }
+    
+    if m.Signing != nil && m.Signing.Keyring != nil {
+        if key := m.Signing.Keyring.Key(m.F.NodeName); key != nil {
+            return SignEnvelope(topic, m.F.NodeName, key, valueType, feedID, value, traceparent)
+        }
+    }
+    
+    return BlueMixEncodeTrace(valueType, feedID, value, traceparent)
+}
+
+// verify checks the signature of a message to an onramp or offramp topic and
+// sets t.Signer. It returns false if the message must be dropped. Retained tasks
+// are always dropped: their nonce cannot be checked, so they could be replayed
+// on every subscribe
+//
+func (m *MqttFabric) verify(t *FabricTopic, msg *Message) bool {
+    s      := m.Signing
+    signer := t.NodeName
+    
+    if t.Kind == TOPIC_OFFRAMP {
+        signer = t.ActorID
+        
+        if msg.Retained {
+            log.Println("verify(): ", msg.Topic, ": err = ", errRetainedTask)
+            
+            m.metrics.reject()
+            
+            if s.OnReject != nil {
+                s.OnReject(msg.Topic, errRetainedTask)
+            }
+            return false
+        }
+    }
+    
+    err := s.verify(signer, msg)
+    
+    if err == nil {
+        t.Signer = signer
+        return true
+    }
+    
+    log.Println("verify(): ", msg.Topic, ": err = ", err)
+    
+    m.metrics.reject()
+    
+    if s.OnReject != nil {
+        s.OnReject(msg.Topic, err)
+    }
+    
+    return s.Policy == SIGNATURE_FLAG
+}
+
+func (s *Signing) verify(signer string, msg *Message) error {
+    var envelope struct {
+        Data *signedData `json:"d"`
+    }
+    
+    if err := json.Unmarshal(msg.Payload, &envelope); err != nil || envelope.Data == nil {
+        return errors.New("verify: cannot parse envelope")
+    }
+    
+    d := envelope.Data
+    
+    if d.Signature == "" {
+        return errUnsigned
+    }
+    if d.KeyID != signer {
+        return errWrongSigner
+    }
+    
+    key := s.Keyring.Key(d.KeyID)
+    
+    if key == nil {
+        return errUnknownKey
+    }
+    if d.Algorithm != key.Algorithm {
+        return errBadSignature
+    }
+    
+    sig, err := base64.StdEncoding.DecodeString(d.Signature)
+    
+    if err != nil || !key.verify(d.signedString(msg.Topic), sig) {
+        return errBadSignature
+    }
+    
+    return s.fresh(d, msg.Retained)
+}
+
+// fresh checks the timestamp and remembers the nonce. Retained values are
+// delivered again on every subscribe, so their nonce is not remembered and
+// only MaxRetainedAge limits their age
+//
+func (s *Signing) fresh(d *signedData, retained bool) error {
+    skew := s.MaxSkew
+    
+    if skew <= 0 {
+        skew = 30 * time.Second
+    }
+    
+    now := time.Now()
+    ts  := time.Unix(0, d.Timestamp * int64(time.Millisecond))
+    
+    if ts.After(now.Add(skew)) {
+        return errStale
+    }
+    
+    if retained {
+        age := s.MaxRetainedAge
+        
+        if age <= 0 {
+            age = 24 * time.Hour
+        }
+        if now.Sub(ts) > age {
+            return errStale
+        }
+        return nil
+    }
+    
+    if now.Sub(ts) > skew {
+        return errStale
+    }
+    if d.Nonce == "" {
+        return errReplayed
+    }
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if s.seen == nil {
+        s.seen = make(map[string]time.Time)
+    }
+    
+    // nonces older than the skew are rejected by the timestamp check
+    if now.Sub(s.pruned) > skew {
+        for k, t := range s.seen {
+            if now.Sub(t) > skew {
+                delete(s.seen, k)
+            }
+        }
+        s.pruned = now
+    }
+    
+    id := d.KeyID + "/" + d.Nonce
+    
+    if _, ok := s.seen[id]; ok {
+        return errReplayed
+    }
+    
+    s.seen[id] = ts
+    
+    return nil
+}
@@ -0,0 +1,177 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "os"
+    "bytes"
+    "strings"
+    "testing"
+    "time"
+    "io/ioutil"
+    "log"
+)
+
+// securedPair is a device and a controller on a MemoryBroker, both signing
+// and encrypting, and the device only allows tasks for relay1
+//
+type securedPair struct {
+    broker          *MemoryBroker
+    device          *MqttFabric
+    ctrl            *MqttFabric
+    tasks           chan string
+}
+
+func newSecuredPair(t *testing.T) *securedPair {
+    log.SetOutput(ioutil.Discard)
+    t.Cleanup(func() { log.SetOutput(os.Stderr) })
+    
+    p := &securedPair{broker: NewMemoryBroker(), tasks: make(chan string, 16)}
+    
+    keyring := func() *Keyring {
+        return NewKeyring().AddHMAC("ctl", []byte("ctl-secret")).AddHMAC("dev1", []byte("dev1-secret"))
+    }
+    encryption := func(key byte) *Encryption {
+        e := NewEncryption()
+        e.SetPairKey("fabric", "dev1", "ctl", "pair-1", bytes.Repeat([]byte{key}, 32))
+        return e
+    }
+    
+    connected := make(chan bool, 2)
+    
+    p.device = MqttFabricInitializeTransport(p.broker.NewTransport(), "fabric", "dev1", "esp", DEVICE)
+    p.device.SetSigning(NewSigning(keyring(), SIGNATURE_DROP))
+    p.device.SetEncryption(encryption(1))
+    p.device.SetACL(&ACL{Rules: []ACLRule{{Effect: ACL_ALLOW, ActorID: "ctl", FeedID: "relay1"}}})
+    p.device.SetOnRootOfframpHandler(func(m *MqttFabric, topic *FabricTopic, msg string) {
+        p.tasks <- topic.FeedID + " " + msg
+    })
+    p.device.SetOnConnectHandler(func(m *MqttFabric) {
+        m.Subscribe(m.F.DeviceOfframpSubscription("dev1", FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY, "esp", FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY), 1)
+        connected <- true
+    })
+    
+    p.ctrl = p.controller(encryption(1))
+    
+    p.device.Start()
+    
+    select {
+        case <-connected:
+        case <-time.After(time.Second):
+            t.Fatal("device did not connect")
+    }
+    
+    return p
+}
+
+// controller returns a started controller named ctl using e
+//
+func (p *securedPair) controller(e *Encryption) *MqttFabric {
+    m := MqttFabricInitializeTransport(p.broker.NewTransport(), "fabric", "ctl", "pc", CONTROLLER)
+    m.SetSigning(NewSigning(NewKeyring().AddHMAC("ctl", []byte("ctl-secret")), SIGNATURE_DROP))
+    m.SetEncryption(e)
+    m.Start()
+    
+    return m
+}
+
+// next returns the next task handled by the device. Messages are delivered in
+// order, so a task that arrives proves the ones sent before it were dropped
+//
+func (p *securedPair) next(t *testing.T) string {
+    select {
+        case s := <-p.tasks:
+            return s
+        case <-time.After(time.Second):
+            t.Fatal("no task handled")
+    }
+    
+    return ""
+}
+
+func TestOnMessageDropsRetainedTasks(t *testing.T) {
+    p := newSecuredPair(t)
+    
+    // a correctly signed task, published retained
+    topic := p.ctrl.F.CtrlOfframpTopic("dev1", TASK_ID_DIGITAL_WRITE, "esp", SERVICE_ID_DIGITAL_OUT, "relay1")
+    raw, err := p.ctrl.encode(topic, SERVICE_ID_DIGITAL_OUT, "relay1", true, "")
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    p.ctrl.Publish(topic, 1, true, raw)
+    
+    // the live copy is not retained and is handled
+    if s := p.next(t); !strings.Contains(s, `"value":true`) {
+        t.Errorf("handler got %s", s)
+    }
+    
+    // a new subscribe delivers it again, retained
+    p.device.Subscribe(p.device.F.DeviceOfframpSubscription("dev1", FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY, "esp", FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY), 1)
+    p.ctrl.CtrlDigitalWrite("dev1", "esp", "relay1", false)
+    
+    if s := p.next(t); !strings.Contains(s, `"value":false`) {
+        t.Errorf("handler got %s", s)
+    }
+    
+    if mt := p.device.Metrics(); mt.Rejected != 1 {
+        t.Errorf("rejected = %d, want 1", mt.Rejected)
+    }
+}
+
+func TestOnMessageVerifiesOwnValues(t *testing.T) {
+    p := newSecuredPair(t)
+    
+    own := make(chan string, 4)
+    
+    p.device.SubscribeHandler(p.device.F.DeviceOnrampTopic(SERVICE_ID_DIGITAL_OUT, "relay1"), 1, func(m *MqttFabric, msg *Message) {
+        own <- string(msg.Payload)
+    })
+    
+    // a forged value on the own feed of the device
+    spy := p.broker.NewTransport()
+    spy.Connect()
+    
+    raw, _ := BlueMixEncode(SERVICE_ID_DIGITAL_OUT, "relay1", true)
+    spy.Publish(p.device.F.DeviceOnrampTopic(SERVICE_ID_DIGITAL_OUT, "relay1"), 0, false, raw)
+    
+    p.device.DevicePub(SERVICE_ID_DIGITAL_OUT, "relay1", false)
+    
+    select {
+        case s := <-own:
+            if !strings.Contains(s, `"value":false`) || !strings.Contains(s, `"sig"`) {
+                t.Errorf("subscription got %s", s)
+            }
+        case <-time.After(time.Second):
+            t.Fatal("subscription got nothing")
+    }
+    
+    if mt := p.device.Metrics(); mt.Rejected != 1 {
+        t.Errorf("rejected = %d, want 1", mt.Rejected)
+    }
+}
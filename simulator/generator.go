@@ -0,0 +1,119 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package simulator
+
+import (
+    "fmt"
+    "math"
+    "time"
+    "math/rand"
+)
+
+// generate returns the generator value at tick n, t after the start
+//
+func (g *GeneratorSpec) generate(n int, t time.Duration) interface{} {
+    switch g.Type {
+        case GENERATOR_SINE:
+            if g.Period <= 0 {
+                return g.Min
+            }
+            
+            phase := 2 * math.Pi * float64(t) / float64(g.Period)
+            
+            return g.Min + (g.Max - g.Min) * (0.5 + 0.5 * math.Sin(phase))
+            
+        case GENERATOR_RANDOM:
+            return g.Min + (g.Max - g.Min) * rand.Float64()
+            
+        case GENERATOR_STEP:
+            if len(g.Values) > 0 {
+                return g.Values[n % len(g.Values)]
+            }
+            if g.Step <= 0 || g.Max <= g.Min {
+                return g.Min
+            }
+            
+            steps := int(math.Floor((g.Max - g.Min) / g.Step)) + 1
+            
+            return g.Min + float64(n % steps) * g.Step
+    }
+    
+    return g.Min
+}
+
+// convert returns v as valueType. Numbers become true for digital feeds when
+// they are above the middle of min..max
+//
+func convert(v interface{}, valueType string, min float64, max float64) interface{} {
+    switch valueType {
+        case "bool":
+            switch x := v.(type) {
+                case bool:
+                    return x
+                case float64:
+                    return x > (min + max) / 2
+                case int:
+                    return float64(x) > (min + max) / 2
+                case string:
+                    return x == "true" || x == "on"
+            }
+            
+        case "int":
+            switch x := v.(type) {
+                case bool:
+                    if x {
+                        return 1
+                    }
+                    return 0
+                case float64:
+                    return int(math.Round(x))
+                case int:
+                    return x
+            }
+            
+        case "float":
+            switch x := v.(type) {
+                case bool:
+                    if x {
+                        return 1.0
+                    }
+                    return 0.0
+                case float64:
+                    return x
+                case int:
+                    return float64(x)
+            }
+            
+        case "string":
+            if s, ok := v.(string); ok {
+                return s
+            }
+            return fmt.Sprint(v)
+    }
+    
+    return v
+}
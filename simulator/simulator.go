@@ -0,0 +1,336 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+// Package simulator runs virtual DEVICE nodes described by a Spec, against the
+// in-memory broker or a real one
+//
+package simulator
+
+import (
+    "fmt"
+    "log"
+    "sync"
+    "time"
+    "errors"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// Device is a running simulated device
+//
+type Device struct {
+    Spec            *DeviceSpec
+    Fabric          *mqttfabric.MqttFabric
+    
+    mu              sync.Mutex
+    values          map[string]interface{}
+    stop            chan struct{}
+    wg              sync.WaitGroup
+}
+
+func feedKey(serviceID string, feedID string) string {
+    return serviceID + "/" + feedID
+}
+
+// NewDevice ...
+//
+func NewDevice(rootTopic string, spec *DeviceSpec, transport mqttfabric.Transport) *Device {
+    d := &Device{
+        Spec:   spec,
+        Fabric: mqttfabric.MqttFabricInitializeTransport(transport, rootTopic, spec.NodeName, spec.PlatformID, mqttfabric.DEVICE),
+        values: make(map[string]interface{}),
+    }
+    
+    for _, f := range spec.Feeds {
+        if f.Initial != nil {
+            d.values[feedKey(f.ServiceID, f.FeedID)] = convert(f.Initial, f.ValueType, 0, 0)
+        }
+    }
+    
+    d.Fabric.SetDescriptor(spec.Descriptor())
+    d.Fabric.SetOnConnectHandler(d.onConnect)
+    d.Fabric.SetOnRootOfframpHandler(d.onOfframp)
+    
+    return d
+}
+
+// Start connects the device and starts the generators
+//
+func (d *Device) Start() (err error) {
+    // MqttFabric.Start() panics when it cannot connect
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("Start: %s: %v", d.Spec.NodeName, r)
+        }
+    }()
+    
+    d.Fabric.Start()
+    
+    d.stop = make(chan struct{})
+    
+    for _, f := range d.Spec.Feeds {
+        if f.Interval > 0 {
+            d.wg.Add(1)
+            go d.run(f)
+        }
+    }
+    
+    return nil
+}
+
+// Stop stops the generators and disconnects, publishing the offline status
+//
+func (d *Device) Stop() {
+    if d.stop == nil {
+        return
+    }
+    
+    close(d.stop)
+    d.wg.Wait()
+    
+    d.Fabric.Stop()
+    d.stop = nil
+}
+
+// Value returns the current value of a feed
+//
+func (d *Device) Value(serviceID string, feedID string) interface{} {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    
+    return d.values[feedKey(serviceID, feedID)]
+}
+
+// Set changes the value of a feed and publishes it
+//
+func (d *Device) Set(serviceID string, feedID string, v interface{}) error {
+    f := d.feed(serviceID, feedID)
+    
+    if f == nil {
+        return errors.New("Set: no feed " + feedKey(serviceID, feedID))
+    }
+    
+    v = convert(v, f.ValueType, 0, 0)
+    
+    d.mu.Lock()
+    d.values[feedKey(serviceID, feedID)] = v
+    d.mu.Unlock()
+    
+    return d.Fabric.DevicePub(serviceID, feedID, v)
+}
+
+func (d *Device) feed(serviceID string, feedID string) *FeedSpec {
+    for _, f := range d.Spec.Feeds {
+        if f.ServiceID == serviceID && f.FeedID == feedID {
+            return f
+        }
+    }
+    
+    return nil
+}
+
+func (d *Device) run(f *FeedSpec) {
+    defer d.wg.Done()
+    
+    ticker := time.NewTicker(time.Duration(f.Interval))
+    defer ticker.Stop()
+    
+    start := time.Now()
+    
+    for n := 0; ; n++ {
+        select {
+            case <-d.stop:
+                return
+            case <-ticker.C:
+        }
+        
+        if f.Generator != nil {
+            d.Set(f.ServiceID, f.FeedID, convert(f.Generator.generate(n, time.Since(start)), f.ValueType, f.Generator.Min, f.Generator.Max))
+        } else if v := d.Value(f.ServiceID, f.FeedID); v != nil {
+            d.Fabric.DevicePub(f.ServiceID, f.FeedID, v)
+        }
+    }
+}
+
+func (d *Device) onConnect(m *mqttfabric.MqttFabric) {
+    topic := m.F.DeviceOfframpSubscription(d.Spec.NodeName, mqttfabric.FABRIC_TOPIC_ANY, mqttfabric.FABRIC_TOPIC_ANY, mqttfabric.FABRIC_TOPIC_ANY, d.Spec.PlatformID, mqttfabric.FABRIC_TOPIC_ANY, mqttfabric.FABRIC_TOPIC_ANY)
+    
+    if err := m.Subscribe(topic, 1); err != nil {
+        log.Println("simulator: onConnect(): err = ", err)
+    }
+    
+    // publish the initial values
+    for _, f := range d.Spec.Feeds {
+        if v := d.Value(f.ServiceID, f.FeedID); v != nil {
+            m.DevicePub(f.ServiceID, f.FeedID, v)
+        }
+    }
+}
+
+// defaultTasks returns the tasks a feed reacts to when none are given
+//
+func defaultTasks(serviceID string) []string {
+    switch serviceID {
+        case mqttfabric.SERVICE_ID_DIGITAL_OUT:
+            return []string{mqttfabric.TASK_ID_DIGITAL_WRITE, mqttfabric.TASK_ID_DIGITAL_WRITE_EX, mqttfabric.TASK_ID_DIGITAL_WRITE_MOMENTARY, mqttfabric.TASK_ID_DIGITAL_WRITE_MOMENTARY_EX}
+        case mqttfabric.SERVICE_ID_ANALOG_OUT:
+            return []string{mqttfabric.TASK_ID_ANALOG_WRITE, mqttfabric.TASK_ID_ANALOG_WRITE_EX}
+        case mqttfabric.SERVICE_ID_TEXT:
+            return []string{mqttfabric.TASK_ID_RAW}
+    }
+    
+    return nil
+}
+
+func (d *Device) onOfframp(m *mqttfabric.MqttFabric, t *mqttfabric.FabricTopic, msg string) {
+    if t.NodeName != d.Spec.NodeName || t.PlatformID != d.Spec.PlatformID {
+        return
+    }
+    
+    f := d.feed(t.ServiceID, t.FeedID)
+    
+    if f == nil {
+        log.Printf("simulator: %s: no feed %s\n", d.Spec.NodeName, feedKey(t.ServiceID, t.FeedID))
+        return
+    }
+    
+    tasks := f.Tasks
+    
+    if len(tasks) == 0 {
+        tasks = defaultTasks(f.ServiceID)
+    }
+    
+    accepted := false
+    
+    for _, task := range tasks {
+        if task == t.TaskID {
+            accepted = true
+        }
+    }
+    
+    if !accepted {
+        log.Printf("simulator: %s: feed %s does not support task %s\n", d.Spec.NodeName, f.FeedID, t.TaskID)
+        return
+    }
+    
+    b, err := mqttfabric.BlueMixParse(msg)
+    
+    if err != nil {
+        log.Printf("simulator: %s: %v\n", d.Spec.NodeName, err)
+        return
+    }
+    
+    d.Set(f.ServiceID, f.FeedID, b.T)
+    
+    if t.TaskID == mqttfabric.TASK_ID_DIGITAL_WRITE_MOMENTARY || t.TaskID == mqttfabric.TASK_ID_DIGITAL_WRITE_MOMENTARY_EX {
+        pulse := time.Duration(f.Momentary)
+        
+        if pulse <= 0 {
+            pulse = 500 * time.Millisecond
+        }
+        
+        value, _ := d.Value(f.ServiceID, f.FeedID).(bool)
+        
+        time.AfterFunc(pulse, func() {
+            d.Set(f.ServiceID, f.FeedID, !value)
+        })
+    }
+}
+
+// Simulator runs all devices of a Spec
+//
+type Simulator struct {
+    Spec            *Spec
+    Devices         []*Device
+}
+
+// New creates the devices of spec, newTransport is called once per device
+//
+func New(spec *Spec, newTransport func(d *DeviceSpec) mqttfabric.Transport) (*Simulator, error) {
+    if err := spec.Validate(); err != nil {
+        return nil, err
+    }
+    
+    s := &Simulator{Spec: spec}
+    
+    for _, d := range spec.Devices {
+        s.Devices = append(s.Devices, NewDevice(spec.RootTopic, d, newTransport(d)))
+    }
+    
+    return s, nil
+}
+
+// NewMemory creates a simulator running against an in-memory broker
+//
+func NewMemory(spec *Spec, broker *mqttfabric.MemoryBroker) (*Simulator, error) {
+    return New(spec, func(d *DeviceSpec) mqttfabric.Transport {
+        return broker.NewTransport()
+    })
+}
+
+// NewFromConfig creates a simulator running against the broker in c. Every
+// device gets its own connection with the client id "sim-<nodename>"
+//
+func NewFromConfig(spec *Spec, c *mqttfabric.Config) (*Simulator, error) {
+    return New(spec, func(d *DeviceSpec) mqttfabric.Transport {
+        cc := *c
+        cc.ClientID = "sim-" + d.NodeName
+        
+        return mqttfabric.NewPahoTransportFromConfig(&cc)
+    })
+}
+
+// Device returns the device named nodename or nil
+//
+func (s *Simulator) Device(nodename string) *Device {
+    for _, d := range s.Devices {
+        if d.Spec.NodeName == nodename {
+            return d
+        }
+    }
+    
+    return nil
+}
+
+// Start starts all devices
+//
+func (s *Simulator) Start() error {
+    for _, d := range s.Devices {
+        if err := d.Start(); err != nil {
+            s.Stop()
+            return err
+        }
+    }
+    
+    return nil
+}
+
+// Stop stops all devices
+//
+func (s *Simulator) Stop() {
+    for _, d := range s.Devices {
+        d.Stop()
+    }
+}
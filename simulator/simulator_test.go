@@ -0,0 +1,172 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package simulator
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "time"
+    "testing"
+    "io/ioutil"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+func TestGenerateStep(t *testing.T) {
+    g := &GeneratorSpec{Type: GENERATOR_STEP, Min: 1, Max: 2, Step: 0.5}
+    
+    for n, want := range []float64{1, 1.5, 2, 1, 1.5} {
+        if got := g.generate(n, 0); got != want {
+            t.Errorf("generate(%d) = %v, want %v", n, got, want)
+        }
+    }
+    
+    g = &GeneratorSpec{Type: GENERATOR_STEP, Values: []interface{}{"a", "b"}}
+    
+    if g.generate(0, 0) != "a" || g.generate(3, 0) != "b" {
+        t.Error("step over values")
+    }
+    
+    g = &GeneratorSpec{Type: GENERATOR_SINE, Min: 10, Max: 20, Period: Duration(time.Minute)}
+    
+    if got := g.generate(0, 15 * time.Second); got != 20.0 {
+        t.Errorf("sine at a quarter period = %v, want 20", got)
+    }
+}
+
+func TestConvert(t *testing.T) {
+    cases := []struct {
+        v               interface{}
+        valueType       string
+        want            interface{}
+    }{
+        {7.0,       "bool",     true},          // above the middle of 0..10
+        {3,         "bool",     false},
+        {"on",      "bool",     true},
+        {2.6,       "int",      3},
+        {true,      "int",      1},
+        {4,         "float",    4.0},
+        {21.5,      "string",   "21.5"},
+    }
+    
+    for _, c := range cases {
+        if got := convert(c.v, c.valueType, 0, 10); got != c.want {
+            t.Errorf("convert(%v, %s) = %#v, want %#v", c.v, c.valueType, got, c.want)
+        }
+    }
+}
+
+func TestSimulatorOverMemoryBroker(t *testing.T) {
+    log.SetOutput(ioutil.Discard)
+    t.Cleanup(func() { log.SetOutput(os.Stderr) })
+    
+    spec := &Spec{RootTopic: "fabric", Devices: []*DeviceSpec{{
+        NodeName:   "sim1",
+        PlatformID: "esp",
+        Feeds:      []*FeedSpec{
+            {ServiceID: mqttfabric.SERVICE_ID_DIGITAL_OUT, FeedID: "relay", Initial: false},
+            {ServiceID: mqttfabric.SERVICE_ID_ANALOG_IN, FeedID: "temp", ValueType: "float", Interval: Duration(10 * time.Millisecond), Generator: &GeneratorSpec{Type: GENERATOR_STEP, Values: []interface{}{20.5}}},
+        },
+    }}}
+    
+    broker := mqttfabric.NewMemoryBroker()
+    values := make(chan string, 64)
+    
+    ctrl := mqttfabric.MqttFabricInitializeTransport(broker.NewTransport(), "fabric", "ctl", "pc", mqttfabric.CONTROLLER)
+    ctrl.SubscribeHandler(ctrl.F.CtrlOnrampSubscription("sim1", "esp", mqttfabric.FABRIC_TOPIC_ANY, mqttfabric.FABRIC_TOPIC_ANY), 0, func(m *mqttfabric.MqttFabric, msg *mqttfabric.Message) {
+        t, _ := m.ParseTopic(msg.Topic)
+        o, err := mqttfabric.BlueMixParse(string(msg.Payload))
+        
+        if err == nil {
+            values <- fmt.Sprint(t.NodeName, " ", t.FeedID, " ", o.T)
+        }
+    })
+    connected := make(chan bool, 1)
+    ctrl.SetOnConnectHandler(func(m *mqttfabric.MqttFabric) { connected <- true })
+    ctrl.Start()
+    defer ctrl.Stop()
+    
+    select {
+        case <-connected:
+        case <-time.After(time.Second):
+            t.Fatal("controller not connected")
+    }
+    
+    s, err := NewMemory(spec, broker)
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Start(); err != nil {
+        t.Fatal(err)
+    }
+    
+    defer s.Stop()
+    
+    // wait until the initial value arrived, the device is subscribed by then
+    wait := func(want string) {
+        deadline := time.After(time.Second)
+        
+        for {
+            select {
+                case v := <-values:
+                    if v == want {
+                        return
+                    }
+                case <-deadline:
+                    t.Fatalf("no %s", want)
+            }
+        }
+    }
+    
+    wait("sim1 relay false")
+    wait("sim1 temp 20.5")
+    
+    d := s.Device("sim1")
+    
+    // a task the feed doesn't take is ignored, so the relay is set only once
+    ctrl.CtrlTaskRoot("fabric", "sim1", mqttfabric.TASK_ID_ANALOG_WRITE, "esp", mqttfabric.SERVICE_ID_DIGITAL_OUT, "relay", 1)
+    ctrl.CtrlDigitalWrite("sim1", "esp", "relay", true)
+    
+    wait("sim1 relay true")
+    
+    for deadline := time.After(100 * time.Millisecond); ; {
+        select {
+            case v := <-values:
+                if v == "sim1 relay true" {
+                    t.Fatal("relay set twice")
+                }
+                continue
+            case <-deadline:
+        }
+        break
+    }
+    
+    if v := d.Value(mqttfabric.SERVICE_ID_DIGITAL_OUT, "relay"); v != true {
+        t.Errorf("relay = %v", v)
+    }
+}
@@ -0,0 +1,235 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package simulator
+
+import (
+    "time"
+    "errors"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+    "gopkg.in/yaml.v2"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+// Duration is a time.Duration written as "1s", "500ms" etc. in spec files
+//
+type Duration time.Duration
+
+// UnmarshalJSON ...
+//
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var s string
+    
+    if err := json.Unmarshal(data, &s); err != nil {
+        return err
+    }
+    
+    v, err := time.ParseDuration(s)
+    *d = Duration(v)
+    
+    return err
+}
+
+// UnmarshalYAML ...
+//
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+    var s string
+    
+    if err := unmarshal(&s); err != nil {
+        return err
+    }
+    
+    v, err := time.ParseDuration(s)
+    *d = Duration(v)
+    
+    return err
+}
+
+const (
+    GENERATOR_CONSTANT  = "constant"
+    GENERATOR_SINE      = "sine"
+    GENERATOR_RANDOM    = "random"
+    GENERATOR_STEP      = "step"
+)
+
+// GeneratorSpec describes how a feed value changes over time
+//
+//   constant: always Min
+//   sine:     between Min and Max with the given Period
+//   random:   uniformly between Min and Max
+//   step:     the next of Values on every tick, or Min, Min+Step, ... Max
+//
+type GeneratorSpec struct {
+    Type            string          `json:"type"     yaml:"type"`
+    Min             float64         `json:"min"      yaml:"min"`
+    Max             float64         `json:"max"      yaml:"max"`
+    Period          Duration        `json:"period"   yaml:"period"`
+    Step            float64         `json:"step"     yaml:"step"`
+    Values          []interface{}   `json:"values"   yaml:"values"`
+}
+
+// FeedSpec describes one feed of a simulated device
+//
+type FeedSpec struct {
+    ServiceID       string          `json:"service_id"  yaml:"service_id"`
+    FeedID          string          `json:"feed_id"     yaml:"feed_id"`
+    ValueType       string          `json:"value_type"  yaml:"value_type"`   // bool, int, float or string; default depends on the service
+    Unit            string          `json:"unit"        yaml:"unit"`
+    Initial         interface{}     `json:"initial"     yaml:"initial"`
+    Interval        Duration        `json:"interval"    yaml:"interval"`     // how often the value is published, 0 only on change
+    Generator       *GeneratorSpec  `json:"generator"   yaml:"generator"`
+    Tasks           []string        `json:"tasks"       yaml:"tasks"`        // task id's the feed reacts to
+    Momentary       Duration        `json:"momentary"   yaml:"momentary"`    // pulse length for digital_write_momentary
+}
+
+// DeviceSpec describes a simulated DEVICE node
+//
+type DeviceSpec struct {
+    NodeName        string          `json:"nodename"    yaml:"nodename"`
+    PlatformID      string          `json:"platform_id" yaml:"platform_id"`
+    Feeds           []*FeedSpec     `json:"feeds"       yaml:"feeds"`
+}
+
+// Spec is the description of a whole simulation
+//
+type Spec struct {
+    RootTopic       string          `json:"root_topic"  yaml:"root_topic"`
+    Devices         []*DeviceSpec   `json:"devices"     yaml:"devices"`
+}
+
+// LoadSpec reads a .json or .yaml/.yml file
+//
+func LoadSpec(path string) (*Spec, error) {
+    data, err := ioutil.ReadFile(path)
+    
+    if err != nil {
+        return nil, err
+    }
+    
+    spec := &Spec{}
+    
+    switch strings.ToLower(filepath.Ext(path)) {
+        case ".json":
+            err = json.Unmarshal(data, spec)
+        case ".yaml", ".yml":
+            err = yaml.Unmarshal(data, spec)
+        default:
+            return nil, errors.New("LoadSpec: unknown file type '" + filepath.Ext(path) + "'")
+    }
+    
+    if err != nil {
+        return nil, errors.New("LoadSpec: " + path + ": " + err.Error())
+    }
+    
+    return spec, spec.Validate()
+}
+
+// Validate checks the spec and fills in the default value types
+//
+func (s *Spec) Validate() error {
+    if s.RootTopic == "" {
+        return errors.New("Validate: root_topic is not set")
+    }
+    
+    for _, d := range s.Devices {
+        if d.NodeName == "" || d.PlatformID == "" {
+            return errors.New("Validate: device without nodename or platform_id")
+        }
+        
+        for _, f := range d.Feeds {
+            if f.ServiceID == "" || f.FeedID == "" {
+                return errors.New("Validate: " + d.NodeName + ": feed without service_id or feed_id")
+            }
+            
+            if f.ValueType == "" {
+                f.ValueType = defaultValueType(f.ServiceID)
+            }
+            
+            switch f.ValueType {
+                case "bool", "int", "float", "string":
+                default:
+                    return errors.New("Validate: " + d.NodeName + "/" + f.FeedID + ": unknown value_type '" + f.ValueType + "'")
+            }
+            
+            if f.Generator != nil {
+                switch f.Generator.Type {
+                    case GENERATOR_CONSTANT, GENERATOR_SINE, GENERATOR_RANDOM, GENERATOR_STEP:
+                    default:
+                        return errors.New("Validate: " + d.NodeName + "/" + f.FeedID + ": unknown generator '" + f.Generator.Type + "'")
+                }
+                
+                if f.Interval <= 0 {
+                    return errors.New("Validate: " + d.NodeName + "/" + f.FeedID + ": a generator needs an interval")
+                }
+            }
+        }
+    }
+    
+    return nil
+}
+
+// Descriptor returns the capability descriptor of the device
+//
+func (d *DeviceSpec) Descriptor() *mqttfabric.Descriptor {
+    desc := mqttfabric.NewDescriptor(d.NodeName, d.PlatformID)
+    
+    for _, f := range d.Feeds {
+        fd := &mqttfabric.FeedDescriptor{
+            FeedID:     f.FeedID,
+            ValueType:  f.ValueType,
+            Unit:       f.Unit,
+            Tasks:      f.Tasks,
+        }
+        
+        if len(fd.Tasks) == 0 {
+            fd.Tasks = defaultTasks(f.ServiceID)
+        }
+        
+        if g := f.Generator; g != nil && g.Type != GENERATOR_CONSTANT && len(g.Values) == 0 {
+            min, max := g.Min, g.Max
+            fd.Min    = &min
+            fd.Max    = &max
+        }
+        
+        desc.AddFeed(f.ServiceID, fd)
+    }
+    
+    return desc
+}
+
+func defaultValueType(serviceID string) string {
+    if strings.HasPrefix(serviceID, "digital") {
+        return "bool"
+    }
+    if strings.HasPrefix(serviceID, "analog") {
+        return "int"
+    }
+    
+    return "string"
+}
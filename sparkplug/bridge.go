@@ -0,0 +1,511 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+// Package sparkplug publishes the fabric as a Sparkplug B edge node
+//
+//   spBv1.0/<group_id>/NBIRTH|NDEATH/<edge_node_id>
+//   spBv1.0/<group_id>/DBIRTH|DDEATH|DDATA|DCMD/<edge_node_id>/<nodename>
+//
+// Every fabric node is a Sparkplug device and every onramp feed a metric named
+// "<platform_id>/<service_id>/<feed_id>". The fabric status drives DBIRTH and
+// DDEATH, the NDEATH is the will of the Sparkplug connection. DCMD writes to
+// digital_out, analog_out and text metrics are sent as offramp tasks, NCMD
+// "Node Control/Rebirth" publishes all births again.
+//
+// The payloads are encoded by the package itself, no protobuf runtime is needed
+//
+package sparkplug
+
+import (
+    "log"
+    "math"
+    "sort"
+    "sync"
+    "time"
+    "errors"
+    "strings"
+    mqttfabric "github.com/mikejac/mqtt.fabric.golang"
+)
+
+const (
+    NAMESPACE           = "spBv1.0"
+    
+    NBIRTH              = "NBIRTH"
+    NDEATH              = "NDEATH"
+    DBIRTH              = "DBIRTH"
+    DDEATH              = "DDEATH"
+    NDATA               = "NDATA"
+    DDATA               = "DDATA"
+    NCMD                = "NCMD"
+    DCMD                = "DCMD"
+    
+    METRIC_BDSEQ        = "bdSeq"
+    METRIC_REBIRTH      = "Node Control/Rebirth"
+)
+
+type metric struct {
+    name            string
+    datatype        uint32
+    value           interface{}
+    timestamp       uint64
+    
+    root            string
+    nodename        string
+    platformID      string
+    serviceID       string
+    feedID          string
+}
+
+type device struct {
+    id              string
+    born            bool
+    metrics         map[string]*metric
+    statuses        map[string]mqttfabric.Status     // per platform id
+}
+
+// Bridge ...
+//
+type Bridge struct {
+    Fabric          *mqttfabric.MqttFabric
+    Transport       mqttfabric.Transport    // the Sparkplug session, not the one of Fabric
+    GroupID         string
+    EdgeNodeID      string
+    
+    mu              sync.Mutex
+    bdSeq           uint64
+    seq             uint64
+    devices         map[string]*device
+}
+
+// NewBridge creates a bridge from the fabric m (a CONTROLLER) to a Sparkplug
+// session on transport. A separate connection is needed since the NDEATH is
+// its will. Call Start() before m.Start()
+//
+func NewBridge(m *mqttfabric.MqttFabric, transport mqttfabric.Transport, groupID string, edgeNodeID string) *Bridge {
+    return &Bridge{
+        Fabric:     m,
+        Transport:  transport,
+        GroupID:    ID(groupID),
+        EdgeNodeID: ID(edgeNodeID),
+        devices:    make(map[string]*device),
+    }
+}
+
+// ID turns s into a valid Sparkplug id
+//
+func ID(s string) string {
+    return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(s)
+}
+
+// NodeTopic returns the topic of a message type for the edge node
+//
+func (b *Bridge) NodeTopic(msgType string) string {
+    return NAMESPACE + "/" + b.GroupID + "/" + msgType + "/" + b.EdgeNodeID
+}
+
+// DeviceTopic returns the topic of a message type for a device
+//
+func (b *Bridge) DeviceTopic(msgType string, deviceID string) string {
+    return b.NodeTopic(msgType) + "/" + deviceID
+}
+
+// Start subscribes to the fabric and connects the Sparkplug session. Each call
+// starts a new session with the next bdSeq
+//
+func (b *Bridge) Start() error {
+    any := mqttfabric.FABRIC_TOPIC_ANY
+    
+    for _, f := range b.Fabric.Roots {
+        if err := b.Fabric.SubscribeHandler(f.StatusSubscription(any, any), 1, b.onStatus); err != nil {
+            return err
+        }
+        if err := b.Fabric.SubscribeHandler(f.CtrlOnrampSubscription(any, any, any, any), 0, b.onOnramp); err != nil {
+            return err
+        }
+    }
+    
+    b.mu.Lock()
+    b.bdSeq = (b.bdSeq + 1) % 256
+    death  := b.deathPayload()
+    b.mu.Unlock()
+    
+    b.Transport.SetWill(b.NodeTopic(NDEATH), death, 1, false)
+    b.Transport.SetHandlers(b.onConnect, b.onConnectionLost, b.onMessage)
+    
+    return b.Transport.Connect()
+}
+
+// Stop publishes the NDEATH and closes the Sparkplug session
+//
+func (b *Bridge) Stop() {
+    b.mu.Lock()
+    b.Transport.Publish(b.NodeTopic(NDEATH), 1, false, b.deathPayload())
+    b.mu.Unlock()
+    
+    b.Transport.Disconnect(250)
+}
+
+func now() uint64 {
+    return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+// deathPayload returns the NDEATH payload, b.mu must be held
+//
+func (b *Bridge) deathPayload() []byte {
+    p := &Payload{
+        Timestamp:  now(),
+        Metrics:    []*Metric{{Name: METRIC_BDSEQ, Datatype: TYPE_INT64, Value: int64(b.bdSeq)}},
+    }
+    
+    p.Metrics[0].Timestamp = p.Timestamp
+    
+    return p.Encode()
+}
+
+// publish sends p with the next sequence number, b.mu must be held
+//
+func (b *Bridge) publish(topic string, p *Payload) {
+    p.Seq    = b.seq
+    p.HasSeq = true
+    b.seq    = (b.seq + 1) % 256
+    
+    if err := b.Transport.Publish(topic, 0, false, p.Encode()); err != nil {
+        log.Println("sparkplug: publish(): err = ", err)
+    }
+}
+
+// birth publishes the NBIRTH and the DBIRTH of all devices that are online,
+// b.mu must be held
+//
+func (b *Bridge) birth() {
+    ts := now()
+    b.seq = 0
+    
+    b.publish(b.NodeTopic(NBIRTH), &Payload{
+        Timestamp:  ts,
+        Metrics:    []*Metric{
+            {Name: METRIC_BDSEQ, Timestamp: ts, Datatype: TYPE_INT64, Value: int64(b.bdSeq)},
+            {Name: METRIC_REBIRTH, Timestamp: ts, Datatype: TYPE_BOOLEAN, Value: false},
+        },
+    })
+    
+    ids := make([]string, 0, len(b.devices))
+    
+    for id := range b.devices {
+        ids = append(ids, id)
+    }
+    
+    sort.Strings(ids)
+    
+    for _, id := range ids {
+        d := b.devices[id]
+        d.born = false
+        
+        if d.online() && len(d.metrics) > 0 {
+            b.deviceBirth(d)
+        }
+    }
+}
+
+// deviceBirth publishes the DBIRTH of d with all its metrics, b.mu must be held
+//
+func (b *Bridge) deviceBirth(d *device) {
+    p := &Payload{Timestamp: now()}
+    
+    names := make([]string, 0, len(d.metrics))
+    
+    for name := range d.metrics {
+        names = append(names, name)
+    }
+    
+    sort.Strings(names)
+    
+    for _, name := range names {
+        p.Metrics = append(p.Metrics, d.metrics[name].metric())
+    }
+    
+    b.publish(b.DeviceTopic(DBIRTH, d.id), p)
+    d.born = true
+}
+
+// deviceDeath publishes the DDEATH of d, b.mu must be held
+//
+func (b *Bridge) deviceDeath(d *device) {
+    b.publish(b.DeviceTopic(DDEATH, d.id), &Payload{Timestamp: now()})
+    d.born = false
+}
+
+func (m *metric) metric() *Metric {
+    return &Metric{Name: m.name, Timestamp: m.timestamp, Datatype: m.datatype, Value: m.value}
+}
+
+// online tells if any platform of d is online. Devices that are sending
+// without a status are online too
+//
+func (d *device) online() bool {
+    if len(d.statuses) == 0 {
+        return true
+    }
+    
+    for _, s := range d.statuses {
+        if s == mqttfabric.FABRIC_ONLINE {
+            return true
+        }
+    }
+    
+    return false
+}
+
+// Value converts a BlueMixObject value to a Sparkplug datatype and value
+//
+func Value(v interface{}) (uint32, interface{}) {
+    switch x := v.(type) {
+        case bool:
+            return TYPE_BOOLEAN, x
+        case int:
+            return TYPE_INT64, int64(x)
+        case float64:
+            return TYPE_DOUBLE, x
+        case string:
+            return TYPE_STRING, x
+        case nil:
+            return TYPE_STRING, nil
+    }
+    
+    return TYPE_STRING, nil
+}
+
+func (b *Bridge) device(nodename string) *device {
+    id := ID(nodename)
+    d  := b.devices[id]
+    
+    if d == nil {
+        d = &device{id: id, metrics: make(map[string]*metric), statuses: make(map[string]mqttfabric.Status)}
+        b.devices[id] = d
+    }
+    
+    return d
+}
+
+func (b *Bridge) onStatus(m *mqttfabric.MqttFabric, msg *mqttfabric.Message) {
+    s, err := mqttfabric.StatusParse(string(msg.Payload))
+    
+    if err != nil || s.ClassType != mqttfabric.DEVICE {
+        return
+    }
+    
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    
+    d := b.device(s.NodeName)
+    d.statuses[s.PlatformID] = s.Status
+    
+    if !b.Transport.IsConnected() {
+        return
+    }
+    
+    if d.born && !d.online() {
+        b.deviceDeath(d)
+    } else if !d.born && d.online() && len(d.metrics) > 0 {
+        b.deviceBirth(d)
+    }
+}
+
+func (b *Bridge) onOnramp(m *mqttfabric.MqttFabric, msg *mqttfabric.Message) {
+    t, err := m.ParseTopic(msg.Topic)
+    
+    if err != nil || t.Kind != mqttfabric.TOPIC_ONRAMP {
+        return
+    }
+    
+    o, err := mqttfabric.BlueMixParse(string(msg.Payload))
+    
+    if err != nil {
+        return
+    }
+    
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    
+    d            := b.device(t.NodeName)
+    name         := t.PlatformID + "/" + t.ServiceID + "/" + t.FeedID
+    datatype, v  := Value(o.T)
+    mt           := d.metrics[name]
+    rebirth      := false
+    
+    if mt == nil {
+        mt = &metric{
+            name:       name,
+            datatype:   datatype,
+            root:       t.RootTopic,
+            nodename:   t.NodeName,
+            platformID: t.PlatformID,
+            serviceID:  t.ServiceID,
+            feedID:     t.FeedID,
+        }
+        
+        d.metrics[name] = mt
+        rebirth = true
+    } else if v != nil && datatype != mt.datatype {
+        // the type of a metric can not change without a new birth
+        mt.datatype = datatype
+        rebirth     = true
+    }
+    
+    mt.value     = v
+    mt.timestamp = now()
+    
+    if !b.Transport.IsConnected() || !d.online() {
+        return
+    }
+    
+    if rebirth && d.born {
+        b.deviceDeath(d)
+    }
+    
+    if !d.born {
+        b.deviceBirth(d)
+        return
+    }
+    
+    b.publish(b.DeviceTopic(DDATA, d.id), &Payload{Timestamp: mt.timestamp, Metrics: []*Metric{mt.metric()}})
+}
+
+func (b *Bridge) onConnect() {
+    for _, topic := range []string{b.NodeTopic(NCMD), b.DeviceTopic(DCMD, "+")} {
+        if err := b.Transport.Subscribe(topic, 1); err != nil {
+            log.Println("sparkplug: onConnect(): err = ", err)
+        }
+    }
+    
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    
+    b.birth()
+}
+
+func (b *Bridge) onConnectionLost(err error) {
+    log.Println("sparkplug: onConnectionLost(): err = ", err)
+}
+
+func (b *Bridge) onMessage(msg *mqttfabric.Message) {
+    p, err := Decode(msg.Payload)
+    
+    if err != nil {
+        log.Println("sparkplug: onMessage(): err = ", err)
+        return
+    }
+    
+    if msg.Topic == b.NodeTopic(NCMD) {
+        for _, mt := range p.Metrics {
+            if mt.Name == METRIC_REBIRTH && mt.Value == true {
+                b.mu.Lock()
+                b.birth()
+                b.mu.Unlock()
+            }
+        }
+        
+        return
+    }
+    
+    prefix := b.NodeTopic(DCMD) + "/"
+    
+    if !strings.HasPrefix(msg.Topic, prefix) {
+        return
+    }
+    
+    deviceID := msg.Topic[len(prefix):]
+    
+    for _, mt := range p.Metrics {
+        if err := b.command(deviceID, mt); err != nil {
+            log.Println("sparkplug: onMessage(): ", deviceID, " ", mt.Name, ": err = ", err)
+        }
+    }
+}
+
+// command sends the offramp task for a DCMD metric
+//
+func (b *Bridge) command(deviceID string, mt *Metric) error {
+    b.mu.Lock()
+    
+    var target *metric
+    
+    if d := b.devices[deviceID]; d != nil {
+        target = d.metrics[mt.Name]
+    }
+    
+    b.mu.Unlock()
+    
+    if target == nil {
+        return errors.New("unknown metric")
+    }
+    
+    switch target.serviceID {
+        case mqttfabric.SERVICE_ID_DIGITAL_OUT:
+            v, ok := mt.Value.(bool)
+            
+            if !ok {
+                return errors.New("not a boolean")
+            }
+            
+            return b.Fabric.CtrlTaskRoot(target.root, target.nodename, mqttfabric.TASK_ID_DIGITAL_WRITE, target.platformID, target.serviceID, target.feedID, v)
+            
+        case mqttfabric.SERVICE_ID_ANALOG_OUT:
+            v, ok := number(mt.Value)
+            
+            if !ok {
+                return errors.New("not a number")
+            }
+            
+            return b.Fabric.CtrlTaskRoot(target.root, target.nodename, mqttfabric.TASK_ID_ANALOG_WRITE, target.platformID, target.serviceID, target.feedID, int(math.Round(v)))
+            
+        case mqttfabric.SERVICE_ID_TEXT:
+            v, ok := mt.Value.(string)
+            
+            if !ok {
+                return errors.New("not a string")
+            }
+            
+            return b.Fabric.CtrlTaskRoot(target.root, target.nodename, mqttfabric.TASK_ID_RAW, target.platformID, target.serviceID, target.feedID, v)
+    }
+    
+    return errors.New("metric is not writable")
+}
+
+func number(v interface{}) (float64, bool) {
+    switch x := v.(type) {
+        case int64:
+            return float64(x), true
+        case uint64:
+            return float64(x), true
+        case float32:
+            return float64(x), true
+        case float64:
+            return x, true
+    }
+    
+    return 0, false
+}
@@ -0,0 +1,332 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package sparkplug
+
+import (
+    "math"
+    "errors"
+    "encoding/binary"
+)
+
+// Sparkplug B data types
+const (
+    TYPE_INT8           uint32 = 1
+    TYPE_INT16          uint32 = 2
+    TYPE_INT32          uint32 = 3
+    TYPE_INT64          uint32 = 4
+    TYPE_UINT8          uint32 = 5
+    TYPE_UINT16         uint32 = 6
+    TYPE_UINT32         uint32 = 7
+    TYPE_UINT64         uint32 = 8
+    TYPE_FLOAT          uint32 = 9
+    TYPE_DOUBLE         uint32 = 10
+    TYPE_BOOLEAN        uint32 = 11
+    TYPE_STRING         uint32 = 12
+    TYPE_DATETIME       uint32 = 13
+    TYPE_TEXT           uint32 = 14
+)
+
+// Metric is the part of the Sparkplug B metric used by the bridge
+//
+type Metric struct {
+    Name            string
+    Alias           uint64
+    Timestamp       uint64          // ms since the epoch
+    Datatype        uint32
+    IsNull          bool
+    Value           interface{}     // int64, uint64, float32, float64, bool or string
+}
+
+// Payload is the part of the Sparkplug B payload used by the bridge
+//
+type Payload struct {
+    Timestamp       uint64
+    Metrics         []*Metric
+    Seq             uint64
+    HasSeq          bool
+}
+
+// protobuf wire types
+const (
+    wireVarint          = 0
+    wireFixed64         = 1
+    wireBytes           = 2
+    wireFixed32         = 5
+)
+
+type encoder struct {
+    buf             []byte
+}
+
+func (e *encoder) varint(v uint64) {
+    e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) key(field int, wire int) {
+    e.varint(uint64(field) << 3 | uint64(wire))
+}
+
+func (e *encoder) uint(field int, v uint64) {
+    e.key(field, wireVarint)
+    e.varint(v)
+}
+
+func (e *encoder) bool(field int, v bool) {
+    if v {
+        e.uint(field, 1)
+    } else {
+        e.uint(field, 0)
+    }
+}
+
+func (e *encoder) bytes(field int, v []byte) {
+    e.key(field, wireBytes)
+    e.varint(uint64(len(v)))
+    e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) fixed32(field int, v uint32) {
+    e.key(field, wireFixed32)
+    e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) fixed64(field int, v uint64) {
+    e.key(field, wireFixed64)
+    e.buf = binary.LittleEndian.AppendUint64(e.buf, v)
+}
+
+// Encode returns the protobuf encoding of p. Fields are written in field
+// number order so the output is stable
+//
+func (p *Payload) Encode() []byte {
+    e := &encoder{}
+    
+    e.uint(1, p.Timestamp)
+    
+    for _, m := range p.Metrics {
+        e.bytes(2, m.encode())
+    }
+    
+    if p.HasSeq {
+        e.uint(3, p.Seq)
+    }
+    
+    return e.buf
+}
+
+func (m *Metric) encode() []byte {
+    e := &encoder{}
+    
+    if m.Name != "" {
+        e.bytes(1, []byte(m.Name))
+    }
+    if m.Alias != 0 {
+        e.uint(2, m.Alias)
+    }
+    
+    e.uint(3, m.Timestamp)
+    e.uint(4, uint64(m.Datatype))
+    
+    if m.IsNull || m.Value == nil {
+        e.bool(7, true)
+        return e.buf
+    }
+    
+    switch v := m.Value.(type) {
+        case int64:
+            switch m.Datatype {
+                case TYPE_INT8, TYPE_INT16, TYPE_INT32:
+                    e.uint(10, uint64(uint32(int32(v))))
+                default:
+                    e.uint(11, uint64(v))
+            }
+        case uint64:
+            switch m.Datatype {
+                case TYPE_UINT8, TYPE_UINT16, TYPE_UINT32:
+                    e.uint(10, uint64(uint32(v)))
+                default:
+                    e.uint(11, v)
+            }
+        case float32:
+            e.fixed32(12, math.Float32bits(v))
+        case float64:
+            e.fixed64(13, math.Float64bits(v))
+        case bool:
+            e.bool(14, v)
+        case string:
+            e.bytes(15, []byte(v))
+    }
+    
+    return e.buf
+}
+
+type decoder struct {
+    buf             []byte
+}
+
+var errTruncated = errors.New("sparkplug: truncated protobuf")
+
+func (d *decoder) varint() (uint64, error) {
+    v, n := binary.Uvarint(d.buf)
+    
+    if n <= 0 {
+        return 0, errTruncated
+    }
+    
+    d.buf = d.buf[n:]
+    
+    return v, nil
+}
+
+// next returns the field number, wire type and the raw value: the number for
+// varints and fixed values, the content for length delimited fields
+func (d *decoder) next() (int, int, uint64, []byte, error) {
+    key, err := d.varint()
+    
+    if err != nil {
+        return 0, 0, 0, nil, err
+    }
+    
+    field, wire := int(key >> 3), int(key & 7)
+    
+    switch wire {
+        case wireVarint:
+            v, err := d.varint()
+            return field, wire, v, nil, err
+            
+        case wireFixed64:
+            if len(d.buf) < 8 {
+                return 0, 0, 0, nil, errTruncated
+            }
+            v    := binary.LittleEndian.Uint64(d.buf)
+            d.buf = d.buf[8:]
+            return field, wire, v, nil, nil
+            
+        case wireBytes:
+            l, err := d.varint()
+            
+            if err != nil || uint64(len(d.buf)) < l {
+                return 0, 0, 0, nil, errTruncated
+            }
+            b    := d.buf[:l]
+            d.buf = d.buf[l:]
+            return field, wire, 0, b, nil
+            
+        case wireFixed32:
+            if len(d.buf) < 4 {
+                return 0, 0, 0, nil, errTruncated
+            }
+            v    := binary.LittleEndian.Uint32(d.buf)
+            d.buf = d.buf[4:]
+            return field, wire, uint64(v), nil, nil
+    }
+    
+    return 0, 0, 0, nil, errors.New("sparkplug: unsupported wire type")
+}
+
+// Decode parses a Sparkplug B payload. Unknown fields are skipped
+//
+func Decode(buf []byte) (*Payload, error) {
+    p := &Payload{}
+    d := &decoder{buf: buf}
+    
+    for len(d.buf) > 0 {
+        field, _, v, b, err := d.next()
+        
+        if err != nil {
+            return nil, err
+        }
+        
+        switch field {
+            case 1:
+                p.Timestamp = v
+            case 2:
+                m, err := decodeMetric(b)
+                
+                if err != nil {
+                    return nil, err
+                }
+                
+                p.Metrics = append(p.Metrics, m)
+            case 3:
+                p.Seq    = v
+                p.HasSeq = true
+        }
+    }
+    
+    return p, nil
+}
+
+func decodeMetric(buf []byte) (*Metric, error) {
+    m := &Metric{}
+    d := &decoder{buf: buf}
+    
+    for len(d.buf) > 0 {
+        field, _, v, b, err := d.next()
+        
+        if err != nil {
+            return nil, err
+        }
+        
+        switch field {
+            case 1:
+                m.Name = string(b)
+            case 2:
+                m.Alias = v
+            case 3:
+                m.Timestamp = v
+            case 4:
+                m.Datatype = uint32(v)
+            case 7:
+                m.IsNull = v != 0
+            case 10:
+                switch m.Datatype {
+                    case TYPE_UINT8, TYPE_UINT16, TYPE_UINT32:
+                        m.Value = uint64(uint32(v))
+                    default:
+                        m.Value = int64(int32(uint32(v)))
+                }
+            case 11:
+                switch m.Datatype {
+                    case TYPE_UINT64, TYPE_DATETIME:
+                        m.Value = v
+                    default:
+                        m.Value = int64(v)
+                }
+            case 12:
+                m.Value = math.Float32frombits(uint32(v))
+            case 13:
+                m.Value = math.Float64frombits(v)
+            case 14:
+                m.Value = v != 0
+            case 15:
+                m.Value = string(b)
+        }
+    }
+    
+    return m, nil
+}
@@ -0,0 +1,132 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package sparkplug
+
+import (
+    "bytes"
+    "reflect"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+)
+
+const goldenTime = 1700000000000
+
+// the payloads of the files in testdata, which were encoded independently of
+// this package from sparkplug_b.proto
+var golden = map[string]*Payload{
+    "nbirth.bin": {
+        Timestamp:  goldenTime,
+        Metrics:    []*Metric{
+            {Name: METRIC_BDSEQ, Timestamp: goldenTime, Datatype: TYPE_INT64, Value: int64(3)},
+            {Name: METRIC_REBIRTH, Timestamp: goldenTime, Datatype: TYPE_BOOLEAN, Value: false},
+        },
+        Seq:        0,
+        HasSeq:     true,
+    },
+    "ndeath.bin": {
+        Timestamp:  goldenTime,
+        Metrics:    []*Metric{
+            {Name: METRIC_BDSEQ, Timestamp: goldenTime, Datatype: TYPE_INT64, Value: int64(3)},
+        },
+    },
+    "dbirth.bin": {
+        Timestamp:  goldenTime + 1,
+        Metrics:    []*Metric{
+            {Name: "esp/analog_in/temp", Timestamp: goldenTime, Datatype: TYPE_DOUBLE, Value: 21.5},
+            {Name: "esp/analog_out/dim", Timestamp: goldenTime, Datatype: TYPE_INT64, Value: int64(-5)},
+            {Name: "esp/digital_out/relay1", Timestamp: goldenTime, Datatype: TYPE_BOOLEAN, Value: true},
+            {Name: "esp/text/empty", Timestamp: goldenTime, Datatype: TYPE_STRING, IsNull: true},
+            {Name: "esp/text/msg", Timestamp: goldenTime, Datatype: TYPE_STRING, Value: "hello"},
+            {Name: "int32", Timestamp: goldenTime, Datatype: TYPE_INT32, Value: int64(-2)},
+            {Name: "uint32", Timestamp: goldenTime, Datatype: TYPE_UINT32, Value: uint64(4000000000)},
+            {Name: "uint64", Timestamp: goldenTime, Datatype: TYPE_UINT64, Value: uint64(18000000000000000000)},
+            {Name: "float", Timestamp: goldenTime, Datatype: TYPE_FLOAT, Value: float32(1.5)},
+            {Name: "datetime", Timestamp: goldenTime, Datatype: TYPE_DATETIME, Value: uint64(goldenTime)},
+        },
+        Seq:        1,
+        HasSeq:     true,
+    },
+    "ddata.bin": {
+        Timestamp:  goldenTime + 2,
+        Metrics:    []*Metric{
+            {Name: "esp/digital_out/relay1", Timestamp: goldenTime + 2, Datatype: TYPE_BOOLEAN, Value: false},
+            {Name: "esp/analog_in/temp", Timestamp: goldenTime + 2, Datatype: TYPE_DOUBLE, Value: 22.25},
+        },
+        Seq:        2,
+        HasSeq:     true,
+    },
+}
+
+func readGolden(t *testing.T, name string) []byte {
+    b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    return b
+}
+
+func TestEncodeGolden(t *testing.T) {
+    for name, p := range golden {
+        if got, want := p.Encode(), readGolden(t, name); !bytes.Equal(got, want) {
+            t.Errorf("%s:\n got %x\nwant %x", name, got, want)
+        }
+    }
+}
+
+func TestDecodeGolden(t *testing.T) {
+    for name, want := range golden {
+        got, err := Decode(readGolden(t, name))
+        
+        if err != nil {
+            t.Errorf("%s: %v", name, err)
+            continue
+        }
+        if got.Timestamp != want.Timestamp || got.Seq != want.Seq || got.HasSeq != want.HasSeq || len(got.Metrics) != len(want.Metrics) {
+            t.Errorf("%s: got %d metrics, timestamp %d, seq %d/%v", name, len(got.Metrics), got.Timestamp, got.Seq, got.HasSeq)
+            continue
+        }
+        
+        for i := range got.Metrics {
+            if !reflect.DeepEqual(got.Metrics[i], want.Metrics[i]) {
+                t.Errorf("%s: metric %d: got %+v, want %+v", name, i, got.Metrics[i], want.Metrics[i])
+            }
+        }
+    }
+}
+
+func TestDecodeTruncated(t *testing.T) {
+    b := readGolden(t, "dbirth.bin")
+    
+    for _, n := range []int{1, 10, len(b) - 1} {
+        if _, err := Decode(b[:n]); err == nil {
+            t.Errorf("%d of %d bytes decoded", n, len(b))
+        }
+    }
+}
@@ -0,0 +1,88 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "log"
+)
+
+// OnMessageHandler ...
+type OnMessageHandler func(mqtt *MqttFabric, msg *Message)
+
+type subscription struct {
+    filter          string
+    qos             byte
+    handler         OnMessageHandler
+}
+
+// SubscribeHandler subscribes to filter, which may be any topic, and calls
+// handler for every message matching it. The subscription is renewed when the
+// connection is re-established. Fabric topics are passed on to the normal
+// handlers as well
+//
+func (m *MqttFabric) SubscribeHandler(filter string, qos byte, handler OnMessageHandler) error {
+    m.subscriptionsMu.Lock()
+    m.subscriptions = append(m.subscriptions, &subscription{filter: filter, qos: qos, handler: handler})
+    m.subscriptionsMu.Unlock()
+    
+    if m.Transport.IsConnected() {
+        return m.Transport.Subscribe(filter, qos)
+    }
+    
+    return nil
+}
+
+func (m *MqttFabric) resubscribe() {
+    m.subscriptionsMu.Lock()
+    subs := append([]*subscription{}, m.subscriptions...)
+    m.subscriptionsMu.Unlock()
+    
+    for _, s := range subs {
+        if err := m.Transport.Subscribe(s.filter, s.qos); err != nil {
+            log.Println("resubscribe(): err = ", err)
+        }
+    }
+}
+
+// dispatchSubscriptions returns true if a handler matched msg
+//
+func (m *MqttFabric) dispatchSubscriptions(msg *Message) bool {
+    m.subscriptionsMu.Lock()
+    subs := append([]*subscription{}, m.subscriptions...)
+    m.subscriptionsMu.Unlock()
+    
+    handled := false
+    
+    for _, s := range subs {
+        if TopicMatch(s.filter, msg.Topic) {
+            s.handler(m, msg)
+            handled = true
+        }
+    }
+    
+    return handled
+}
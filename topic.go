@@ -0,0 +1,136 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "errors"
+    "strings"
+)
+
+type TopicKind int
+
+const (
+    TOPIC_ONRAMP        TopicKind = 1
+    TOPIC_OFFRAMP       TopicKind = 2
+    TOPIC_COMMAND       TopicKind = 3
+)
+
+// FabricTopic is a fabric topic split into its parts
+//
+type FabricTopic struct {
+    RootTopic           string
+    NodeName            string
+    Kind                TopicKind
+
+    ActorID             string          // $offramp and $commands only
+    ActorPlatformID     string          // $offramp only
+    TaskID              string          // $offramp only
+    PlatformID          string
+    ServiceID           string          // $onramp and $offramp only
+    FeedID              string          // $onramp and $offramp only
+    Command             string          // $commands only
+    
+    Signer              string          // set by MqttFabric when the signature was verified
+}
+
+// ParseTopic splits a topic published under rootTopic into its fabric parts
+//
+func ParseTopic(rootTopic string, topic string) (*FabricTopic, error) {
+    if !strings.HasPrefix(topic, rootTopic + "/") {
+        return nil, errors.New("ParseTopic: topic is not below root topic")
+    }
+
+    tokenizer := strings.Split(topic[len(rootTopic) + 1:], "/")
+    count     := len(tokenizer)
+
+    if count < 2 {
+        return nil, errors.New("ParseTopic: topic too short")
+    }
+
+    t := &FabricTopic{RootTopic: rootTopic, NodeName: tokenizer[0]}
+
+    if tokenizer[1] == "$commands" && count > 5 {
+        t.Kind          = TOPIC_COMMAND
+        t.ActorID       = tokenizer[3]
+        t.PlatformID    = tokenizer[4]
+        t.Command       = tokenizer[5]
+    } else if tokenizer[1] == "$feeds" && count > 5 && tokenizer[2] == "$onramp" {
+        t.Kind          = TOPIC_ONRAMP
+        t.PlatformID    = tokenizer[3]
+        t.ServiceID     = tokenizer[4]
+        t.FeedID        = tokenizer[5]
+    } else if tokenizer[1] == "$feeds" && count > 8 && tokenizer[2] == "$offramp" {
+        t.Kind              = TOPIC_OFFRAMP
+        t.ActorID           = tokenizer[3]
+        t.ActorPlatformID   = tokenizer[4]
+        t.TaskID            = tokenizer[5]
+        t.PlatformID        = tokenizer[6]
+        t.ServiceID         = tokenizer[7]
+        t.FeedID            = tokenizer[8]
+    } else {
+        return nil, errors.New("ParseTopic: not a fabric topic")
+    }
+
+    return t, nil
+}
+
+// ParseTopicRoots parses topic using the longest matching root in roots. If no
+// root matches, the first level of the topic is used as root
+//
+func ParseTopicRoots(roots []string, topic string) (*FabricTopic, error) {
+    var root string
+    
+    for _, r := range roots {
+        if strings.HasPrefix(topic, r + "/") && len(r) > len(root) {
+            root = r
+        }
+    }
+    
+    if root == "" {
+        // not one of ours; assume a single level root
+        root = strings.SplitN(topic, "/", 2)[0]
+    }
+    
+    return ParseTopic(root, topic)
+}
+
+// String builds the topic string again
+//
+func (t *FabricTopic) String() (string) {
+    switch t.Kind {
+        case TOPIC_ONRAMP:
+            return t.RootTopic + "/" + t.NodeName + "/$feeds/$onramp/" + t.PlatformID + "/" + t.ServiceID + "/" + t.FeedID
+
+        case TOPIC_OFFRAMP:
+            return t.RootTopic + "/" + t.NodeName + "/$feeds/$offramp/" + t.ActorID + "/" + t.ActorPlatformID + "/" + t.TaskID + "/" + t.PlatformID + "/" + t.ServiceID + "/" + t.FeedID
+
+        case TOPIC_COMMAND:
+            return t.RootTopic + "/" + t.NodeName + "/$commands/$clients/" + t.ActorID + "/" + t.PlatformID + "/" + t.Command
+    }
+
+    return ""
+}
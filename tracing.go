@@ -0,0 +1,363 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "sync"
+    "time"
+    "errors"
+    "strings"
+    "crypto/rand"
+    "encoding/hex"
+)
+
+const (
+    PROPERTY_TRACEPARENT        = "traceparent"
+)
+
+// TraceID ...
+type TraceID [16]byte
+// SpanID ...
+type SpanID [8]byte
+
+// SpanContext identifies a span, it is propagated as W3C traceparent in the
+// "traceparent" field of the "d" envelope and as MQTT 5 user property
+//
+type SpanContext struct {
+    TraceID         TraceID
+    SpanID          SpanID
+    Sampled         bool
+}
+
+// IsValid ...
+//
+func (c SpanContext) IsValid() bool {
+    return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+// TraceParent returns c as W3C traceparent header, "" if c is not valid
+//
+func (c SpanContext) TraceParent() string {
+    if !c.IsValid() {
+        return ""
+    }
+    
+    flags := "00"
+    
+    if c.Sampled {
+        flags = "01"
+    }
+    
+    return "00-" + hex.EncodeToString(c.TraceID[:]) + "-" + hex.EncodeToString(c.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceParent parses a W3C traceparent header
+//
+func ParseTraceParent(s string) (SpanContext, error) {
+    var c SpanContext
+    
+    parts := strings.Split(s, "-")
+    
+    if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+        return c, errors.New("ParseTraceParent: malformed traceparent")
+    }
+    
+    if _, err := hex.Decode(c.TraceID[:], []byte(parts[1])); err != nil {
+        return c, errors.New("ParseTraceParent: malformed trace id")
+    }
+    if _, err := hex.Decode(c.SpanID[:], []byte(parts[2])); err != nil {
+        return c, errors.New("ParseTraceParent: malformed span id")
+    }
+    
+    flags, err := hex.DecodeString(parts[3])
+    
+    if err != nil {
+        return c, errors.New("ParseTraceParent: malformed flags")
+    }
+    
+    c.Sampled = flags[0] & 1 == 1
+    
+    if !c.IsValid() {
+        return c, errors.New("ParseTraceParent: invalid trace or span id")
+    }
+    
+    return c, nil
+}
+
+// Span is one traced operation. The methods do nothing on a nil span, which
+// is what a nil Tracer returns
+//
+type Span struct {
+    Name            string
+    Context         SpanContext
+    Parent          SpanContext     // not valid for a root span
+    StartTime       time.Time
+    EndTime         time.Time
+    Attributes      map[string]string
+    Err             error
+    
+    tracer          *Tracer
+    mu              sync.Mutex
+}
+
+// SpanContext returns the context of s, or an invalid one if s is nil
+//
+func (s *Span) SpanContext() SpanContext {
+    if s == nil {
+        return SpanContext{}
+    }
+    
+    return s.Context
+}
+
+// SetAttribute ...
+//
+func (s *Span) SetAttribute(key string, value string) *Span {
+    if s == nil {
+        return s
+    }
+    
+    s.mu.Lock()
+    s.Attributes[key] = value
+    s.mu.Unlock()
+    
+    return s
+}
+
+// SetError records err if it is not nil
+//
+func (s *Span) SetError(err error) *Span {
+    if s == nil || err == nil {
+        return s
+    }
+    
+    s.mu.Lock()
+    s.Err = err
+    s.mu.Unlock()
+    
+    return s
+}
+
+// End ends s and hands it to the exporter
+//
+func (s *Span) End() {
+    if s == nil {
+        return
+    }
+    
+    s.mu.Lock()
+    
+    if !s.EndTime.IsZero() {
+        s.mu.Unlock()
+        return
+    }
+    
+    s.EndTime = time.Now()
+    s.mu.Unlock()
+    
+    if s.tracer.Exporter != nil && s.Context.Sampled {
+        s.tracer.Exporter.ExportSpan(s)
+    }
+}
+
+// SpanExporter receives the ended spans. It is called from the goroutine
+// ending the span, so it should not block
+//
+type SpanExporter interface {
+    ExportSpan(s *Span)
+}
+
+// Tracer creates spans
+//
+type Tracer struct {
+    Exporter        SpanExporter
+}
+
+// NewTracer ...
+//
+func NewTracer(exporter SpanExporter) *Tracer {
+    return &Tracer{Exporter: exporter}
+}
+
+// Start starts a span, a child of parent if it is valid and else the root of
+// a new trace. A nil tracer returns a nil span
+//
+func (t *Tracer) Start(name string, parent SpanContext) *Span {
+    if t == nil {
+        return nil
+    }
+    
+    s := &Span{
+        Name:       name,
+        Parent:     parent,
+        StartTime:  time.Now(),
+        Attributes: make(map[string]string),
+        tracer:     t,
+    }
+    
+    if parent.IsValid() {
+        s.Context.TraceID = parent.TraceID
+        s.Context.Sampled = parent.Sampled
+    } else {
+        rand.Read(s.Context.TraceID[:])
+        s.Context.Sampled = true
+    }
+    
+    rand.Read(s.Context.SpanID[:])
+    
+    return s
+}
+
+// MemoryExporter keeps the ended spans, for tests
+//
+type MemoryExporter struct {
+    mu              sync.Mutex
+    spans           []*Span
+}
+
+// NewMemoryExporter ...
+//
+func NewMemoryExporter() *MemoryExporter {
+    return &MemoryExporter{}
+}
+
+// ExportSpan ...
+//
+func (e *MemoryExporter) ExportSpan(s *Span) {
+    e.mu.Lock()
+    e.spans = append(e.spans, s)
+    e.mu.Unlock()
+}
+
+// Spans returns the spans exported so far
+//
+func (e *MemoryExporter) Spans() []*Span {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    
+    return append([]*Span{}, e.spans...)
+}
+
+// Trace returns the spans of one trace
+//
+func (e *MemoryExporter) Trace(id TraceID) []*Span {
+    var list []*Span
+    
+    for _, s := range e.Spans() {
+        if s.Context.TraceID == id {
+            list = append(list, s)
+        }
+    }
+    
+    return list
+}
+
+// Reset drops the spans
+//
+func (e *MemoryExporter) Reset() {
+    e.mu.Lock()
+    e.spans = nil
+    e.mu.Unlock()
+}
+
+// tracing is the trace state of a MqttFabric
+//
+type tracing struct {
+    mu              sync.Mutex
+    active          map[string]SpanContext  // service/feed of the offramp task being handled
+}
+
+// SetTracer enables tracing of the tasks and values published with the Ctrl*
+// and Device* helpers and of the messages received
+//
+func (m *MqttFabric) SetTracer(t *Tracer) *MqttFabric {
+    m.Tracer = t
+    return m
+}
+
+// messageTrace returns the span context carried by msg
+//
+func messageTrace(msg *Message) SpanContext {
+    if o, err := BlueMixParse(string(msg.Payload)); err == nil && o.TraceParent != "" {
+        if c, err := ParseTraceParent(o.TraceParent); err == nil {
+            return c
+        }
+    }
+    
+    if msg.Properties != nil {
+        if c, err := ParseTraceParent(msg.Properties.UserProperties[PROPERTY_TRACEPARENT]); err == nil {
+            return c
+        }
+    }
+    
+    return SpanContext{}
+}
+
+// ActiveTrace returns the span context of the offramp task for serviceID/feedID
+// that is being handled right now, if any. DevicePub() uses it as parent so the
+// value published by a task handler belongs to the trace of the task
+//
+func (m *MqttFabric) ActiveTrace(serviceID string, feedID string) SpanContext {
+    m.tracing.mu.Lock()
+    defer m.tracing.mu.Unlock()
+    
+    return m.tracing.active[serviceID + "/" + feedID]
+}
+
+func (m *MqttFabric) setActiveTrace(serviceID string, feedID string, c SpanContext) {
+    m.tracing.mu.Lock()
+    defer m.tracing.mu.Unlock()
+    
+    if m.tracing.active == nil {
+        m.tracing.active = make(map[string]SpanContext)
+    }
+    
+    if c.IsValid() {
+        m.tracing.active[serviceID + "/" + feedID] = c
+    } else {
+        delete(m.tracing.active, serviceID + "/" + feedID)
+    }
+}
+
+// withTraceParent returns props with the traceparent user property added
+//
+func withTraceParent(props *Properties, traceparent string) *Properties {
+    if traceparent == "" {
+        return props
+    }
+    
+    if props == nil {
+        props = &Properties{}
+    }
+    if props.UserProperties == nil {
+        props.UserProperties = make(map[string]string)
+    }
+    
+    props.UserProperties[PROPERTY_TRACEPARENT] = traceparent
+    
+    return props
+}
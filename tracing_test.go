@@ -0,0 +1,164 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "testing"
+    "time"
+    "io/ioutil"
+    "log"
+)
+
+func TestTraceParentRoundTrip(t *testing.T) {
+    c, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+    
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !c.Sampled || c.TraceParent() != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+        t.Errorf("got %+v", c)
+    }
+    
+    for _, s := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "00-00000000000000000000000000000000-00f067aa0ba902b7-01"} {
+        if _, err := ParseTraceParent(s); err == nil {
+            t.Errorf("'%s' accepted", s)
+        }
+    }
+}
+
+// TestSpanParenting follows a task from a controller to a device and the value
+// the device publishes back
+//
+func TestSpanParenting(t *testing.T) {
+    log.SetOutput(ioutil.Discard)
+    
+    broker   := NewMemoryBroker()
+    exporter := NewMemoryExporter()
+    tracer   := NewTracer(exporter)
+    
+    connected := make(chan bool, 2)
+    values    := make(chan string, 4)
+    
+    device := MqttFabricInitializeTransport(broker.NewTransport(), "fabric", "dev1", "esp", DEVICE)
+    device.SetTracer(tracer)
+    device.SetOnRootOfframpHandler(func(m *MqttFabric, topic *FabricTopic, msg string) {
+        m.DevicePub(topic.ServiceID, topic.FeedID, true)
+    })
+    device.SetOnConnectHandler(func(m *MqttFabric) {
+        m.Subscribe(m.F.DeviceOfframpSubscription("dev1", FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY, "esp", FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY), 1)
+        connected <- true
+    })
+    
+    ctrl := MqttFabricInitializeTransport(broker.NewTransport(), "fabric", "ctl", "pc", CONTROLLER)
+    ctrl.SetTracer(tracer)
+    ctrl.SetOnRootOnrampHandler(func(m *MqttFabric, topic *FabricTopic, msg string) {
+        values <- msg
+    })
+    ctrl.SetOnConnectHandler(func(m *MqttFabric) {
+        m.Subscribe(m.F.CtrlOnrampSubscription("dev1", FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY, FABRIC_TOPIC_ANY), 0)
+        connected <- true
+    })
+    
+    device.Start()
+    ctrl.Start()
+    
+    for i := 0; i < 2; i++ {
+        select {
+            case <-connected:
+            case <-time.After(time.Second):
+                t.Fatal("not connected")
+        }
+    }
+    
+    root := tracer.Start("rule", SpanContext{})
+    
+    if err := ctrl.CtrlTaskTrace(root.SpanContext(), "fabric", "dev1", TASK_ID_DIGITAL_WRITE, "esp", SERVICE_ID_DIGITAL_OUT, "relay1", true); err != nil {
+        t.Fatal(err)
+    }
+    
+    root.End()
+    
+    select {
+        case <-values:
+        case <-time.After(time.Second):
+            t.Fatal("no value")
+    }
+    
+    // the handler span of the controller ends after the handler returned
+    var spans []*Span
+    
+    for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+        if spans = exporter.Trace(root.Context.TraceID); len(spans) == 7 {
+            break
+        }
+    }
+    
+    byID := make(map[SpanID]*Span)
+    
+    for _, s := range spans {
+        byID[s.Context.SpanID] = s
+    }
+    
+    offramp := "fabric/dev1/$feeds/$offramp/ctl/pc/digital_write/esp/digital_out/relay1"
+    onramp  := "fabric/dev1/$feeds/$onramp/esp/digital_out/relay1"
+    
+    // each span and its parent, from the task to the controller's handler
+    want := []struct {
+        name, topic, parent, parentTopic string
+    }{
+        {"fabric.publish",  offramp, "rule",            ""},
+        {"fabric.dispatch", offramp, "fabric.publish",  offramp},
+        {"fabric.handler",  offramp, "fabric.dispatch", offramp},
+        {"fabric.publish",  onramp,  "fabric.handler",  offramp},
+        {"fabric.dispatch", onramp,  "fabric.publish",  onramp},
+        {"fabric.handler",  onramp,  "fabric.dispatch", onramp},
+    }
+    
+    if len(spans) != len(want) + 1 {
+        t.Fatalf("%d spans in the trace, want %d", len(spans), len(want) + 1)
+    }
+    
+    for _, w := range want {
+        found := false
+        
+        for _, s := range spans {
+            if s.Name != w.name || s.Attributes["fabric.topic"] != w.topic {
+                continue
+            }
+            
+            found = true
+            
+            if p := byID[s.Parent.SpanID]; p == nil || p.Name != w.parent || p.Attributes["fabric.topic"] != w.parentTopic {
+                t.Errorf("%s %s: wrong parent %+v", w.name, w.topic, p)
+            }
+        }
+        
+        if !found {
+            t.Errorf("no %s span for %s", w.name, w.topic)
+        }
+    }
+}
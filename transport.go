@@ -0,0 +1,121 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "sync"
+)
+
+// Message is a message received from the broker
+//
+type Message struct {
+    Topic           string
+    Payload         []byte
+    QoS             byte
+    Retained        bool
+    Properties      *Properties     // nil unless received over MQTT 5
+}
+
+const (
+    PROPERTY_NODENAME           = "nodename"
+    PROPERTY_PLATFORM_ID        = "platform_id"
+    PROPERTY_ACTOR_ID           = "actor_id"
+    PROPERTY_ACTOR_PLATFORM_ID  = "actor_platform_id"
+)
+
+// Properties are the MQTT 5 publish properties used by the fabric
+//
+type Properties struct {
+    ResponseTopic   string
+    CorrelationData []byte
+    UserProperties  map[string]string
+    MessageExpiry   uint32          // seconds, 0 means no expiry
+}
+
+// taskReplies has the correlation data of the offramp tasks being handled, by
+// service/feed
+//
+type taskReplies struct {
+    mu              sync.Mutex
+    correlation     map[string][]byte
+}
+
+func (r *taskReplies) get(serviceID string, feedID string) []byte {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    
+    return r.correlation[serviceID + "/" + feedID]
+}
+
+func (r *taskReplies) set(serviceID string, feedID string, correlation []byte) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    
+    if r.correlation == nil {
+        r.correlation = make(map[string][]byte)
+    }
+    
+    if correlation != nil {
+        r.correlation[serviceID + "/" + feedID] = correlation
+    } else {
+        delete(r.correlation, serviceID + "/" + feedID)
+    }
+}
+
+// TransportConnectHandler ...
+type TransportConnectHandler func()
+// TransportConnectionLostHandler ...
+type TransportConnectionLostHandler func(err error)
+// TransportMessageHandler ...
+type TransportMessageHandler func(msg *Message)
+
+// Transport is the connection to the broker used by MqttFabric. The Paho
+// client is the default one, see PahoTransport
+//
+type Transport interface {
+    // SetWill sets the LWT, must be called before Connect
+    SetWill(topic string, payload []byte, qos byte, retain bool)
+    // SetHandlers sets the callbacks, must be called before Connect
+    SetHandlers(onConnect TransportConnectHandler, onConnectionLost TransportConnectionLostHandler, onMessage TransportMessageHandler)
+    
+    Connect() error
+    Disconnect(quiesce uint)
+    IsConnected() bool
+    
+    Publish(topic string, qos byte, retain bool, payload []byte) error
+    Subscribe(topic string, qos byte) error
+    Unsubscribe(topics ...string) error
+}
+
+// PropertiesTransport is implemented by transports that can send MQTT 5
+// properties, like the one in the mqtt5 package
+//
+type PropertiesTransport interface {
+    Transport
+    
+    PublishProperties(topic string, qos byte, retain bool, payload []byte, props *Properties) error
+}
@@ -0,0 +1,208 @@
+/* 
+ * The MIT License (MIT)
+ * 
+ * MQTT Infrastructure
+ * Copyright (c) 2016 Michael Jacobsen (github.com/mikejac)
+ * 
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ * 
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+ * THE SOFTWARE.
+ *
+ */
+
+package mqttfabric
+
+import (
+    "log"
+    "errors"
+    MQTT "github.com/eclipse/paho.mqtt.golang"  // import the Paho Go MQTT library
+)
+
+// PahoTransport is a Transport using the Eclipse Paho MQTT client
+//
+type PahoTransport struct {
+    Options         *MQTT.ClientOptions
+    Client          MQTT.Client
+    OnPublishError  func(err error)     // called for publishes failing after Publish returned
+    
+    onMessage       TransportMessageHandler
+    queue           chan *Message
+    done            chan struct{}
+}
+
+// NewPahoTransport creates a transport from opts. Options like SetOrderMatters()
+// and SetResumeSubs() can be set on opts before calling Connect.
+//
+// With the order mattering (the default) received messages are queued and
+// handled one by one on a separate goroutine, so the queue depth is known.
+// Otherwise Paho calls the handler on a goroutine per message
+//
+func NewPahoTransport(opts *MQTT.ClientOptions) *PahoTransport {
+    return &PahoTransport{Options: opts}
+}
+
+// SetWill ...
+//
+func (t *PahoTransport) SetWill(topic string, payload []byte, qos byte, retain bool) {
+    t.Options.SetBinaryWill(topic, payload, qos, retain)
+}
+
+// SetHandlers ...
+//
+func (t *PahoTransport) SetHandlers(onConnect TransportConnectHandler, onConnectionLost TransportConnectionLostHandler, onMessage TransportMessageHandler) {
+    t.Options.SetOnConnectHandler(func(client MQTT.Client) {
+        onConnect()
+    })
+    t.Options.SetConnectionLostHandler(func(client MQTT.Client, err error) {
+        onConnectionLost(err)
+    })
+    t.onMessage = onMessage
+    
+    t.Options.SetDefaultPublishHandler(func(client MQTT.Client, msg MQTT.Message) {
+        m := &Message{Topic: msg.Topic(), Payload: msg.Payload(), QoS: msg.Qos(), Retained: msg.Retained()}
+        
+        if t.queue == nil {
+            onMessage(m)
+            return
+        }
+        
+        select {
+            case t.queue <- m:
+            case <-t.done:
+        }
+    })
+}
+
+func (t *PahoTransport) deliver(queue chan *Message, done chan struct{}) {
+    for {
+        select {
+            case msg := <-queue:
+                if t.onMessage != nil {
+                    t.onMessage(msg)
+                }
+            case <-done:
+                return
+        }
+    }
+}
+
+// Connect ...
+//
+func (t *PahoTransport) Connect() error {
+    // set before the client runs the handler
+    if t.Options.Order {
+        t.queue = make(chan *Message, 256)
+        t.done  = make(chan struct{})
+        
+        go t.deliver(t.queue, t.done)
+    }
+    
+    t.Client = MQTT.NewClient(t.Options)
+    
+    if token := t.Client.Connect(); token.Wait() && token.Error() != nil {
+        t.stop()
+        return token.Error()
+    }
+    
+    return nil
+}
+
+func (t *PahoTransport) stop() {
+    if t.done == nil {
+        return
+    }
+    
+    select {
+        case <-t.done:
+        default:
+            close(t.done)
+    }
+}
+
+// Disconnect ...
+//
+func (t *PahoTransport) Disconnect(quiesce uint) {
+    if t.Client != nil {
+        t.Client.Disconnect(quiesce)
+    }
+    
+    t.stop()
+}
+
+// QueueDepth returns the number of received messages waiting for the handler,
+// always 0 when the order doesn't matter
+//
+func (t *PahoTransport) QueueDepth() int {
+    return len(t.queue)
+}
+
+// IsConnected ...
+//
+func (t *PahoTransport) IsConnected() bool {
+    return t.Client != nil && t.Client.IsConnected()
+}
+
+// Publish does not wait for the publish to complete since it may be called
+// from within a message handler; errors are logged
+//
+func (t *PahoTransport) Publish(topic string, qos byte, retain bool, payload []byte) error {
+    if t.Client == nil {
+        return errors.New("Publish: not connected")
+    }
+    
+    token := t.Client.Publish(topic, qos, retain, payload)
+    
+    go func() {
+        if token.Wait() && token.Error() != nil {
+            log.Println("Publish(): err = ", token.Error())
+            
+            if t.OnPublishError != nil {
+                t.OnPublishError(token.Error())
+            }
+        }
+    }()
+    
+    return nil
+}
+
+// Subscribe ...
+//
+func (t *PahoTransport) Subscribe(topic string, qos byte) error {
+    if t.Client == nil {
+        return errors.New("Subscribe: not connected")
+    }
+    
+    if token := t.Client.Subscribe(topic, qos, nil); token.Wait() && token.Error() != nil {
+        return token.Error()
+    }
+    
+    return nil
+}
+
+// Unsubscribe ...
+//
+func (t *PahoTransport) Unsubscribe(topics ...string) error {
+    if t.Client == nil {
+        return errors.New("Unsubscribe: not connected")
+    }
+    
+    if token := t.Client.Unsubscribe(topics...); token.Wait() && token.Error() != nil {
+        return token.Error()
+    }
+    
+    return nil
+}